@@ -0,0 +1,91 @@
+package finalize
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// additionalTargets returns the targets of the SRV and MX records of rrs
+// whose addresses are to be added to the additional section, as enabled.
+func (s *Finalize) additionalTargets(rrs []dns.RR) []string {
+	var targets []string
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.SRV:
+			if s.srvAdditional && rr.Target != "." {
+				targets = append(targets, rr.Target)
+			}
+		case *dns.MX:
+			if s.mxAdditional && rr.Mx != "." {
+				targets = append(targets, rr.Mx)
+			}
+		}
+	}
+	return targets
+}
+
+// serveAdditional finalizes an SRV or MX answer by adding the addresses of
+// its targets to the additional section. The lookups are subject to the
+// circuit breaker and max_concurrent, as those of CNAME chains are.
+func (s *Finalize) serveAdditional(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, response *dns.Msg) (int, error) {
+	log.Debugf("Finalizing targets for request: %+v", response)
+	s.recordRequest(ctx, w, r)
+	defer recordDuration(ctx, time.Now())
+
+	state := request.Request{W: w, Req: r}
+	release, err := s.admit(ctx)
+	if err != nil {
+		s.recordOutcome(ctx, w, r, outcomeFailed)
+		code, text := edeFor(err)
+		return s.writeAbandoned(w, state, response, code, text)
+	}
+	defer release()
+
+	s.recordOutcome(ctx, w, r, outcomeFlattened)
+	return s.writeFinalized(ctx, w, state, response, outcomeFlattened)
+}
+
+// addAdditional resolves the A and AAAA records of the SRV and MX targets of
+// the answer of m, following any CNAME chain, and adds the records to the
+// additional section. Targets with addresses in the additional section
+// already are skipped.
+func (s *Finalize) addAdditional(ctx context.Context, state request.Request, m *dns.Msg) {
+	state = s.lookupState(state)
+	present := make(map[string]struct{})
+	for _, rr := range m.Extra {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			present[dns.CanonicalName(rr.Header().Name)] = struct{}{}
+		}
+	}
+
+	for _, target := range s.additionalTargets(m.Answer) {
+		if _, ok := present[dns.CanonicalName(target)]; ok {
+			continue
+		}
+		present[dns.CanonicalName(target)] = struct{}{}
+
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			rrs, err := s.resolveType(ctx, state, target, qtype)
+			if err != nil {
+				log.Debugf("Failed to resolve addresses of target [%s]: %v", target, err)
+				continue
+			}
+			m.Extra = append(m.Extra, s.appendResolved(nil, rrs)...)
+		}
+	}
+	m.Extra = dedup(m.Extra)
+}
+
+// resolveType returns the records of the chain starting at name resolved for
+// qtype instead of the question type of state.
+func (s *Finalize) resolveType(ctx context.Context, state request.Request, name string, qtype uint16) ([]dns.RR, error) {
+	ch, err := s.resolveChain(ctx, withQType(state, qtype), name)
+	if err != nil {
+		return nil, err
+	}
+	return ch.rrs, nil
+}
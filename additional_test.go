@@ -0,0 +1,161 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSSRVAdditional(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"a.example.net.": {plugintest.A("a.example.net. 300 IN A 192.0.2.1")},
+		"b.example.net.": {plugintest.CNAME("b.example.net. 300 IN CNAME c.example.net.")},
+		"c.example.net.": {plugintest.AAAA("c.example.net. 300 IN AAAA 2001:db8::1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.srvAdditional = true
+	f.Next = cnameHandler(
+		plugintest.SRV("_sip._udp.example.com. 300 IN SRV 10 0 5060 a.example.net."),
+		plugintest.SRV("_sip._udp.example.com. 300 IN SRV 20 0 5060 b.example.net."),
+		plugintest.SRV("_sip._udp.example.com. 300 IN SRV 30 0 5060 ."),
+	)
+
+	req := new(dns.Msg)
+	req.SetQuestion("_sip._udp.example.com.", dns.TypeSRV)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(rec.Msg.Answer) != 3 {
+		t.Errorf("Expected the answer to be left as is, got %v", rec.Msg.Answer)
+	}
+	want := map[uint16]int{dns.TypeA: 1, dns.TypeCNAME: 1, dns.TypeAAAA: 1}
+	got := make(map[uint16]int)
+	for _, rr := range rec.Msg.Extra {
+		got[rr.Header().Rrtype]++
+	}
+	for typ, n := range want {
+		if got[typ] != n {
+			t.Errorf("Expected %d %s records in the additional section, got %v", n, dns.TypeToString[typ], rec.Msg.Extra)
+		}
+	}
+}
+
+func TestServeDNSSRVAdditionalPresent(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{}}
+
+	f := New()
+	f.Resolver = resolver
+	f.srvAdditional = true
+	f.Next = plugintest.HandlerFunc(func(_ context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{plugintest.SRV("_sip._udp.example.com. 300 IN SRV 10 0 5060 a.example.net.")}
+		m.Extra = []dns.RR{plugintest.A("a.example.net. 300 IN A 192.0.2.1")}
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("_sip._udp.example.com.", dns.TypeSRV)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(resolver.lookups) != 0 {
+		t.Errorf("Expected no lookups, got %v", resolver.lookups)
+	}
+	if len(rec.Msg.Extra) != 1 {
+		t.Errorf("Expected the additional section to be left as is, got %v", rec.Msg.Extra)
+	}
+}
+
+func TestServeDNSMXAdditional(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"mx.example.com.":   {plugintest.CNAME("mx.example.com. 300 IN CNAME mail.example.net.")},
+		"mail.example.net.": {plugintest.A("mail.example.net. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.srvAdditional = true
+	f.Next = cnameHandler(plugintest.MX("example.com. 300 IN MX 10 mx.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeMX)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rec.Msg.Extra) != 0 {
+		t.Errorf("Expected no additional records without mx_additional, got %v", rec.Msg.Extra)
+	}
+
+	f.mxAdditional = true
+	rec = dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rec.Msg.Extra) != 2 {
+		t.Fatalf("Expected the CNAME and the address of the exchange, got %v", rec.Msg.Extra)
+	}
+	if rec.Msg.Extra[0].Header().Rrtype != dns.TypeCNAME || rec.Msg.Extra[1].Header().Rrtype != dns.TypeA {
+		t.Errorf("Expected the CNAME followed by the address, got %v", rec.Msg.Extra)
+	}
+}
+
+func TestServeDNSAdditionalGates(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(f *Finalize)
+	}{
+		{"circuit_breaker", func(f *Finalize) {
+			f.breaker = newCircuitBreaker(1, time.Minute)
+			f.breaker.failure()
+		}},
+		{"max_concurrent", func(f *Finalize) {
+			f.sem = make(chan struct{}, 1)
+			f.sem <- struct{}{}
+		}},
+	}
+
+	answers := []dns.RR{
+		plugintest.SRV("_sip._udp.example.com. 300 IN SRV 10 0 5060 a.example.net."),
+		plugintest.MX("example.com. 300 IN MX 10 a.example.net."),
+	}
+
+	for _, tc := range tests {
+		for _, answer := range answers {
+			resolver := &stubResolver{answers: map[string][]dns.RR{
+				"a.example.net.": {plugintest.A("a.example.net. 300 IN A 192.0.2.1")},
+			}}
+			f := New()
+			f.Resolver = resolver
+			f.srvAdditional = true
+			f.mxAdditional = true
+			tc.setup(f)
+			f.Next = cnameHandler(answer)
+
+			req := new(dns.Msg)
+			req.SetQuestion(answer.Header().Name, answer.Header().Rrtype)
+			rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+			if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatalf("%s: expected no error, got %v", tc.name, err)
+			}
+			if len(resolver.lookups) != 0 || len(rec.Msg.Extra) != 0 {
+				t.Errorf("%s: expected no lookups of the targets of %s, got %v", tc.name, answer, resolver.lookups)
+			}
+			if len(rec.Msg.Answer) != 1 {
+				t.Errorf("%s: expected the original answer, got %v", tc.name, rec.Msg.Answer)
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package finalize
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+)
+
+// adminServer serves the HTTP endpoints used to inspect and control the
+// plugin at runtime.
+type adminServer struct {
+	addr string
+	mux  *http.ServeMux
+	// token, when set, must be sent as bearer token with every request.
+	token string
+
+	ln net.Listener
+}
+
+func newAdminServer(addr, token string) *adminServer {
+	return &adminServer{addr: addr, mux: http.NewServeMux(), token: token}
+}
+
+// handle registers handler for pattern, behind the token check.
+func (a *adminServer) handle(pattern string, handler http.HandlerFunc) {
+	a.mux.HandleFunc(pattern, a.authorize(handler))
+}
+
+// authorize wraps handler to reject requests without the bearer token of
+// the server. Without a token, only requests that do not change anything,
+// i.e. GET and HEAD requests, are served.
+func (a *adminServer) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	if a.token == "" {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "a token is required to change the plugin", http.StatusForbidden)
+				return
+			}
+			handler(w, r)
+		}
+	}
+	want := []byte("Bearer " + a.token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// start starts listening on the address of the server.
+func (a *adminServer) start() error {
+	ln, err := reuseport.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	a.ln = ln
+	go func() { http.Serve(ln, a.mux) }()
+	return nil
+}
+
+// shutdown stops listening.
+func (a *adminServer) shutdown() error {
+	if a.ln == nil {
+		return nil
+	}
+	err := a.ln.Close()
+	a.ln = nil
+	return err
+}
+
+// writeJSON writes v as the JSON body of a reply.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warningf("Failed to write admin reply: %v", err)
+	}
+}
+
+// cacheDumpEntry is a cached chain as listed by the cache endpoint.
+type cacheDumpEntry struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	ECS     string   `json:"ecs,omitempty"`
+	DO      bool     `json:"do,omitempty"`
+	TTL     int64    `json:"ttl"`
+	Records []string `json:"records"`
+}
+
+// serveCache lists the cached chains on GET and purges them on DELETE,
+// optionally limited to the chains involving the name given as query
+// parameter. Purging applies to the hop cache as well.
+func (s *Finalize) serveCache(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.cache.dump())
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		n := s.cache.purge(name)
+		if s.hops != nil {
+			n += s.hops.purge(name)
+		}
+		log.Infof("Purged %d chains from the cache", n)
+		writeJSON(w, map[string]int{"purged": n})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// settings are the tunables changed at runtime through the settings
+// endpoint. Fields left out of a request are not changed.
+type settings struct {
+	Enabled   *bool `json:"enabled,omitempty"`
+	MaxLookup *int  `json:"max_lookup,omitempty"`
+}
+
+// serveSettings returns the runtime settings on GET and changes them on PUT,
+// so that finalization can be disabled or max_lookup lowered during an
+// incident without restarting the server. Changes are lost on reload.
+func (s *Finalize) serveSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req settings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.MaxLookup != nil && *req.MaxLookup < 0 {
+			http.Error(w, "max_lookup must be 0 for no limit or greater than 0", http.StatusBadRequest)
+			return
+		}
+		if req.Enabled != nil {
+			s.disabled.Store(!*req.Enabled)
+			log.Infof("Finalization %s through the admin endpoint", map[bool]string{true: "enabled", false: "disabled"}[*req.Enabled])
+		}
+		if req.MaxLookup != nil {
+			s.maxLookup.Store(int64(*req.MaxLookup))
+			log.Infof("Max lookup set to %d through the admin endpoint", *req.MaxLookup)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled := !s.disabled.Load()
+	maxLookup := int(s.maxLookup.Load())
+	writeJSON(w, settings{Enabled: &enabled, MaxLookup: &maxLookup})
+}
@@ -0,0 +1,184 @@
+package finalize
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeCache(t *testing.T) {
+	c := newChainCache(10, time.Minute)
+	f := New()
+	f.cache = c
+	f.hops = newChainCache(10, time.Minute)
+	f.hops.add(cacheKey{name: "cdn.example.net.", qtype: dns.TypeA}, []dns.RR{
+		plugintest.A("cdn.example.net. 60 IN A 192.0.2.1"),
+	})
+	c.add(cacheKey{name: "a.example.com.", qtype: dns.TypeA}, []dns.RR{
+		plugintest.CNAME("a.example.com. 60 IN CNAME cdn.example.net."),
+		plugintest.A("cdn.example.net. 60 IN A 192.0.2.1"),
+	})
+	c.add(cacheKey{name: "b.example.com.", qtype: dns.TypeA}, []dns.RR{
+		plugintest.A("b.example.com. 60 IN A 192.0.2.2"),
+	})
+
+	rec := httptest.NewRecorder()
+	f.serveCache(rec, httptest.NewRequest(http.MethodGet, "/cache", nil))
+	var entries []cacheDumpEntry
+	if err := json.NewDecoder(rec.Body).Decode(&entries); err != nil {
+		t.Fatalf("Expected JSON, got %v", err)
+	}
+	if len(entries) != 2 || entries[0].Name != "b.example.com." || entries[1].Type != "A" || len(entries[1].Records) != 2 {
+		t.Errorf("Unexpected cache dump %+v", entries)
+	}
+
+	rec = httptest.NewRecorder()
+	f.serveCache(rec, httptest.NewRequest(http.MethodDelete, "/cache?name=CDN.example.net", nil))
+	if rec.Code != http.StatusOK || c.len() != 1 {
+		t.Errorf("Expected the chain pointing to the name to be purged, got %d entries", c.len())
+	}
+	if f.hops.len() != 0 {
+		t.Errorf("Expected the hop of the name to be purged, got %d entries", f.hops.len())
+	}
+
+	rec = httptest.NewRecorder()
+	f.serveCache(rec, httptest.NewRequest(http.MethodDelete, "/cache", nil))
+	if c.len() != 0 {
+		t.Errorf("Expected the whole cache to be purged, got %d entries", c.len())
+	}
+
+	rec = httptest.NewRecorder()
+	f.serveCache(rec, httptest.NewRequest(http.MethodPost, "/cache", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestAdminServer(t *testing.T) {
+	a := newAdminServer("127.0.0.1:0", "")
+	a.handle("/ping", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	if err := a.start(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	resp, err := http.Get("http://" + a.ln.Addr().String() + "/ping")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if err := a.shutdown(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestAdminServerToken(t *testing.T) {
+	a := newAdminServer("127.0.0.1:0", "secret")
+	a.handle("/ping", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusNoContent},
+	}
+	for i, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		a.mux.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("Test %d: expected status %d, got %d", i, tc.want, rec.Code)
+		}
+	}
+}
+
+func TestAdminServerWithoutToken(t *testing.T) {
+	a := newAdminServer("127.0.0.1:0", "")
+	a.handle("/ping", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) })
+
+	tests := []struct {
+		method string
+		want   int
+	}{
+		{http.MethodGet, http.StatusNoContent},
+		{http.MethodPut, http.StatusForbidden},
+		{http.MethodDelete, http.StatusForbidden},
+	}
+	for i, tc := range tests {
+		rec := httptest.NewRecorder()
+		a.mux.ServeHTTP(rec, httptest.NewRequest(tc.method, "/ping", nil))
+		if rec.Code != tc.want {
+			t.Errorf("Test %d: expected status %d for %s, got %d", i, tc.want, tc.method, rec.Code)
+		}
+	}
+}
+
+func TestServeSettings(t *testing.T) {
+	f := New()
+
+	rec := httptest.NewRecorder()
+	f.serveSettings(rec, httptest.NewRequest(http.MethodPut, "/settings", strings.NewReader(`{"enabled": false, "max_lookup": 3}`)))
+	var got settings
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("Expected JSON, got %v", err)
+	}
+	if *got.Enabled || *got.MaxLookup != 3 || !f.disabled.Load() || f.maxLookup.Load() != 3 {
+		t.Errorf("Expected finalization disabled and max lookup 3, got %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	f.serveSettings(rec, httptest.NewRequest(http.MethodPut, "/settings", strings.NewReader(`{"enabled": true}`)))
+	if rec.Code != http.StatusOK || f.disabled.Load() || f.maxLookup.Load() != 3 {
+		t.Errorf("Expected only finalization to be enabled again, got status %d", rec.Code)
+	}
+
+	for _, body := range []string{`{"max_lookup": -1}`, `enabled`} {
+		rec = httptest.NewRecorder()
+		f.serveSettings(rec, httptest.NewRequest(http.MethodPut, "/settings", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for %s, got %d", http.StatusBadRequest, body, rec.Code)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	f.serveSettings(rec, httptest.NewRequest(http.MethodDelete, "/settings", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestServeDNSDisabled(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+	}}
+	f := New()
+	f.Resolver = resolver
+	f.disabled.Store(true)
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rec.Msg.Answer) != 1 || len(resolver.lookups) != 0 {
+		t.Errorf("Expected the original answer without lookups, got %v", rec.Msg.Answer)
+	}
+}
@@ -0,0 +1,300 @@
+package finalize
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/rand"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// flatten returns the records of rrs answering qname directly: the CNAMEs are
+// removed and the owner of the remaining records is rewritten to qname.
+// Signatures are dropped as well, as they do not cover the rewritten records.
+func flatten(rrs []dns.RR, qname string) []dns.RR {
+	flat := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeCNAME, dns.TypeRRSIG:
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = qname
+		flat = append(flat, rr)
+	}
+	return flat
+}
+
+// dedup returns rrs without duplicates. dns.Dedup lowers the TTL of the
+// record it keeps to that of its duplicates, so it is given copies: the
+// records may be shared with the next plugin's zone data or the cache.
+func dedup(rrs []dns.RR) []dns.RR {
+	copied := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		copied[i] = dns.Copy(rr)
+	}
+	return dns.Dedup(copied, nil)
+}
+
+// mergeSections adds the authority records of reply owned by the looked up
+// name or one of its parents to m, along with the additional records of reply
+// holding the addresses of the name servers among them. Other records are
+// dropped, like unrelated records of the answer.
+func mergeSections(m, reply *dns.Msg) {
+	name := reply.Question[0].Name
+	servers := make(map[string]struct{})
+	for _, rr := range reply.Ns {
+		if !dns.IsSubDomain(rr.Header().Name, name) {
+			continue
+		}
+		m.Ns = append(m.Ns, rr)
+		if ns, ok := rr.(*dns.NS); ok {
+			servers[dns.CanonicalName(ns.Ns)] = struct{}{}
+		}
+	}
+	m.Ns = dedup(m.Ns)
+
+	for _, rr := range reply.Extra {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			if _, ok := servers[dns.CanonicalName(rr.Header().Name)]; ok {
+				m.Extra = append(m.Extra, rr)
+			}
+		}
+	}
+	m.Extra = dedup(m.Extra)
+}
+
+// stripDNSSEC removes the signatures and the denial of existence records from
+// all sections of m, for clients that did not ask for them with the DO bit.
+func stripDNSSEC(m *dns.Msg) {
+	m.Answer = withoutDNSSEC(m.Answer)
+	m.Ns = withoutDNSSEC(m.Ns)
+	m.Extra = withoutDNSSEC(m.Extra)
+}
+
+func withoutDNSSEC(rrs []dns.RR) []dns.RR {
+	kept := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+// negativeAuthority returns the SOA records of the authority section of reply
+// owned by the looked up name or one of its parents.
+func negativeAuthority(reply *dns.Msg) []dns.RR {
+	var soa []dns.RR
+	for _, rr := range reply.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA && dns.IsSubDomain(rr.Header().Name, reply.Question[0].Name) {
+			soa = append(soa, rr)
+		}
+	}
+	return soa
+}
+
+// minimize removes the authority and additional records of m, except for the
+// OPT record and, in negative answers, the SOA records needed to cache them.
+func minimize(m *dns.Msg) {
+	var ns []dns.RR
+	if len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				ns = append(ns, rr)
+			}
+		}
+	}
+	m.Ns = ns
+
+	var extra []dns.RR
+	if opt := m.IsEdns0(); opt != nil {
+		extra = append(extra, opt)
+	}
+	m.Extra = extra
+}
+
+// harmonizeTTLs sets the TTL of the records of rrs other than CNAMEs, or of
+// all records if all is true, to the lowest TTL in rrs, so that no record
+// outlives the shortest-lived link of the chain.
+func harmonizeTTLs(rrs []dns.RR, all bool) []dns.RR {
+	ttl := minTTL(rrs)
+	harmonized := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		if rr.Header().Ttl == ttl || (!all && rr.Header().Rrtype == dns.TypeCNAME) {
+			harmonized[i] = rr
+			continue
+		}
+		harmonized[i] = dns.Copy(rr)
+		harmonized[i].Header().Ttl = ttl
+	}
+	return harmonized
+}
+
+// clampTTLs returns rrs with their TTLs raised to floor and lowered to ceiling.
+// A bound of 0 is not applied.
+func clampTTLs(rrs []dns.RR, floor, ceiling uint32) []dns.RR {
+	clamped := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		ttl := rr.Header().Ttl
+		if floor > 0 {
+			ttl = max(ttl, floor)
+		}
+		if ceiling > 0 {
+			ttl = min(ttl, ceiling)
+		}
+		if ttl == rr.Header().Ttl {
+			clamped[i] = rr
+			continue
+		}
+		clamped[i] = dns.Copy(rr)
+		clamped[i].Header().Ttl = ttl
+	}
+	return clamped
+}
+
+// trimAddresses returns rrs with at most n A and AAAA records, keeping the
+// first ones. If any are removed, the signatures of the address records are
+// removed as well, as they no longer cover the remaining set.
+func trimAddresses(rrs []dns.RR, n int) []dns.RR {
+	idx := addressIndexes(rrs)
+	if len(idx) <= n {
+		return rrs
+	}
+	trimmed := make([]dns.RR, 0, len(rrs)-len(idx)+n)
+	kept := 0
+	for _, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			if kept == n {
+				continue
+			}
+			kept++
+		case dns.TypeRRSIG:
+			switch rr.(*dns.RRSIG).TypeCovered {
+			case dns.TypeA, dns.TypeAAAA:
+				continue
+			}
+		}
+		trimmed = append(trimmed, rr)
+	}
+	return trimmed
+}
+
+// addressOrder defines how the address records of finalized answers are
+// ordered, so that clients always picking the first one spread their load.
+type addressOrder interface {
+	order(rrs []dns.RR)
+}
+
+// newAddressOrder returns a new instance of the address order called name.
+// The random order uses seed, if not 0, so that it is reproducible.
+func newAddressOrder(name string, seed int64) (addressOrder, error) {
+	switch name {
+	case "random":
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		return &randomOrder{rn: rand.New(seed)}, nil
+	case "round_robin":
+		return &roundRobinOrder{}, nil
+	}
+	return nil, fmt.Errorf("unknown address order '%s'", name)
+}
+
+// randomOrder shuffles the address records.
+type randomOrder struct {
+	rn *rand.Rand
+}
+
+func (r *randomOrder) order(rrs []dns.RR) {
+	idx := addressIndexes(rrs)
+	if len(idx) < 2 {
+		return
+	}
+	addrs := make([]dns.RR, len(idx))
+	for i, p := range r.rn.Perm(len(idx)) {
+		addrs[i] = rrs[idx[p]]
+	}
+	for i, j := range idx {
+		rrs[j] = addrs[i]
+	}
+}
+
+// roundRobinOrder rotates the address records by one for each answer.
+type roundRobinOrder struct {
+	robin uint32
+}
+
+func (r *roundRobinOrder) order(rrs []dns.RR) {
+	idx := addressIndexes(rrs)
+	if len(idx) < 2 {
+		return
+	}
+	shift := int(atomic.AddUint32(&r.robin, 1) % uint32(len(idx)))
+	addrs := make([]dns.RR, len(idx))
+	for i, j := range idx {
+		addrs[i] = rrs[j]
+	}
+	for i, j := range idx {
+		rrs[j] = addrs[(i+shift)%len(idx)]
+	}
+}
+
+// addressIndexes returns the indexes of the A and AAAA records of rrs.
+func addressIndexes(rrs []dns.RR) []int {
+	var idx []int
+	for i, rr := range rrs {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// The ways of making a response fit that remove records from it.
+const (
+	fitFlattened = "flattened"
+	fitTruncated = "truncated"
+)
+
+// fitResponse makes m fit into the buffer size of the client of state. If m
+// is too large, it is compressed, and the number of bytes saved by that is
+// returned. Answers that fit without compression are left alone, as CoreDNS
+// sends them uncompressed anyway. If m is still too large, the CNAMEs of the
+// answer are dropped first by flattening it, as the addresses matter most to
+// the client. If that is not enough, records are removed and the TC bit is
+// set, so that the client retries over TCP. Which of the two was needed, if
+// any, is returned as fitFlattened or fitTruncated.
+func fitResponse(m *dns.Msg, state request.Request) (int, string) {
+	size := max(state.Size(), dns.MinMsgSize)
+	// the OPT record of the request is added to m when it is written
+	if o := state.Req.IsEdns0(); o != nil && m.IsEdns0() == nil {
+		size -= dns.Len(o)
+	}
+
+	m.Compress = false
+	l := m.Len()
+	if l <= size {
+		return 0, ""
+	}
+	m.Compress = true
+	saved := l - m.Len()
+	if m.Len() <= size {
+		return saved, ""
+	}
+	if !state.Do() {
+		m.Answer = flatten(m.Answer, m.Question[0].Name)
+		if m.Len() <= size {
+			return saved, fitFlattened
+		}
+	}
+	m.Truncate(size)
+	return saved, fitTruncated
+}
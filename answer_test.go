@@ -0,0 +1,284 @@
+package finalize
+
+import (
+	"fmt"
+	"testing"
+
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestFlatten(t *testing.T) {
+	rrs := []dns.RR{
+		plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."),
+		plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com."),
+		plugintest.A("c.example.com. 60 IN A 192.0.2.1"),
+		plugintest.A("c.example.com. 60 IN A 192.0.2.2"),
+		plugintest.RRSIG("c.example.com. 60 IN RRSIG A 8 3 60 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl"),
+	}
+
+	flat := flatten(rrs, "A.example.com.")
+	if len(flat) != 2 {
+		t.Fatalf("Expected 2 records, got %v", flat)
+	}
+	for _, rr := range flat {
+		if rr.Header().Rrtype != dns.TypeA || rr.Header().Name != "A.example.com." {
+			t.Errorf("Expected an A record owned by A.example.com., got %v", rr)
+		}
+	}
+	if rrs[2].Header().Name != "c.example.com." {
+		t.Errorf("Expected the original records to be left unmodified, got %v", rrs[2])
+	}
+}
+
+func TestMergeSections(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.com.", dns.TypeA)
+	m.Ns = []dns.RR{plugintest.NS("example.com. 300 IN NS ns1.example.com.")}
+
+	reply := new(dns.Msg)
+	reply.SetQuestion("b.cdn.example.net.", dns.TypeA)
+	reply.Ns = []dns.RR{
+		plugintest.NS("cdn.example.net. 300 IN NS ns1.cdn.example.net."),
+		plugintest.NS("example.org. 300 IN NS ns1.example.org."),
+		plugintest.NS("example.com. 300 IN NS ns1.example.com."),
+	}
+	reply.Extra = []dns.RR{
+		plugintest.A("ns1.cdn.example.net. 300 IN A 192.0.2.53"),
+		plugintest.A("ns1.example.org. 300 IN A 192.0.2.54"),
+		plugintest.A("www.example.net. 300 IN A 192.0.2.1"),
+	}
+
+	mergeSections(m, reply)
+	if len(m.Ns) != 2 || m.Ns[1].(*dns.NS).Hdr.Name != "cdn.example.net." {
+		t.Errorf("Expected the NS records of example.com. and cdn.example.net., got %v", m.Ns)
+	}
+	if len(m.Extra) != 1 || m.Extra[0].Header().Name != "ns1.cdn.example.net." {
+		t.Errorf("Expected the address of ns1.cdn.example.net., got %v", m.Extra)
+	}
+}
+
+func TestStripDNSSEC(t *testing.T) {
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{
+		plugintest.A("a.example.com. 300 IN A 192.0.2.1"),
+		plugintest.RRSIG("a.example.com. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl"),
+	}
+	m.Ns = []dns.RR{
+		plugintest.NS("example.com. 300 IN NS ns.example.com."),
+		plugintest.NSEC("a.example.com. 300 IN NSEC b.example.com. A RRSIG NSEC"),
+	}
+	m.Extra = []dns.RR{plugintest.A("ns.example.com. 300 IN A 192.0.2.53")}
+
+	stripDNSSEC(m)
+	if len(m.Answer) != 1 || len(m.Ns) != 1 || len(m.Extra) != 1 {
+		t.Errorf("Expected the signature and the NSEC record to be removed, got %v", m)
+	}
+	if m.Answer[0].Header().Rrtype != dns.TypeA || m.Ns[0].Header().Rrtype != dns.TypeNS {
+		t.Errorf("Expected the other records to be kept, got %v", m)
+	}
+}
+
+func TestNegativeAuthority(t *testing.T) {
+	reply := new(dns.Msg)
+	reply.SetQuestion("b.example.net.", dns.TypeA)
+	reply.Ns = []dns.RR{
+		plugintest.SOA("example.net. 60 IN SOA ns.example.net. hostmaster.example.net. 1 7200 3600 1209600 60"),
+		plugintest.SOA("example.org. 60 IN SOA ns.example.org. hostmaster.example.org. 1 7200 3600 1209600 60"),
+		plugintest.NS("example.net. 300 IN NS ns.example.net."),
+	}
+
+	if soa := negativeAuthority(reply); len(soa) != 1 || soa[0] != reply.Ns[0] {
+		t.Errorf("Expected the SOA record of example.net., got %v", soa)
+	}
+}
+
+func TestMinimize(t *testing.T) {
+	soa := plugintest.SOA("example.net. 60 IN SOA ns.example.net. hostmaster.example.net. 1 7200 3600 1209600 60")
+	ns := plugintest.NS("example.net. 300 IN NS ns.example.net.")
+	glue := plugintest.A("ns.example.net. 300 IN A 192.0.2.53")
+
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.com.", dns.TypeA)
+	m.Answer = []dns.RR{plugintest.A("a.example.com. 60 IN A 192.0.2.1")}
+	m.Ns = []dns.RR{ns, soa}
+	m.Extra = []dns.RR{glue}
+	m.SetEdns0(1232, false)
+
+	minimize(m)
+	if len(m.Ns) != 0 || len(m.Extra) != 1 || m.IsEdns0() == nil {
+		t.Errorf("Expected only the answer and the OPT record, got %v", m)
+	}
+
+	m.Answer = nil
+	m.Ns = []dns.RR{ns, soa}
+	minimize(m)
+	if len(m.Ns) != 1 || m.Ns[0] != soa {
+		t.Errorf("Expected the SOA record of the negative answer, got %v", m.Ns)
+	}
+}
+
+func TestHarmonizeTTLs(t *testing.T) {
+	rrs := []dns.RR{
+		plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."),
+		plugintest.CNAME("b.example.com. 30 IN CNAME c.example.com."),
+		plugintest.A("c.example.com. 60 IN A 192.0.2.1"),
+	}
+
+	harmonized := harmonizeTTLs(rrs, false)
+	if harmonized[0].Header().Ttl != 300 || harmonized[2].Header().Ttl != 30 {
+		t.Errorf("Expected the A record to get TTL 30 and the CNAMEs to be kept, got %v", harmonized)
+	}
+	if rrs[2].Header().Ttl != 60 {
+		t.Errorf("Expected the original records to be left unmodified, got %v", rrs[2])
+	}
+
+	harmonized = harmonizeTTLs(rrs, true)
+	for _, rr := range harmonized {
+		if rr.Header().Ttl != 30 {
+			t.Errorf("Expected TTL 30, got %v", rr)
+		}
+	}
+}
+
+func TestClampTTLs(t *testing.T) {
+	rrs := []dns.RR{
+		plugintest.A("c.example.com. 1 IN A 192.0.2.1"),
+		plugintest.A("c.example.com. 60 IN A 192.0.2.2"),
+		plugintest.A("c.example.com. 3600 IN A 192.0.2.3"),
+	}
+
+	tests := []struct {
+		floor, ceiling uint32
+		want           []uint32
+	}{
+		{30, 300, []uint32{30, 60, 300}},
+		{30, 0, []uint32{30, 60, 3600}},
+		{0, 300, []uint32{1, 60, 300}},
+		{0, 0, []uint32{1, 60, 3600}},
+	}
+
+	for i, tc := range tests {
+		clamped := clampTTLs(rrs, tc.floor, tc.ceiling)
+		for j, rr := range clamped {
+			if rr.Header().Ttl != tc.want[j] {
+				t.Errorf("Test %d: expected TTL %d, got %v", i, tc.want[j], rr)
+			}
+		}
+	}
+	if rrs[0].Header().Ttl != 1 {
+		t.Errorf("Expected the original records to be left unmodified, got %v", rrs[0])
+	}
+}
+
+func TestTrimAddresses(t *testing.T) {
+	rrs := []dns.RR{
+		plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."),
+		plugintest.A("b.example.com. 60 IN A 192.0.2.1"),
+		plugintest.A("b.example.com. 60 IN A 192.0.2.2"),
+		plugintest.A("b.example.com. 60 IN A 192.0.2.3"),
+		plugintest.RRSIG("b.example.com. 60 IN RRSIG A 8 3 60 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl"),
+	}
+
+	if trimmed := trimAddresses(rrs, 3); len(trimmed) != 5 {
+		t.Errorf("Expected all records within the limit, got %v", trimmed)
+	}
+
+	trimmed := trimAddresses(rrs, 2)
+	if len(trimmed) != 3 || trimmed[0] != rrs[0] || trimmed[1] != rrs[1] || trimmed[2] != rrs[2] {
+		t.Errorf("Expected the CNAME and the first 2 addresses, got %v", trimmed)
+	}
+}
+
+func TestAddressOrder(t *testing.T) {
+	answer := func() []dns.RR {
+		return []dns.RR{
+			plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."),
+			plugintest.A("b.example.com. 60 IN A 192.0.2.1"),
+			plugintest.A("b.example.com. 60 IN A 192.0.2.2"),
+			plugintest.A("b.example.com. 60 IN A 192.0.2.3"),
+		}
+	}
+	first := func(rrs []dns.RR) string { return rrs[1].(*dns.A).A.String() }
+
+	order, _ := newAddressOrder("round_robin", 0)
+	for _, want := range []string{"192.0.2.2", "192.0.2.3", "192.0.2.1"} {
+		rrs := answer()
+		order.order(rrs)
+		if rrs[0].Header().Rrtype != dns.TypeCNAME || first(rrs) != want {
+			t.Errorf("Expected the CNAME followed by %s, got %v", want, rrs)
+		}
+	}
+
+	a, _ := newAddressOrder("random", 42)
+	b, _ := newAddressOrder("random", 42)
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		x, y := answer(), answer()
+		a.order(x)
+		b.order(y)
+		if x[0].Header().Rrtype != dns.TypeCNAME || len(dns.Dedup(x, nil)) != 4 {
+			t.Fatalf("Expected the CNAME followed by the shuffled addresses, got %v", x)
+		}
+		if first(x) != first(y) {
+			t.Fatalf("Expected the same order for the same seed, got %v and %v", x, y)
+		}
+		seen[first(x)] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("Expected the addresses to be shuffled, got %v first", seen)
+	}
+
+	if _, err := newAddressOrder("sequential", 0); err == nil {
+		t.Errorf("Expected an error for an unknown address order")
+	}
+}
+
+func TestFitResponse(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: req}
+
+	answer := func(hops, addrs int) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		name := "a.example.com."
+		for i := 0; i < hops; i++ {
+			target := fmt.Sprintf("hop%d.some-long-cdn-name-%d.example.net.", i, i)
+			m.Answer = append(m.Answer, plugintest.CNAME(name+" 300 IN CNAME "+target))
+			name = target
+		}
+		for i := 0; i < addrs; i++ {
+			m.Answer = append(m.Answer, plugintest.A(fmt.Sprintf("%s 60 IN A 192.0.2.%d", name, i+1)))
+		}
+		return m
+	}
+
+	m := answer(2, 2)
+	if saved, trimmed := fitResponse(m, state); saved != 0 || trimmed != "" || len(m.Answer) != 4 || m.Truncated {
+		t.Errorf("Expected the answer to be kept, got %v", m)
+	}
+
+	m = answer(8, 4)
+	if saved, trimmed := fitResponse(m, state); saved <= 0 || trimmed != "" || !m.Compress || len(m.Answer) != 12 || m.Truncated {
+		t.Errorf("Expected the answer to be compressed, saving %d bytes, got %v", saved, m)
+	}
+
+	m = answer(20, 4)
+	if _, trimmed := fitResponse(m, state); trimmed != fitFlattened || len(m.Answer) != 4 || m.Answer[0].Header().Rrtype != dns.TypeA || m.Truncated || m.Len() > dns.MinMsgSize {
+		t.Errorf("Expected the answer to be flattened, got %v", m)
+	}
+
+	m = answer(2, 60)
+	if _, trimmed := fitResponse(m, state); trimmed != fitTruncated || !m.Truncated || len(m.Answer) >= 60 || m.Len() > dns.MinMsgSize {
+		t.Errorf("Expected a truncated answer, got %d records of %d bytes", len(m.Answer), m.Len())
+	}
+
+	req.SetEdns0(4096, false)
+	m = answer(2, 60)
+	fitResponse(m, state)
+	if len(m.Answer) != 62 || m.Truncated {
+		t.Errorf("Expected the answer to fit into the EDNS buffer size, got %v", m)
+	}
+}
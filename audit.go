@@ -0,0 +1,114 @@
+package finalize
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// auditStdout is the audit log path writing to the standard output.
+const auditStdout = "stdout"
+
+// auditLog writes a JSON line for every chain that was blocked or could not
+// be finalized, as a trail for security reviews.
+type auditLog struct {
+	path string
+	now  func() time.Time
+
+	mu sync.Mutex
+	w  io.Writer
+	f  *os.File
+}
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Client string    `json:"client"`
+	Chain  []string  `json:"chain"`
+	Reason string    `json:"reason"`
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{path: path, now: time.Now}
+}
+
+// open opens the file of the log for appending, creating it if needed.
+func (a *auditLog) open() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.path == auditStdout {
+		a.w = os.Stdout
+		return nil
+	}
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	a.w, a.f = f, f
+	return nil
+}
+
+// close closes the file of the log.
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.w = nil
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+// write appends rec to the log.
+func (a *auditLog) write(rec auditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Warningf("Failed to encode audit record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.w == nil {
+		return
+	}
+	if _, err := a.w.Write(line); err != nil {
+		log.Warningf("Failed to write audit log %s: %v", a.path, err)
+	}
+}
+
+// audit records in the audit log, if enabled, that the chain of the original
+// answer response to the request of state was blocked or failed, as event,
+// because of reason.
+func (s *Finalize) audit(state request.Request, response *dns.Msg, event, reason string) {
+	if s.audits == nil {
+		return
+	}
+	var answer []dns.RR
+	if response != nil {
+		answer = response.Answer
+	}
+	s.audits.write(auditRecord{
+		Time:   s.audits.now().UTC(),
+		Event:  event,
+		Name:   state.Name(),
+		Type:   state.Type(),
+		Client: state.IP(),
+		Chain:  chainNames(state.Name(), answer),
+		Reason: reason,
+	})
+}
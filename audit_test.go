@@ -0,0 +1,78 @@
+package finalize
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	f := New()
+	f.Resolver = &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.net.")},
+	}}
+	f.denyTargets = plugin.Zones{"example.net."}
+	f.audits = newAuditLog(path)
+	f.audits.now = func() time.Time { return time.Unix(0, 0) }
+	if err := f.OnStartup(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for _, name := range []string{"a.example.com.", "x.example.com."} {
+		f.Next = cnameHandler(plugintest.CNAME(name + " 300 IN CNAME b.example.com."))
+		if name == "x.example.com." {
+			// the lookup of the target fails
+			f.Resolver = &stubResolver{answers: map[string][]dns.RR{}}
+		}
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if err := f.OnShutdown(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Expected a JSON line, got %s: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %+v", records)
+	}
+	blocked, failed := records[0], records[1]
+	if blocked.Event != "blocked" || blocked.Name != "a.example.com." || blocked.Type != "A" || blocked.Client != "10.240.0.1" || blocked.Reason == "" {
+		t.Errorf("Unexpected record %+v", blocked)
+	}
+	if len(blocked.Chain) != 2 || blocked.Chain[1] != "b.example.com." || !blocked.Time.Equal(time.Unix(0, 0)) {
+		t.Errorf("Unexpected chain or time %+v", blocked)
+	}
+	if failed.Event != "failed" || failed.Name != "x.example.com." {
+		t.Errorf("Unexpected record %+v", failed)
+	}
+}
@@ -0,0 +1,69 @@
+package finalize
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// errBudget is returned when a client has used up its lookup budget.
+var errBudget = errors.New("client lookup budget exceeded")
+
+// maxBudgetEntries is the number of clients whose budget is tracked.
+const maxBudgetEntries = 10000
+
+// clientBudget limits the rate of lookups triggered by each client address,
+// so that a single client asking for long chains can not multiply the
+// traffic sent upstream. The budgets of at most size clients are tracked, the
+// client that has been seen least recently is forgotten first.
+type clientBudget struct {
+	limit rate.Limit
+	burst int
+	size  int
+	now   func() time.Time
+
+	mu      sync.Mutex
+	ll      *list.List
+	clients map[string]*list.Element
+}
+
+type budgetEntry struct {
+	ip      string
+	limiter *rate.Limiter
+}
+
+func newClientBudget(limit rate.Limit, burst int) *clientBudget {
+	return &clientBudget{
+		limit:   limit,
+		burst:   burst,
+		size:    maxBudgetEntries,
+		now:     time.Now,
+		ll:      list.New(),
+		clients: make(map[string]*list.Element),
+	}
+}
+
+// allow reports whether the client with address ip may trigger another lookup.
+func (b *clientBudget) allow(ip string) bool {
+	now := b.now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if el, ok := b.clients[ip]; ok {
+		b.ll.MoveToFront(el)
+		return el.Value.(*budgetEntry).limiter.AllowN(now, 1)
+	}
+
+	l := rate.NewLimiter(b.limit, b.burst)
+	b.clients[ip] = b.ll.PushFront(&budgetEntry{ip: ip, limiter: l})
+	if b.ll.Len() > b.size {
+		oldest := b.ll.Back()
+		b.ll.Remove(oldest)
+		delete(b.clients, oldest.Value.(*budgetEntry).ip)
+	}
+	return l.AllowN(now, 1)
+}
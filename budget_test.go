@@ -0,0 +1,84 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+func TestClientBudget(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newClientBudget(rate.Every(time.Second), 2)
+	b.now = func() time.Time { return now }
+
+	for i, want := range []bool{true, true, false} {
+		if got := b.allow("192.0.2.1"); got != want {
+			t.Errorf("Lookup %d: expected %t, got %t", i, want, got)
+		}
+	}
+	if !b.allow("192.0.2.2") {
+		t.Error("Expected the budget of another client to be untouched")
+	}
+
+	now = now.Add(time.Second)
+	if !b.allow("192.0.2.1") {
+		t.Error("Expected the budget to be refilled")
+	}
+}
+
+func TestClientBudgetSize(t *testing.T) {
+	b := newClientBudget(rate.Every(time.Hour), 1)
+	b.size = 2
+
+	b.allow("192.0.2.1")
+	b.allow("192.0.2.2")
+	b.allow("192.0.2.1")
+	b.allow("192.0.2.3")
+	if len(b.clients) != 2 || b.ll.Len() != 2 {
+		t.Fatalf("Expected the budgets of 2 clients, got %d", len(b.clients))
+	}
+	if _, ok := b.clients["192.0.2.2"]; ok {
+		t.Error("Expected the client seen least recently to be forgotten")
+	}
+	if b.allow("192.0.2.1") {
+		t.Error("Expected the budget of a recent client to be kept")
+	}
+}
+
+func TestServeDNSClientBudget(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com.")},
+		"c.example.com.": {plugintest.A("c.example.com. 300 IN A 192.0.2.1")},
+	}}
+	f := New()
+	f.Resolver = resolver
+	f.budget = newClientBudget(rate.Every(time.Hour), 3)
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+
+	// the second request of the client would need two more lookups, but only
+	// one is left
+	for i, want := range []int{3, 1} {
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Request %d: expected no error, got %v", i, err)
+		}
+		if len(rec.Msg.Answer) != want {
+			t.Errorf("Request %d: expected %d answers, got %v", i, want, rec.Msg.Answer)
+		}
+	}
+
+	// another client has its own budget
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter6{})
+	f.ServeDNS(context.Background(), rec, req)
+	if len(rec.Msg.Answer) != 3 {
+		t.Errorf("Expected 3 answers for another client, got %v", rec.Msg.Answer)
+	}
+}
@@ -0,0 +1,418 @@
+package finalize
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultCacheSize is the number of chains cached when only cache_ttl_cap is given.
+	defaultCacheSize = 10000
+	// defaultCacheTTLCap is the longest time a chain is cached when only cache_size is given.
+	defaultCacheTTLCap = time.Hour
+	// defaultStaleFor is the longest time an expired chain is served by serve_stale.
+	defaultStaleFor = time.Hour
+	// staleTTL is the TTL of the records of an expired chain when served.
+	staleTTL = 30
+	// defaultPrefetchWindow is the period in which the hits of a chain are counted for prefetching.
+	defaultPrefetchWindow = time.Minute
+	// defaultPrefetchPercentage is the percentage of its TTL left when a chain is prefetched.
+	defaultPrefetchPercentage = 10
+)
+
+// chainCache is an LRU cache of the records resolved for CNAME chains, i.e.
+// the records following the answer of the plugin chain. Entries expire with
+// the lowest TTL of their records, capped at ttlCap. Expired entries are kept
+// for staleFor to be served when resolving the chain fails.
+type chainCache struct {
+	size     int
+	ttlCap   time.Duration
+	staleFor time.Duration
+	now      func() time.Time
+
+	// prefetchHits is the number of hits within prefetchWindow after which a
+	// chain is refreshed once less than prefetchPercentage of its TTL is left.
+	// Prefetching is disabled if 0.
+	prefetchHits       int
+	prefetchWindow     time.Duration
+	prefetchPercentage int
+
+	// shared, when set, is a second level cache shared with other instances,
+	// holding its keys under sharedPrefix.
+	shared       sharedStore
+	sharedPrefix string
+
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[cacheKey]*list.Element
+	// scopes counts the entries per scope prefix length.
+	scopes map[uint8]int
+}
+
+// cacheKey identifies a chain by its first target, the question type and the
+// EDNS Client Subnet of the lookups, truncated to the scope prefix length
+// returned by the upstream.
+type cacheKey struct {
+	name  string
+	qtype uint16
+	ecs   string
+	scope uint8
+	// do is set for chains resolved with the DO bit, which carry signatures.
+	do bool
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	rrs     []dns.RR
+	stored  time.Time
+	expires time.Time
+
+	hits        int
+	windowStart time.Time
+	prefetching bool
+}
+
+func newChainCache(size int, ttlCap time.Duration) *chainCache {
+	return &chainCache{
+		size:    size,
+		ttlCap:  ttlCap,
+		now:     time.Now,
+		ll:      list.New(),
+		entries: make(map[cacheKey]*list.Element),
+		scopes:  make(map[uint8]int),
+	}
+}
+
+// newCacheKey returns the key of the chain starting at target for state,
+// including the full source prefix of its client subnet.
+func newCacheKey(state request.Request, target string) cacheKey {
+	return scopedCacheKey(state, target, math.MaxUint8)
+}
+
+// scopedCacheKey returns the key of the chain starting at target for state,
+// with its client subnet truncated to scope bits. A scope of 0 means the chain
+// is valid for all clients.
+func scopedCacheKey(state request.Request, target string, scope uint8) cacheKey {
+	key := cacheKey{name: dns.CanonicalName(target), qtype: state.QType()}
+	if o := state.Req.IsEdns0(); o != nil {
+		key.do = o.Do()
+	}
+	ecs := clientSubnet(state.Req)
+	if ecs == nil || scope == 0 {
+		return key
+	}
+	key.scope = min(scope, ecs.SourceNetmask)
+	bits := 8 * net.IPv4len
+	if ecs.Family == 2 {
+		bits = 8 * net.IPv6len
+	}
+	key.ecs = fmt.Sprintf("%s/%d", ecs.Address.Mask(net.CIDRMask(int(key.scope), bits)), key.scope)
+	return key
+}
+
+// keysFor returns the keys the chain starting at target may be cached under
+// for state, most specific first. These are the keys for each scope of the
+// cached entries that is covered by the client subnet of state.
+func (c *chainCache) keysFor(state request.Request, target string) []cacheKey {
+	ecs := clientSubnet(state.Req)
+	if ecs == nil {
+		return []cacheKey{scopedCacheKey(state, target, 0)}
+	}
+
+	c.mu.Lock()
+	scopes := make([]uint8, 0, len(c.scopes))
+	for scope := range c.scopes {
+		if scope > 0 && scope <= ecs.SourceNetmask {
+			scopes = append(scopes, scope)
+		}
+	}
+	c.mu.Unlock()
+	slices.Sort(scopes)
+
+	keys := make([]cacheKey, 0, len(scopes)+1)
+	for i := len(scopes) - 1; i >= 0; i-- {
+		keys = append(keys, scopedCacheKey(state, target, scopes[i]))
+	}
+	return append(keys, scopedCacheKey(state, target, 0))
+}
+
+// get returns a copy of the records cached for key with their TTLs decreased
+// by the time passed since they were stored.
+func (c *chainCache) get(key cacheKey) ([]dns.RR, bool) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		if !now.Before(e.expires.Add(c.staleFor)) {
+			c.remove(el)
+		}
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+
+	elapsed := uint32(now.Sub(e.stored).Seconds())
+	rrs := make([]dns.RR, len(e.rrs))
+	for i, rr := range e.rrs {
+		rrs[i] = dns.Copy(rr)
+		rrs[i].Header().Ttl -= elapsed
+	}
+	return rrs, true
+}
+
+// getStale returns a copy of the records cached for key if they expired less
+// than staleFor ago. Their TTLs are set to staleTTL.
+func (c *chainCache) getStale(key cacheKey) ([]dns.RR, bool) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if now.Before(e.expires) || !now.Before(e.expires.Add(c.staleFor)) {
+		return nil, false
+	}
+
+	rrs := make([]dns.RR, len(e.rrs))
+	for i, rr := range e.rrs {
+		rrs[i] = dns.Copy(rr)
+		rrs[i].Header().Ttl = staleTTL
+	}
+	return rrs, true
+}
+
+// add stores a copy of rrs for key, evicting the least recently used entry
+// if the cache is full, in which case true is returned. Records with a TTL of
+// 0 are not cached.
+func (c *chainCache) add(key cacheKey, rrs []dns.RR) bool {
+	ttl := c.ttl(rrs)
+	if ttl <= 0 {
+		return false
+	}
+
+	stored := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		stored[i] = dns.Copy(rr)
+	}
+	now := c.now()
+	e := &cacheEntry{key: key, rrs: stored, stored: now, expires: now.Add(ttl), windowStart: now}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return false
+	}
+	c.entries[key] = c.ll.PushFront(e)
+	c.scopes[key.scope]++
+	if c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+		return true
+	}
+	return false
+}
+
+// store adds rrs for key as add does, and records the eviction and the number
+// of entries in the metrics of the server of ctx.
+func (c *chainCache) store(ctx context.Context, key cacheKey, rrs []dns.RR) {
+	server := metrics.WithServer(ctx)
+	if c.add(key, rrs) {
+		cacheEvictionCount.WithLabelValues(server).Inc()
+	}
+	cacheEntries.WithLabelValues(server).Set(float64(c.len()))
+}
+
+// remove removes the entry of el. c.mu must be held.
+func (c *chainCache) remove(el *list.Element) {
+	key := el.Value.(*cacheEntry).key
+	c.ll.Remove(el)
+	delete(c.entries, key)
+	if c.scopes[key.scope]--; c.scopes[key.scope] == 0 {
+		delete(c.scopes, key.scope)
+	}
+}
+
+// getShared looks key up in the shared cache. A chain found there is stored in
+// the local cache as well. Errors of the shared cache are treated as misses.
+func (c *chainCache) getShared(ctx context.Context, key cacheKey) ([]dns.RR, bool) {
+	sctx, cancel := context.WithTimeout(ctx, sharedTimeout)
+	defer cancel()
+
+	b, err := c.shared.get(sctx, sharedKey(c.sharedPrefix, viewName(ctx), key))
+	if err != nil {
+		sharedCacheErrorCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		log.Debugf("Failed to read %s from the shared cache: %v", key.name, err)
+		return nil, false
+	}
+	if b == nil {
+		sharedCacheMissCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		return nil, false
+	}
+	rrs, err := decodeChain(b, c.now())
+	if err != nil {
+		sharedCacheMissCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		log.Debugf("Ignoring shared cache entry of %s: %v", key.name, err)
+		return nil, false
+	}
+	sharedCacheHitCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+	c.store(ctx, key, rrs)
+	return rrs, true
+}
+
+// addShared stores rrs for key in the shared cache, with the same expiry as
+// in the local cache.
+func (c *chainCache) addShared(ctx context.Context, key cacheKey, rrs []dns.RR) {
+	ttl := c.ttl(rrs)
+	if ttl <= 0 {
+		return
+	}
+	b, err := encodeChain(rrs, c.now())
+	if err == nil {
+		sctx, cancel := context.WithTimeout(ctx, sharedTimeout)
+		err = c.shared.set(sctx, sharedKey(c.sharedPrefix, viewName(ctx), key), b, ttl)
+		cancel()
+	}
+	if err != nil {
+		sharedCacheErrorCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		log.Debugf("Failed to write %s to the shared cache: %v", key.name, err)
+	}
+}
+
+// shouldPrefetch records a hit of key and reports whether the chain should be
+// refreshed in the background. It reports true only once per entry.
+func (c *chainCache) shouldPrefetch(key cacheKey) bool {
+	if c.prefetchHits == 0 {
+		return false
+	}
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*cacheEntry)
+	if e.prefetching {
+		return false
+	}
+	if now.Sub(e.windowStart) > c.prefetchWindow {
+		e.windowStart = now
+		e.hits = 0
+	}
+	e.hits++
+	if e.hits < c.prefetchHits {
+		return false
+	}
+	ttl := e.expires.Sub(e.stored)
+	if e.expires.Sub(now) > ttl*time.Duration(c.prefetchPercentage)/100 {
+		return false
+	}
+	e.prefetching = true
+	return true
+}
+
+// ttl returns the time rrs are cached for.
+func (c *chainCache) ttl(rrs []dns.RR) time.Duration {
+	ttl := time.Duration(minTTL(rrs)) * time.Second
+	if ttl > c.ttlCap {
+		return c.ttlCap
+	}
+	return ttl
+}
+
+// dump returns the entries of the cache, most recently used first. The TTL
+// of an expired entry that is kept for serve_stale is negative.
+func (c *chainCache) dump() []cacheDumpEntry {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]cacheDumpEntry, 0, c.ll.Len())
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*cacheEntry)
+		records := make([]string, len(e.rrs))
+		for i, rr := range e.rrs {
+			records[i] = rr.String()
+		}
+		entries = append(entries, cacheDumpEntry{
+			Name:    e.key.name,
+			Type:    dns.TypeToString[e.key.qtype],
+			ECS:     e.key.ecs,
+			DO:      e.key.do,
+			TTL:     int64(e.expires.Sub(now).Seconds()),
+			Records: records,
+		})
+	}
+	return entries
+}
+
+// purge removes the entries whose chain involves name, i.e. that start at name
+// or hold a record owned by or pointing to name. An empty name removes all
+// entries. The number of removed entries is returned.
+func (c *chainCache) purge(name string) int {
+	name = dns.CanonicalName(name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		if name == "." || el.Value.(*cacheEntry).involves(name) {
+			c.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// involves reports whether the chain of e starts at name or holds a record
+// owned by or pointing to name.
+func (e *cacheEntry) involves(name string) bool {
+	if e.key.name == name {
+		return true
+	}
+	for _, rr := range e.rrs {
+		if dns.CanonicalName(rr.Header().Name) == name {
+			return true
+		}
+		if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Target) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// len returns the number of cached entries.
+func (c *chainCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
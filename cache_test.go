@@ -0,0 +1,193 @@
+package finalize
+
+import (
+	"testing"
+	"time"
+
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestChainCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newChainCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	key := cacheKey{name: "b.example.com.", qtype: dns.TypeA}
+	c.add(key, []dns.RR{
+		plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com."),
+		plugintest.A("c.example.com. 30 IN A 192.0.2.1"),
+	})
+
+	now = now.Add(10 * time.Second)
+	rrs, ok := c.get(key)
+	if !ok || len(rrs) != 2 {
+		t.Fatalf("Expected cached chain, got %v", rrs)
+	}
+	if rrs[1].Header().Ttl != 20 {
+		t.Errorf("Expected TTL 20, got %d", rrs[1].Header().Ttl)
+	}
+
+	now = now.Add(20 * time.Second)
+	if rrs, ok := c.get(key); ok {
+		t.Errorf("Expected chain to expire with the lowest TTL, got %v", rrs)
+	}
+	if c.len() != 0 {
+		t.Errorf("Expected expired entry to be removed, got %d entries", c.len())
+	}
+
+	c.add(key, []dns.RR{plugintest.A("b.example.com. 3600 IN A 192.0.2.1")})
+	now = now.Add(time.Minute)
+	if _, ok := c.get(key); ok {
+		t.Errorf("Expected chain to expire with the TTL cap")
+	}
+
+	c.add(key, []dns.RR{plugintest.A("b.example.com. 0 IN A 192.0.2.1")})
+	if _, ok := c.get(key); ok {
+		t.Errorf("Expected records with TTL 0 not to be cached")
+	}
+}
+
+func TestChainCacheEviction(t *testing.T) {
+	c := newChainCache(2, time.Minute)
+	a := cacheKey{name: "a.example.com.", qtype: dns.TypeA}
+	b := cacheKey{name: "b.example.com.", qtype: dns.TypeA}
+	d := cacheKey{name: "d.example.com.", qtype: dns.TypeA}
+	rrs := []dns.RR{plugintest.A("x.example.com. 60 IN A 192.0.2.1")}
+
+	if c.add(a, rrs) || c.add(b, rrs) {
+		t.Errorf("Expected no eviction before the cache is full")
+	}
+	c.get(a)
+	if !c.add(d, rrs) {
+		t.Errorf("Expected an eviction once the cache is full")
+	}
+
+	if _, ok := c.get(b); ok {
+		t.Errorf("Expected least recently used entry to be evicted")
+	}
+	if _, ok := c.get(a); !ok {
+		t.Errorf("Expected recently used entry to be kept")
+	}
+	if _, ok := c.get(d); !ok {
+		t.Errorf("Expected new entry to be cached")
+	}
+}
+
+func TestNewCacheKey(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeAAAA)
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: req}
+
+	key := newCacheKey(state, "B.example.com.")
+	if key != (cacheKey{name: "b.example.com.", qtype: dns.TypeAAAA}) {
+		t.Errorf("Unexpected key %+v", key)
+	}
+
+	state = (&ecsConfig{v4Prefix: 24}).withClientSubnet(state)
+	if key := newCacheKey(state, "b.example.com."); key.ecs != "10.240.0.0/24" || key.scope != 24 {
+		t.Errorf("Expected the client subnet in the key, got %+v", key)
+	}
+	if key := scopedCacheKey(state, "b.example.com.", 16); key.ecs != "10.240.0.0/16" || key.scope != 16 {
+		t.Errorf("Expected the client subnet truncated to the scope, got %+v", key)
+	}
+	if key := scopedCacheKey(state, "b.example.com.", 0); key.ecs != "" {
+		t.Errorf("Expected no client subnet for scope 0, got %+v", key)
+	}
+
+	req = new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeAAAA)
+	req.SetEdns0(4096, true)
+	state = request.Request{W: &plugintest.ResponseWriter{}, Req: req}
+	if key := newCacheKey(state, "b.example.com."); !key.do {
+		t.Errorf("Expected the DO bit in the key, got %+v", key)
+	}
+}
+
+func TestChainCacheKeysFor(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: req}
+	ecsState := (&ecsConfig{v4Prefix: 24}).withClientSubnet(state)
+
+	c := newChainCache(10, time.Minute)
+	rrs := []dns.RR{plugintest.A("x.example.com. 60 IN A 192.0.2.1")}
+	c.add(scopedCacheKey(ecsState, "b.example.com.", 16), rrs)
+	c.add(scopedCacheKey(ecsState, "c.example.com.", 32), rrs)
+	c.add(scopedCacheKey(ecsState, "d.example.com.", 20), rrs)
+
+	keys := c.keysFor(ecsState, "b.example.com.")
+	want := []string{"10.240.0.0/24", "10.240.0.0/20", "10.240.0.0/16", ""}
+	if len(keys) != len(want) {
+		t.Fatalf("Expected %d keys, got %+v", len(want), keys)
+	}
+	for i, key := range keys {
+		if key.ecs != want[i] {
+			t.Errorf("Expected key %d for %q, got %+v", i, want[i], key)
+		}
+	}
+
+	if keys := c.keysFor(state, "b.example.com."); len(keys) != 1 || keys[0].ecs != "" {
+		t.Errorf("Expected a single key without client subnet, got %+v", keys)
+	}
+}
+
+func TestChainCacheStale(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newChainCache(10, time.Minute)
+	c.staleFor = time.Minute
+	c.now = func() time.Time { return now }
+
+	key := cacheKey{name: "b.example.com.", qtype: dns.TypeA}
+	c.add(key, []dns.RR{plugintest.A("b.example.com. 60 IN A 192.0.2.1")})
+
+	if _, ok := c.getStale(key); ok {
+		t.Errorf("Expected no stale records before expiry")
+	}
+
+	now = now.Add(90 * time.Second)
+	if _, ok := c.get(key); ok {
+		t.Errorf("Expected expired records not to be served")
+	}
+	rrs, ok := c.getStale(key)
+	if !ok || rrs[0].Header().Ttl != staleTTL {
+		t.Fatalf("Expected stale records with TTL %d, got %v", staleTTL, rrs)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.getStale(key); ok {
+		t.Errorf("Expected records to be dropped after the stale period")
+	}
+}
+
+func TestChainCachePrefetch(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newChainCache(10, time.Hour)
+	c.prefetchHits = 2
+	c.prefetchWindow = time.Minute
+	c.prefetchPercentage = 10
+	c.now = func() time.Time { return now }
+
+	key := cacheKey{name: "b.example.com.", qtype: dns.TypeA}
+	c.add(key, []dns.RR{plugintest.A("b.example.com. 100 IN A 192.0.2.1")})
+
+	now = now.Add(95 * time.Second)
+	if c.shouldPrefetch(key) {
+		t.Errorf("Expected no prefetch before enough hits")
+	}
+	now = now.Add(time.Second)
+	if !c.shouldPrefetch(key) {
+		t.Errorf("Expected prefetch of a popular chain close to expiry")
+	}
+	if c.shouldPrefetch(key) {
+		t.Errorf("Expected a single prefetch per entry")
+	}
+
+	c.add(key, []dns.RR{plugintest.A("b.example.com. 100 IN A 192.0.2.1")})
+	c.shouldPrefetch(key)
+	now = now.Add(2 * time.Minute)
+	if c.shouldPrefetch(key) {
+		t.Errorf("Expected hits outside the window not to count")
+	}
+}
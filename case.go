@@ -0,0 +1,46 @@
+package finalize
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// errCaseMismatch is returned for replies whose question does not match the
+// randomized case of the query name.
+var errCaseMismatch = errors.New("reply question does not match the query name case")
+
+// randomizeCase returns name with the case of its letters randomized, as
+// described in draft-vixie-dnsext-dns0x20.
+func randomizeCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			if rand.Intn(2) == 0 {
+				b[i] = c | 0x20
+			} else {
+				b[i] = c &^ 0x20
+			}
+		}
+	}
+	return string(b)
+}
+
+// restoreCase checks that the question of ret matches sent exactly and sets
+// the question and the owner names of the records for it back to name.
+func restoreCase(ret *dns.Msg, sent, name string) error {
+	if len(ret.Question) != 1 || ret.Question[0].Name != sent {
+		return errCaseMismatch
+	}
+	ret.Question[0].Name = name
+	for _, section := range [][]dns.RR{ret.Answer, ret.Ns, ret.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, name) {
+				rr.Header().Name = name
+			}
+		}
+	}
+	return nil
+}
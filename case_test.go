@@ -0,0 +1,91 @@
+package finalize
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	name := "a-very-long-name-to-randomize.example.org."
+	mixed := false
+	for i := 0; i < 10; i++ {
+		r := randomizeCase(name)
+		if !strings.EqualFold(r, name) {
+			t.Fatalf("Expected %s to equal %s ignoring case", r, name)
+		}
+		mixed = mixed || r != name
+	}
+	if !mixed {
+		t.Errorf("Expected the case of %s to be randomized", name)
+	}
+}
+
+func TestRestoreCase(t *testing.T) {
+	ret := new(dns.Msg)
+	ret.SetQuestion("ExAmPlE.org.", dns.TypeA)
+	ret.Answer = []dns.RR{
+		plugintest.A("ExAmPlE.org. 60 IN A 192.0.2.1"),
+		plugintest.A("other.org. 60 IN A 192.0.2.2"),
+	}
+
+	if err := restoreCase(ret, "EXAMPLE.org.", "example.org."); err != errCaseMismatch {
+		t.Errorf("Expected %v, got %v", errCaseMismatch, err)
+	}
+	if err := restoreCase(ret, "ExAmPlE.org.", "example.org."); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if ret.Question[0].Name != "example.org." || ret.Answer[0].Header().Name != "example.org." {
+		t.Errorf("Expected the original case to be restored, got %v", ret)
+	}
+	if ret.Answer[1].Header().Name != "other.org." {
+		t.Errorf("Expected other names to be kept, got %s", ret.Answer[1].Header().Name)
+	}
+}
+
+func TestDNSUpstreamRandomizeCase(t *testing.T) {
+	tests := []struct {
+		lower bool
+		err   error
+	}{
+		{false, nil},
+		{true, errCaseMismatch},
+	}
+
+	for i, test := range tests {
+		var asked string
+		s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+			asked = r.Question[0].Name
+			ret := new(dns.Msg)
+			ret.SetReply(r)
+			if test.lower {
+				ret.Question[0].Name = strings.ToLower(ret.Question[0].Name)
+			}
+			ret.Answer = append(ret.Answer, plugintest.A(r.Question[0].Name+" 60 IN A 192.0.2.1"))
+			w.WriteMsg(ret)
+		})
+
+		u := newTestUpstream(s.Addr)
+		u.randomizeCase = true
+		state := request.Request{W: &plugintest.ResponseWriter{}, Req: new(dns.Msg)}
+		m, err := u.Lookup(context.Background(), state, "a-very-long-name-to-randomize.example.org.", dns.TypeA)
+		u.Close()
+		s.Close()
+
+		if !errors.Is(err, test.err) {
+			t.Errorf("Test %d: expected error %v, got %v", i, test.err, err)
+		}
+		if !strings.EqualFold(asked, "a-very-long-name-to-randomize.example.org.") {
+			t.Errorf("Test %d: expected a query for the target, got %s", i, asked)
+		}
+		if err == nil && m.Answer[0].Header().Name != "a-very-long-name-to-randomize.example.org." {
+			t.Errorf("Test %d: expected the original case in the answer, got %s", i, m.Answer[0].Header().Name)
+		}
+	}
+}
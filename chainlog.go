@@ -0,0 +1,68 @@
+package finalize
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/coredns/coredns/request"
+)
+
+// The formats of the chain log lines.
+const (
+	chainLogJSON     = "json"
+	chainLogKeyValue = "kv"
+)
+
+// chainLog logs a line per finalized request at info level, optionally for a
+// sample of the requests only.
+type chainLog struct {
+	format string
+	// sample is the fraction of the requests logged, 1 logs all of them.
+	sample float64
+	rand   func() float64
+}
+
+// chainLogRecord is a line of the chain log.
+type chainLogRecord struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Client   string `json:"client"`
+	Hops     int64  `json:"hops"`
+	Duration string `json:"duration"`
+	Outcome  string `json:"outcome"`
+}
+
+func newChainLog(format string, sample float64) *chainLog {
+	return &chainLog{format: format, sample: sample, rand: rand.Float64}
+}
+
+// log logs the finalization of the request of state, which took d and hops
+// lookups, unless it is not sampled.
+func (l *chainLog) log(state request.Request, hops int64, d time.Duration, outcome string) {
+	if l.sample < 1 && l.rand() >= l.sample {
+		return
+	}
+	log.Info(l.line(chainLogRecord{
+		Name:     state.Name(),
+		Type:     state.Type(),
+		Client:   state.IP(),
+		Hops:     hops,
+		Duration: d.String(),
+		Outcome:  outcome,
+	}))
+}
+
+// line formats rec in the format of the log.
+func (l *chainLog) line(rec chainLogRecord) string {
+	if l.format == chainLogKeyValue {
+		return fmt.Sprintf("name=%s type=%s client=%s hops=%d duration=%s outcome=%s",
+			rec.Name, rec.Type, rec.Client, rec.Hops, rec.Duration, rec.Outcome)
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err.Error()
+	}
+	return string(line)
+}
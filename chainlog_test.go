@@ -0,0 +1,72 @@
+package finalize
+
+import (
+	"bytes"
+	"context"
+	golog "log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestChainLogLine(t *testing.T) {
+	rec := chainLogRecord{Name: "a.example.com.", Type: "A", Client: "10.240.0.1", Hops: 2, Duration: "1.5ms", Outcome: outcomeFlattened}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{chainLogJSON, `{"name":"a.example.com.","type":"A","client":"10.240.0.1","hops":2,"duration":"1.5ms","outcome":"flattened"}`},
+		{chainLogKeyValue, "name=a.example.com. type=A client=10.240.0.1 hops=2 duration=1.5ms outcome=flattened"},
+	}
+
+	for i, test := range tests {
+		if got := newChainLog(test.format, 1).line(rec); got != test.want {
+			t.Errorf("Test %d: expected %s, got %s", i, test.want, got)
+		}
+	}
+}
+
+func TestServeDNSLogChains(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	for _, sampled := range []bool{true, false} {
+		f.chainLog = newChainLog(chainLogKeyValue, 0.5)
+		f.chainLog.rand = func() float64 {
+			if sampled {
+				return 0.25
+			}
+			return 0.75
+		}
+		buf.Reset()
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		logged := strings.Contains(buf.String(), "name=a.example.com. type=A client=10.240.0.1 hops=1 duration=")
+		if logged != sampled {
+			t.Errorf("Expected the chain to be logged %t, got %q", sampled, buf.String())
+		}
+		if sampled && !strings.Contains(buf.String(), "outcome=flattened") {
+			t.Errorf("Expected the outcome to be logged, got %q", buf.String())
+		}
+	}
+}
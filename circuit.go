@@ -0,0 +1,88 @@
+package finalize
+
+import (
+	"sync"
+	"time"
+)
+
+// The states of a circuit breaker, as reported by the health endpoint.
+const (
+	circuitStateClosed = "closed"
+	circuitStateOpen   = "open"
+	// circuitStateHalfOpen is an open circuit past its cooldown, letting
+	// lookups through until the next one fails or succeeds.
+	circuitStateHalfOpen = "half_open"
+)
+
+// circuitBreaker stops finalization for a cooldown period once a number of
+// lookups in a row have failed. After the cooldown a single failure opens the
+// circuit again, while a successful lookup closes it.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// allow reports whether finalization may be attempted.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return !cb.open || !cb.now().Before(cb.openUntil)
+}
+
+// state returns the state of the circuit.
+func (cb *circuitBreaker) state() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch {
+	case !cb.open:
+		return circuitStateClosed
+	case cb.now().Before(cb.openUntil):
+		return circuitStateOpen
+	}
+	return circuitStateHalfOpen
+}
+
+// success records a successful lookup. It returns true if this closed the circuit.
+func (cb *circuitBreaker) success() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	closed := cb.open
+	cb.failures = 0
+	cb.open = false
+
+	return closed
+}
+
+// failure records a failed lookup. It returns true if this opened the circuit.
+func (cb *circuitBreaker) failure() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures++
+	if !cb.open && cb.failures < cb.threshold {
+		return false
+	}
+
+	cb.open = true
+	cb.failures = 0
+	cb.openUntil = cb.now().Add(cb.cooldown)
+
+	return true
+}
@@ -0,0 +1,46 @@
+package finalize
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cb := newCircuitBreaker(3, 30*time.Second)
+	cb.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if cb.failure() {
+			t.Fatalf("Expected the circuit to stay closed after %d failures", i+1)
+		}
+	}
+	if cb.success() {
+		t.Errorf("Expected a success not to report closing a closed circuit")
+	}
+
+	cb.failure()
+	cb.failure()
+	if !cb.failure() {
+		t.Fatalf("Expected the circuit to open after 3 failures in a row")
+	}
+	if cb.allow() {
+		t.Errorf("Expected finalization to be skipped while the circuit is open")
+	}
+
+	now = now.Add(31 * time.Second)
+	if !cb.allow() {
+		t.Fatalf("Expected finalization to be attempted after the cooldown")
+	}
+	if !cb.failure() {
+		t.Errorf("Expected a single failure after the cooldown to open the circuit again")
+	}
+
+	now = now.Add(31 * time.Second)
+	if !cb.success() {
+		t.Errorf("Expected a success after the cooldown to close the circuit")
+	}
+	if !cb.allow() {
+		t.Errorf("Expected finalization to be attempted once the circuit is closed")
+	}
+}
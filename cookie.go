@@ -0,0 +1,73 @@
+package finalize
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// errCookieMismatch is returned for replies that do not echo the client cookie.
+var errCookieMismatch = errors.New("reply does not carry the client cookie")
+
+// cookieJar holds the DNS cookies (RFC 7873) exchanged with a single upstream
+// server. The client cookie is fixed for the lifetime of the jar, the server
+// cookie is learned from the replies.
+type cookieJar struct {
+	client string
+
+	mu     sync.Mutex
+	server string
+}
+
+func newCookieJar() *cookieJar {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &cookieJar{client: hex.EncodeToString(b)}
+}
+
+// apply returns a copy of m carrying the cookies of the jar in place of any
+// cookie copied from the client query. m must have an OPT record.
+func (j *cookieJar) apply(m *dns.Msg) *dns.Msg {
+	j.mu.Lock()
+	cookie := j.client + j.server
+	j.mu.Unlock()
+
+	m = m.Copy()
+	opt := m.IsEdns0()
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0COOKIE {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+
+	return m
+}
+
+// check verifies that a cookie in ret echoes the client cookie and remembers
+// the server cookie. Replies without a cookie are accepted, as the server
+// might not support cookies.
+func (j *cookieJar) check(ret *dns.Msg) error {
+	opt := ret.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		c, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		if len(c.Cookie) < len(j.client) || !strings.EqualFold(c.Cookie[:len(j.client)], j.client) {
+			return errCookieMismatch
+		}
+		j.mu.Lock()
+		j.server = c.Cookie[len(j.client):]
+		j.mu.Unlock()
+	}
+	return nil
+}
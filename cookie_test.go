@@ -0,0 +1,126 @@
+package finalize
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const serverCookie = "0102030405060708"
+
+// cookieLog records the cookies received by a cookieServer, whose handler
+// runs in a goroutine of its own.
+type cookieLog struct {
+	mu      sync.Mutex
+	cookies []string
+}
+
+// add records cookie and returns the number of cookies received so far.
+func (l *cookieLog) add(cookie string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cookies = append(l.cookies, cookie)
+	return len(l.cookies)
+}
+
+// list returns the cookies received so far.
+func (l *cookieLog) list() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.cookies)
+}
+
+// cookieServer starts a server that replies BADCOOKIE to queries without its
+// server cookie. If echo is false, a foreign client cookie is returned.
+func cookieServer(echo bool, cookies *cookieLog) *dnstest.Server {
+	return dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		var client string
+		received := 0
+		for _, o := range r.IsEdns0().Option {
+			if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+				received = cookies.add(c.Cookie)
+				client = c.Cookie[:16]
+			}
+		}
+		if !echo {
+			client = "ffffffffffffffff"
+		}
+
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.SetEdns0(dns.DefaultMsgSize, false)
+		ret.IsEdns0().Option = append(ret.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: client + serverCookie})
+		if received == 1 {
+			ret.Rcode = dns.RcodeBadCookie
+		} else {
+			ret.Answer = append(ret.Answer, plugintest.A(r.Question[0].Name+" 60 IN A 192.0.2.1"))
+		}
+		w.WriteMsg(ret)
+	})
+}
+
+func TestDNSUpstreamCookies(t *testing.T) {
+	seen := new(cookieLog)
+	s := cookieServer(true, seen)
+	defer s.Close()
+
+	opts := newUpstreamOptions()
+	opts.cookies = true
+	opts.ednsOptions = []uint16{dns.EDNS0COOKIE}
+	r, err := newResolver([]string{s.Addr}, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	startResolver(r)
+	defer closeResolver(r)
+
+	req := new(dns.Msg)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "aaaaaaaaaaaaaaaa"})
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: req}
+
+	m, err := r.Lookup(context.Background(), state, "example.org.", dns.TypeA)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(m.Answer) != 1 {
+		t.Errorf("Expected an answer after the BADCOOKIE retry, got %v", m)
+	}
+	cookies := seen.list()
+	if len(cookies) != 2 {
+		t.Fatalf("Expected 2 exchanges, got %d", len(cookies))
+	}
+	client := r.(*dnsUpstream).hosts[0].cookies.client
+	if cookies[0] != client {
+		t.Errorf("Expected the first query to carry only the client cookie %s, got %s", client, cookies[0])
+	}
+	if cookies[1] != client+serverCookie {
+		t.Errorf("Expected the retry to carry the server cookie, got %s", cookies[1])
+	}
+}
+
+func TestDNSUpstreamCookieMismatch(t *testing.T) {
+	s := cookieServer(false, new(cookieLog))
+	defer s.Close()
+
+	opts := newUpstreamOptions()
+	opts.cookies = true
+	r, err := newResolver([]string{s.Addr}, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	startResolver(r)
+	defer closeResolver(r)
+
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: new(dns.Msg)}
+	if _, err := r.Lookup(context.Background(), state, "example.org.", dns.TypeA); !errors.Is(err, errCookieMismatch) {
+		t.Errorf("Expected %v, got %v", errCookieMismatch, err)
+	}
+}
@@ -0,0 +1,57 @@
+package finalize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// errMaxZones is returned for chains crossing more registrable domains than
+// max_zones allows.
+var errMaxZones = errors.New("max zones reached")
+
+// registrableDomain returns the registrable domain of name, e.g. example.co.uk.
+// for www.example.co.uk., according to the public suffix list. Names without
+// one, such as public suffixes themselves, are returned as is.
+func registrableDomain(name string) string {
+	name = dns.CanonicalName(name)
+	domain, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return name
+	}
+	return dns.Fqdn(domain)
+}
+
+// chainNames returns qname followed by the targets of the CNAMEs of rrs.
+func chainNames(qname string, rrs []dns.RR) []string {
+	names := []string{qname}
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			names = append(names, cname.Target)
+		}
+	}
+	return names
+}
+
+// checkZones returns errMaxZones if names span more distinct registrable
+// domains than max_zones allows.
+func (s *Finalize) checkZones(ctx context.Context, names []string) error {
+	if s.maxZones == 0 {
+		return nil
+	}
+	domains := make(map[string]struct{})
+	for _, name := range names {
+		domains[registrableDomain(name)] = struct{}{}
+	}
+	if len(domains) <= s.maxZones {
+		return nil
+	}
+	maxZonesReachedCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	log.Warningf("CNAME chain of %s crosses %d registrable domains, more than %d", names[0], len(domains), s.maxZones)
+	return fmt.Errorf("%w: %d domains crossed", errMaxZones, len(domains))
+}
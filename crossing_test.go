@@ -0,0 +1,69 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestRegistrableDomain(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"www.example.com.", "example.com."},
+		{"A.B.Example.CO.UK.", "example.co.uk."},
+		{"example.com.", "example.com."},
+		{"co.uk.", "co.uk."},
+		{"localhost.", "localhost."},
+	}
+	for i, tc := range tests {
+		if got := registrableDomain(tc.name); got != tc.want {
+			t.Errorf("Test %d: expected %s for %s, got %s", i, tc.want, tc.name, got)
+		}
+	}
+}
+
+func TestServeDNSMaxZones(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.net.": {plugintest.CNAME("b.example.net. 300 IN CNAME c.example.org.")},
+		"c.example.org.": {plugintest.A("c.example.org. 300 IN A 192.0.2.1")},
+	}}
+
+	tests := []struct {
+		maxZones    int
+		wantRRs     int
+		wantLookups int
+	}{
+		{0, 3, 2},
+		{3, 3, 2},
+		// the lookup of c.example.org. is not made
+		{2, 1, 1},
+		{1, 1, 0},
+	}
+
+	for i, tc := range tests {
+		resolver.lookups = nil
+		f := New()
+		f.Resolver = resolver
+		f.maxZones = tc.maxZones
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.net."))
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if len(rec.Msg.Answer) != tc.wantRRs {
+			t.Errorf("Test %d: expected %d records, got %v", i, tc.wantRRs, rec.Msg)
+		}
+		if len(resolver.lookups) != tc.wantLookups {
+			t.Errorf("Test %d: expected %d lookups, got %v", i, tc.wantLookups, resolver.lookups)
+		}
+	}
+}
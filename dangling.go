@@ -0,0 +1,39 @@
+package finalize
+
+import (
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// danglingUpstream is the on_dangling action answering with the rcode of the
+// last lookup, the default.
+const danglingUpstream = -2
+
+// danglingActions maps the names accepted by on_dangling to the rcode of the
+// answer, or answerOriginal.
+var danglingActions = map[string]int{
+	"original": answerOriginal,
+	"nxdomain": dns.RcodeNameError,
+	"nodata":   dns.RcodeSuccess,
+}
+
+// danglingRcode returns the rcode of the answer to a request whose chain,
+// resolved up to ch, ends in a name without records, as reported by err, or
+// answerOriginal. It returns false if the chain does not end in such a name.
+func (s *Finalize) danglingRcode(err error, ch chain) (int, bool) {
+	nxdomain := errors.Is(err, errNXDomain)
+	if (!nxdomain && !errors.Is(err, errDangling)) || ch.reply == nil {
+		return 0, false
+	}
+	if s.onDangling != danglingUpstream {
+		return s.onDangling, true
+	}
+	switch {
+	case nxdomain && !s.rcodePassthrough:
+		return dns.RcodeNameError, true
+	case !nxdomain && ch.reply.Rcode == dns.RcodeSuccess:
+		return dns.RcodeSuccess, true
+	}
+	return 0, false
+}
@@ -0,0 +1,60 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSOnDangling(t *testing.T) {
+	soa := plugintest.SOA("example.net. 60 IN SOA ns.example.net. hostmaster.example.net. 1 7200 3600 1209600 60")
+
+	tests := []struct {
+		onDangling  int
+		passthrough bool
+		rcode       int // rcode of the last lookup
+		wantRcode   int
+		wantRRs     int
+	}{
+		{danglingUpstream, false, dns.RcodeNameError, dns.RcodeNameError, 2},
+		{danglingUpstream, false, dns.RcodeSuccess, dns.RcodeSuccess, 2},
+		{danglingUpstream, true, dns.RcodeNameError, dns.RcodeSuccess, 1},
+		{answerOriginal, false, dns.RcodeNameError, dns.RcodeSuccess, 1},
+		{answerOriginal, false, dns.RcodeSuccess, dns.RcodeSuccess, 1},
+		{dns.RcodeNameError, false, dns.RcodeSuccess, dns.RcodeNameError, 2},
+		{dns.RcodeNameError, true, dns.RcodeNameError, dns.RcodeNameError, 2},
+		{dns.RcodeSuccess, false, dns.RcodeNameError, dns.RcodeSuccess, 2},
+	}
+
+	for i, tc := range tests {
+		f := New()
+		f.Resolver = &stubResolver{
+			answers: map[string][]dns.RR{
+				"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.net.")},
+				"c.example.net.": {},
+			},
+			rcodes:    map[string]int{"c.example.net.": tc.rcode},
+			authority: map[string][]dns.RR{"c.example.net.": {soa}},
+		}
+		f.onDangling = tc.onDangling
+		f.rcodePassthrough = tc.passthrough
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if rec.Msg.Rcode != tc.wantRcode || len(rec.Msg.Answer) != tc.wantRRs {
+			t.Errorf("Test %d: expected %s with %d records, got %v", i, dns.RcodeToString[tc.wantRcode], tc.wantRRs, rec.Msg)
+		}
+		if tc.wantRRs == 2 && len(rec.Msg.Ns) != 1 {
+			t.Errorf("Test %d: expected the SOA record, got %v", i, rec.Msg.Ns)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package finalize
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// synthesizeCNAMEs returns rrs with the CNAME records implied by its DNAME
+// records for the chain starting at name, as in RFC 6672, added right after
+// the DNAME records where they are missing. rrs is returned as is if it holds
+// no DNAME records.
+func synthesizeCNAMEs(rrs []dns.RR, name string) []dns.RR {
+	var dnames []*dns.DNAME
+	cnames := make(map[string]string)
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.DNAME:
+			dnames = append(dnames, rr)
+		case *dns.CNAME:
+			cnames[dns.CanonicalName(rr.Hdr.Name)] = rr.Target
+		}
+	}
+	if len(dnames) == 0 {
+		return rrs
+	}
+
+	synthesized := make([]dns.RR, len(rrs))
+	copy(synthesized, rrs)
+	seen := make(map[string]struct{})
+	for current := dns.CanonicalName(name); ; {
+		if _, ok := seen[current]; ok {
+			break
+		}
+		seen[current] = struct{}{}
+
+		if target, ok := cnames[current]; ok {
+			current = dns.CanonicalName(target)
+			continue
+		}
+		dname := redirecting(dnames, current)
+		if dname == nil {
+			break
+		}
+		target := strings.TrimSuffix(current, dns.CanonicalName(dname.Hdr.Name)) + dns.CanonicalName(dname.Target)
+		if len(target) > 255 {
+			// the substitution exceeds the maximum name length, YXDOMAIN
+			break
+		}
+		cname := &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: current, Rrtype: dns.TypeCNAME, Class: dname.Hdr.Class, Ttl: dname.Hdr.Ttl},
+			Target: target,
+		}
+		for i, rr := range synthesized {
+			if rr == dname {
+				synthesized = append(synthesized[:i+1], append([]dns.RR{cname}, synthesized[i+1:]...)...)
+				break
+			}
+		}
+		current = target
+	}
+	return synthesized
+}
+
+// redirecting returns the DNAME record of dnames with the longest owner name
+// that name is below, nil if there is none.
+func redirecting(dnames []*dns.DNAME, name string) *dns.DNAME {
+	var match *dns.DNAME
+	for _, d := range dnames {
+		owner := dns.CanonicalName(d.Hdr.Name)
+		if owner == name || !dns.IsSubDomain(owner, name) {
+			continue
+		}
+		if match == nil || dns.CountLabel(owner) > dns.CountLabel(match.Hdr.Name) {
+			match = d
+		}
+	}
+	return match
+}
@@ -0,0 +1,50 @@
+package finalize
+
+import (
+	"testing"
+
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestSynthesizeCNAMEs(t *testing.T) {
+	rrs := []dns.RR{
+		plugintest.DNAME("example.com. 300 IN DNAME example.net."),
+		plugintest.A("www.example.net. 60 IN A 192.0.2.1"),
+	}
+
+	synthesized := synthesizeCNAMEs(rrs, "www.example.com.")
+	if len(synthesized) != 3 {
+		t.Fatalf("Expected a synthesized CNAME, got %v", synthesized)
+	}
+	cname, ok := synthesized[1].(*dns.CNAME)
+	if !ok || cname.Hdr.Name != "www.example.com." || cname.Target != "www.example.net." || cname.Hdr.Ttl != 300 {
+		t.Errorf("Expected www.example.com. CNAME www.example.net. after the DNAME, got %v", synthesized[1])
+	}
+	if len(rrs) != 2 {
+		t.Errorf("Expected the original records to be left unmodified, got %v", rrs)
+	}
+
+	rrs = []dns.RR{
+		plugintest.DNAME("example.com. 300 IN DNAME example.net."),
+		plugintest.CNAME("www.example.com. 300 IN CNAME www.example.net."),
+	}
+	if synthesized := synthesizeCNAMEs(rrs, "www.example.com."); len(synthesized) != 2 {
+		t.Errorf("Expected no CNAME to be synthesized twice, got %v", synthesized)
+	}
+
+	rrs = []dns.RR{
+		plugintest.DNAME("example.com. 300 IN DNAME example.net."),
+		plugintest.DNAME("example.net. 300 IN DNAME sub.example.org."),
+	}
+	synthesized = synthesizeCNAMEs(rrs, "www.example.com.")
+	target, err := findLastTarget(synthesized, "www.example.com.")
+	if err != nil || target != "www.sub.example.org." {
+		t.Errorf("Expected the chain to end at www.sub.example.org., got %s, %v", target, err)
+	}
+
+	rrs = []dns.RR{plugintest.CNAME("www.example.com. 300 IN CNAME www.example.net.")}
+	if synthesized := synthesizeCNAMEs(rrs, "www.example.com."); &synthesized[0] != &rrs[0] {
+		t.Errorf("Expected records without DNAME to be returned as is")
+	}
+}
@@ -0,0 +1,51 @@
+package finalize
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/plugin/dnstap"
+	"github.com/coredns/coredns/plugin/dnstap/msg"
+	"github.com/coredns/coredns/request"
+
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// SetTapPlugin appends one or more dnstap plugins to the tap plugin list.
+func (s *Finalize) SetTapPlugin(tapPlugin *dnstap.Dnstap) {
+	s.tapPlugins = append(s.tapPlugins, tapPlugin)
+	if nextPlugin, ok := tapPlugin.Next.(*dnstap.Dnstap); ok {
+		s.SetTapPlugin(nextPlugin)
+	}
+}
+
+// toDnstap sends the lookup of name made for state, and its reply if there
+// is one, to the dnstap plugins as resolver messages. The messages are from
+// the perspective of this server, i.e. the query address is the client's.
+func (s *Finalize) toDnstap(ctx context.Context, state request.Request, name string, reply *dns.Msg, start time.Time) {
+	for _, t := range s.tapPlugins {
+		q := new(tap.Message)
+		msg.SetQueryTime(q, start)
+		msg.SetQueryAddress(q, state.W.RemoteAddr())
+		if t.IncludeRawMessage {
+			buf, _ := newLookupMsg(state, name, state.QType(), nil).Pack()
+			q.QueryMessage = buf
+		}
+		msg.SetType(q, tap.Message_RESOLVER_QUERY)
+		t.TapMessageWithMetadata(ctx, q, state)
+
+		if reply != nil {
+			r := new(tap.Message)
+			if t.IncludeRawMessage {
+				buf, _ := reply.Pack()
+				r.ResponseMessage = buf
+			}
+			msg.SetQueryTime(r, start)
+			msg.SetQueryAddress(r, state.W.RemoteAddr())
+			msg.SetResponseTime(r, time.Now())
+			msg.SetType(r, tap.Message_RESOLVER_RESPONSE)
+			t.TapMessageWithMetadata(ctx, r, state)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package finalize
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/dnstap"
+)
+
+func TestSetTapPlugin(t *testing.T) {
+	second := &dnstap.Dnstap{}
+	first := &dnstap.Dnstap{Next: second}
+
+	f := New()
+	f.SetTapPlugin(first)
+
+	if len(f.tapPlugins) != 2 || f.tapPlugins[0] != first || f.tapPlugins[1] != second {
+		t.Errorf("Expected both chained dnstap plugins, got %v", f.tapPlugins)
+	}
+}
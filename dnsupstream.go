@@ -0,0 +1,244 @@
+package finalize
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/pkg/up"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultTimeout is the time to wait for a reply from an upstream DNS server.
+	defaultTimeout = 2 * time.Second
+	// defaultMaxFails is the number of failed health checks after which an upstream DNS server is considered down.
+	defaultMaxFails = 2
+	// defaultHCInterval is the interval between health checks of an upstream DNS server that failed.
+	defaultHCInterval = 500 * time.Millisecond
+)
+
+// dnsUpstream resolves CNAME targets by querying DNS servers directly. The
+// servers are tried in the order given by the policy until one of them
+// replies, skipping the ones that are considered down.
+type dnsUpstream struct {
+	hosts       []*upstreamHost
+	policy      policy
+	maxFails    uint32
+	ednsOptions []uint16
+	loopNonce   []byte
+	forceTCP    bool
+	preferUDP   bool
+	// randomizeCase enables the 0x20 randomization of the query names.
+	randomizeCase bool
+}
+
+// upstreamHost is a single server of a dnsUpstream.
+type upstreamHost struct {
+	addr string
+	// client is used for UDP or, for DNS over TLS servers, for all exchanges.
+	client    *dns.Client
+	tcpClient *dns.Client
+	// cookies is nil when DNS cookies are disabled.
+	cookies *cookieJar
+
+	// fails is the number of consecutive failed health checks.
+	fails      uint32
+	probe      *up.Probe
+	hcInterval time.Duration
+	// replied is set once the host replied to a lookup or health check.
+	replied atomic.Bool
+}
+
+func newUpstreamHost(trans, addr string, opts upstreamOptions) *upstreamHost {
+	client := &dns.Client{Net: "udp", Timeout: defaultTimeout, Dialer: dialer("udp", opts.bindAddr)}
+	if trans == transport.TLS {
+		client.Net = "tcp-tls"
+		client.TLSConfig = opts.tlsConfig
+		client.Dialer = dialer("tcp", opts.bindAddr)
+	}
+
+	h := &upstreamHost{
+		addr:       addr,
+		client:     client,
+		tcpClient:  &dns.Client{Net: "tcp", Timeout: defaultTimeout, Dialer: dialer("tcp", opts.bindAddr)},
+		probe:      up.New(),
+		hcInterval: opts.hcInterval,
+	}
+	if opts.cookies {
+		h.cookies = newCookieJar()
+	}
+
+	return h
+}
+
+// Lookup sends a query for name and typ to the upstream servers and returns the first reply.
+func (u *dnsUpstream) Lookup(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+	req := newLookupMsg(state, name, typ, u.ednsOptions)
+	if u.loopNonce != nil {
+		addLoopNonce(req, u.loopNonce)
+	}
+	if u.randomizeCase {
+		req.Question[0].Name = randomizeCase(req.Question[0].Name)
+	}
+	proto := u.proto(state)
+
+	var err error
+	addr := ""
+	for _, h := range u.policy.List(u.healthy()) {
+		var ret *dns.Msg
+		upstreamRequestCount.WithLabelValues(metrics.WithServer(ctx), h.addr).Inc()
+		start := time.Now()
+		ret, err = h.exchange(ctx, req, proto)
+		observeDuration(ctx, lookupDuration.WithLabelValues(metrics.WithServer(ctx), h.addr), start)
+		if err == nil && u.randomizeCase {
+			if err = restoreCase(ret, req.Question[0].Name, name); err != nil {
+				caseMismatchCount.WithLabelValues(metrics.WithServer(ctx), h.addr).Inc()
+			}
+		}
+		if err == nil {
+			h.replied.Store(true)
+			return ret, nil
+		}
+		log.Debugf("Failed to lookup %s at %s: %v", name, h.addr, err)
+		addr = h.addr
+		h.healthcheck()
+	}
+
+	if err != nil {
+		return nil, &upstreamError{addr: addr, err: err}
+	}
+	return nil, nil
+}
+
+// proto returns the protocol used for the lookups of state. TCP has
+// precedence over UDP, without either the protocol of the client is used.
+func (u *dnsUpstream) proto(state request.Request) string {
+	switch {
+	case u.forceTCP:
+		return "tcp"
+	case u.preferUDP:
+		return "udp"
+	}
+	return state.Proto()
+}
+
+// healthy returns the hosts that are not considered down. If all of them are
+// down, all hosts are returned, as there is nothing better to try.
+func (u *dnsUpstream) healthy() []*upstreamHost {
+	hosts := make([]*upstreamHost, 0, len(u.hosts))
+	for _, h := range u.hosts {
+		if !h.down(u.maxFails) {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == 0 {
+		return u.hosts
+	}
+	return hosts
+}
+
+// ready reports whether any of the hosts has replied yet, and starts health
+// checking the others until they do.
+func (u *dnsUpstream) ready() bool {
+	ready := false
+	for _, h := range u.hosts {
+		if h.replied.Load() {
+			ready = true
+			continue
+		}
+		h.healthcheck()
+	}
+	return ready
+}
+
+// start starts the health checks of all hosts.
+func (u *dnsUpstream) start() {
+	for _, h := range u.hosts {
+		h.probe.Start(h.hcInterval)
+	}
+}
+
+// Close stops the health checks of all hosts.
+func (u *dnsUpstream) Close() error {
+	for _, h := range u.hosts {
+		h.probe.Stop()
+	}
+	return nil
+}
+
+// exchange sends req to the host using proto. With DNS cookies enabled, a
+// reply not echoing the client cookie is rejected and a BADCOOKIE reply is
+// retried once with the server cookie it carries.
+func (h *upstreamHost) exchange(ctx context.Context, req *dns.Msg, proto string) (*dns.Msg, error) {
+	if h.cookies == nil {
+		return h.send(ctx, req, proto)
+	}
+
+	for retried := false; ; retried = true {
+		ret, err := h.send(ctx, h.cookies.apply(req), proto)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.cookies.check(ret); err != nil {
+			cookieMismatchCount.WithLabelValues(metrics.WithServer(ctx), h.addr).Inc()
+			return nil, err
+		}
+		if ret.Rcode != dns.RcodeBadCookie || retried {
+			return ret, nil
+		}
+		log.Debugf("Bad cookie reply from %s, retrying with the new server cookie", h.addr)
+	}
+}
+
+// send sends req to the host using proto. A truncated reply received over UDP
+// is retried over TCP.
+func (h *upstreamHost) send(ctx context.Context, req *dns.Msg, proto string) (*dns.Msg, error) {
+	client := h.client
+	if proto == "tcp" && client.Net == "udp" {
+		client = h.tcpClient
+	}
+
+	ret, _, err := client.ExchangeContext(ctx, req, h.addr)
+	if err != nil || !ret.Truncated || client.Net != "udp" {
+		return ret, err
+	}
+
+	truncatedRetryCount.WithLabelValues(metrics.WithServer(ctx), h.addr).Inc()
+	log.Debugf("Truncated reply from %s, retrying over TCP", h.addr)
+	ret, _, err = h.tcpClient.ExchangeContext(ctx, req, h.addr)
+	return ret, err
+}
+
+// down reports whether the host has failed more than maxFails health checks in
+// a row. A maxFails of 0 means the host is never considered down.
+func (h *upstreamHost) down(maxFails uint32) bool {
+	if maxFails == 0 {
+		return false
+	}
+	return atomic.LoadUint32(&h.fails) > maxFails
+}
+
+// healthcheck starts probing the host until it replies to a health check.
+func (h *upstreamHost) healthcheck() {
+	h.probe.Do(h.check)
+}
+
+// check sends a health check query to the host. Any reply is considered healthy.
+func (h *upstreamHost) check() error {
+	ping := new(dns.Msg)
+	ping.SetQuestion(".", dns.TypeNS)
+
+	if _, _, err := h.client.Exchange(ping, h.addr); err != nil {
+		healthcheckFailureCount.WithLabelValues(h.addr).Inc()
+		atomic.AddUint32(&h.fails, 1)
+		return err
+	}
+
+	atomic.StoreUint32(&h.fails, 0)
+	h.replied.Store(true)
+	return nil
+}
@@ -0,0 +1,235 @@
+package finalize
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// newTestServer starts a DNS server answering every A query with 192.0.2.1.
+func newTestServer(t *testing.T) *dnstest.Server {
+	t.Helper()
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			ret.Answer = append(ret.Answer, plugintest.A(r.Question[0].Name+" 60 IN A 192.0.2.1"))
+		}
+		w.WriteMsg(ret)
+	})
+	t.Cleanup(s.Close)
+	return s
+}
+
+// deadAddr returns an address nobody is listening on.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := c.LocalAddr().String()
+	c.Close()
+	return addr
+}
+
+func newTestUpstream(addrs ...string) *dnsUpstream {
+	opts := newUpstreamOptions()
+	u := &dnsUpstream{maxFails: opts.maxFails, policy: &sequential{}}
+	for _, addr := range addrs {
+		h := newUpstreamHost(transport.DNS, addr, opts)
+		h.client.Timeout = 100 * time.Millisecond
+		u.hosts = append(u.hosts, h)
+	}
+	u.start()
+	return u
+}
+
+func TestDNSUpstreamFailover(t *testing.T) {
+	s := newTestServer(t)
+	u := newTestUpstream(deadAddr(t), s.Addr)
+	defer u.Close()
+
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: new(dns.Msg)}
+	m, err := u.Lookup(context.Background(), state, "example.org.", dns.TypeA)
+	if err != nil {
+		t.Fatalf("Expected failover to the second host, got error %v", err)
+	}
+	if len(m.Answer) != 1 {
+		t.Errorf("Expected 1 answer, got %v", m.Answer)
+	}
+}
+
+func TestDNSUpstreamError(t *testing.T) {
+	first, second := deadAddr(t), deadAddr(t)
+	u := newTestUpstream(first, second)
+	defer u.Close()
+
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: new(dns.Msg)}
+	_, err := u.Lookup(context.Background(), state, "example.org.", dns.TypeA)
+	if err == nil {
+		t.Fatal("Expected an error from dead hosts")
+	}
+	if addr := upstreamAddr(err); addr != second {
+		t.Errorf("Expected the error of the last host %s, got %q", second, addr)
+	}
+	if addr := upstreamAddr(errLookup); addr != "" {
+		t.Errorf("Expected no address for other errors, got %q", addr)
+	}
+}
+
+func TestDNSUpstreamDown(t *testing.T) {
+	s := newTestServer(t)
+	u := newTestUpstream(deadAddr(t), s.Addr)
+	defer u.Close()
+
+	u.hosts[0].fails = u.maxFails + 1
+	if hosts := u.healthy(); len(hosts) != 1 || hosts[0] != u.hosts[1] {
+		t.Errorf("Expected only the second host to be healthy, got %v", hosts)
+	}
+
+	u.hosts[1].fails = u.maxFails + 1
+	if hosts := u.healthy(); len(hosts) != 2 {
+		t.Errorf("Expected all hosts to be used when all are down, got %v", hosts)
+	}
+
+	if err := u.hosts[1].check(); err != nil {
+		t.Fatalf("Expected health check to succeed, got %v", err)
+	}
+	if u.hosts[1].down(u.maxFails) {
+		t.Errorf("Expected the host to be up after a successful health check")
+	}
+
+	if err := u.hosts[0].check(); err == nil {
+		t.Fatalf("Expected health check of a dead host to fail")
+	}
+	if u.hosts[0].fails != u.maxFails+2 {
+		t.Errorf("Expected fails to be incremented, got %d", u.hosts[0].fails)
+	}
+}
+
+func TestDNSUpstreamReady(t *testing.T) {
+	s := newTestServer(t)
+	u := newTestUpstream(deadAddr(t), s.Addr)
+	defer u.Close()
+
+	if u.ready() {
+		t.Fatalf("Expected the upstream not to be ready before any reply")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !u.ready() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the upstream to be ready once a host replied to a health check")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if u.hosts[0].replied.Load() {
+		t.Errorf("Expected the dead host not to have replied")
+	}
+}
+
+func TestDNSUpstreamMaxFailsDisabled(t *testing.T) {
+	h := &upstreamHost{fails: 100}
+	if h.down(0) {
+		t.Errorf("Expected a host never to be down with max_fails 0")
+	}
+}
+
+func TestDNSUpstreamProtocols(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		protos []string
+	)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		proto := w.RemoteAddr().Network()
+		mu.Lock()
+		protos = append(protos, proto)
+		mu.Unlock()
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if proto == "udp" {
+			ret.Truncated = true
+		} else {
+			ret.Answer = append(ret.Answer, plugintest.A(r.Question[0].Name+" 60 IN A 192.0.2.1"))
+		}
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tests := []struct {
+		forceTCP, preferUDP bool
+		client              dns.ResponseWriter
+		want                []string
+	}{
+		{false, false, &plugintest.ResponseWriter{}, []string{"udp", "tcp"}},
+		{false, false, &plugintest.ResponseWriter{TCP: true}, []string{"tcp"}},
+		{true, false, &plugintest.ResponseWriter{}, []string{"tcp"}},
+		{false, true, &plugintest.ResponseWriter{TCP: true}, []string{"udp", "tcp"}},
+	}
+
+	for i, test := range tests {
+		mu.Lock()
+		protos = nil
+		mu.Unlock()
+		u := newTestUpstream(s.Addr)
+		u.forceTCP = test.forceTCP
+		u.preferUDP = test.preferUDP
+
+		state := request.Request{W: test.client, Req: new(dns.Msg)}
+		m, err := u.Lookup(context.Background(), state, "example.org.", dns.TypeA)
+		u.Close()
+		if err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+		if len(m.Answer) != 1 || m.Truncated {
+			t.Errorf("Test %d: expected a complete answer, got %v", i, m)
+		}
+		mu.Lock()
+		got := strings.Join(protos, ",")
+		mu.Unlock()
+		if got != strings.Join(test.want, ",") {
+			t.Errorf("Test %d: expected exchanges over %v, got %s", i, test.want, got)
+		}
+	}
+}
+
+func TestDNSUpstreamBind(t *testing.T) {
+	remote := make(chan net.IP, 1)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		select {
+		case remote <- net.ParseIP(host):
+		default:
+		}
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	opts := newUpstreamOptions()
+	opts.bindAddr = net.ParseIP("127.0.0.1")
+	r, err := newResolver([]string{s.Addr}, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	startResolver(r)
+	defer closeResolver(r)
+
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: new(dns.Msg)}
+	if _, err := r.Lookup(context.Background(), state, "example.org.", dns.TypeA); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := <-remote; !got.Equal(opts.bindAddr) {
+		t.Errorf("Expected lookup from %v, got %v", opts.bindAddr, got)
+	}
+}
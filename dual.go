@@ -0,0 +1,44 @@
+package finalize
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// dualTypes returns the type the chain is resolved for when answering a
+// question of type qtype, and the type whose records of the terminal name are
+// merged into the answer too, 0 if none. ANY questions, and A questions with
+// the dual option, are answered with both the A and the AAAA records.
+func (s *Finalize) dualTypes(qtype uint16) (uint16, uint16) {
+	if qtype == dns.TypeANY || (qtype == dns.TypeA && s.dual) {
+		return dns.TypeA, dns.TypeAAAA
+	}
+	return qtype, 0
+}
+
+// mergeDual appends the records of type qtype resolved for the terminal name
+// of the chain in rrs. rrs is returned as is if there are none.
+func (s *Finalize) mergeDual(ctx context.Context, state request.Request, rrs []dns.RR, qtype uint16) []dns.RR {
+	if qtype == 0 {
+		return rrs
+	}
+	name, err := findLastTarget(rrs, state.QName())
+	if err != nil {
+		return rrs
+	}
+	resolved, err := s.resolveType(ctx, state, name, qtype)
+	if err != nil {
+		log.Debugf("Failed to resolve %s records of [%s]: %v", dns.TypeToString[qtype], name, err)
+		return rrs
+	}
+	return s.appendResolved(rrs, resolved)
+}
+
+// withQType returns a copy of state asking for qtype instead.
+func withQType(state request.Request, qtype uint16) request.Request {
+	req := state.Req.Copy()
+	req.Question[0].Qtype = qtype
+	return request.Request{W: state.W, Req: req}
+}
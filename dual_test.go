@@ -0,0 +1,57 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSDual(t *testing.T) {
+	tests := []struct {
+		qtype uint16
+		dual  bool
+		want  []uint16
+	}{
+		{dns.TypeA, false, []uint16{dns.TypeCNAME, dns.TypeA}},
+		{dns.TypeA, true, []uint16{dns.TypeCNAME, dns.TypeA, dns.TypeAAAA}},
+		{dns.TypeANY, false, []uint16{dns.TypeCNAME, dns.TypeA, dns.TypeAAAA}},
+		{dns.TypeAAAA, true, []uint16{dns.TypeCNAME, dns.TypeAAAA}},
+	}
+
+	for i, tc := range tests {
+		resolver := &stubResolver{answers: map[string][]dns.RR{
+			"b.example.com.": {
+				plugintest.A("b.example.com. 300 IN A 192.0.2.1"),
+				plugintest.AAAA("b.example.com. 300 IN AAAA 2001:db8::1"),
+			},
+		}}
+
+		f := New()
+		f.Resolver = resolver
+		f.dual = tc.dual
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", tc.qtype)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if len(rec.Msg.Answer) != len(tc.want) {
+			t.Errorf("Test %d: expected %d records, got %v", i, len(tc.want), rec.Msg.Answer)
+			continue
+		}
+		for j, rr := range rec.Msg.Answer {
+			if rr.Header().Rrtype != tc.want[j] {
+				t.Errorf("Test %d: expected %s record at %d, got %v", i, dns.TypeToString[tc.want[j]], j, rr)
+			}
+		}
+		if rec.Msg.Question[0].Qtype != tc.qtype {
+			t.Errorf("Test %d: expected the question to be left as is, got %v", i, rec.Msg.Question[0])
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package finalize
+
+import (
+	"net"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultECSv4Prefix = 24
+	defaultECSv6Prefix = 56
+)
+
+// ecsConfig holds the source prefix lengths used to derive an EDNS Client
+// Subnet option from the client address for queries that carry none.
+type ecsConfig struct {
+	v4Prefix uint8
+	v6Prefix uint8
+}
+
+// clientSubnet returns the EDNS Client Subnet option of m, or nil if there is none.
+func clientSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	o := m.IsEdns0()
+	if o == nil {
+		return nil
+	}
+	for _, opt := range o.Option {
+		if ecs, ok := opt.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// withClientSubnet returns state with a copy of its request that carries an
+// EDNS Client Subnet option for the client address. If the request already
+// has one, or the client address is unknown, state is returned unchanged.
+func (c *ecsConfig) withClientSubnet(state request.Request) request.Request {
+	if clientSubnet(state.Req) != nil {
+		return state
+	}
+	ip := net.ParseIP(state.IP())
+	if ip == nil {
+		return state
+	}
+
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.SourceNetmask = c.v4Prefix
+		ecs.Address = ip4.Mask(net.CIDRMask(int(c.v4Prefix), 8*net.IPv4len))
+	} else {
+		ecs.Family = 2
+		ecs.SourceNetmask = c.v6Prefix
+		ecs.Address = ip.Mask(net.CIDRMask(int(c.v6Prefix), 8*net.IPv6len))
+	}
+
+	req := state.Req.Copy()
+	o := req.IsEdns0()
+	if o == nil {
+		req.SetEdns0(dns.MinMsgSize, false)
+		o = req.IsEdns0()
+	}
+	o.Option = append(o.Option, ecs)
+
+	return request.Request{W: state.W, Req: req}
+}
+
+// lookupState returns state as sent upstream, with the EDNS Client Subnet
+// option derived from the client address if enabled. The response must be
+// shaped for state itself: the copy may carry an OPT record the client did
+// not send.
+func (s *Finalize) lookupState(state request.Request) request.Request {
+	if s.ecs == nil {
+		return state
+	}
+	return s.ecs.withClientSubnet(state)
+}
@@ -0,0 +1,97 @@
+package finalize
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestWithClientSubnet(t *testing.T) {
+	c := &ecsConfig{v4Prefix: 24, v6Prefix: 56}
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: req}
+
+	got := c.withClientSubnet(state)
+	ecs := clientSubnet(got.Req)
+	if ecs == nil {
+		t.Fatalf("Expected an ECS option to be added")
+	}
+	if ecs.Family != 1 || ecs.SourceNetmask != 24 || !ecs.Address.Equal(net.IPv4(10, 240, 0, 0)) {
+		t.Errorf("Expected 10.240.0.0/24, got %v", ecs)
+	}
+	if clientSubnet(req) != nil {
+		t.Errorf("Expected the original request to be left untouched")
+	}
+
+	state = request.Request{W: &plugintest.ResponseWriter6{}, Req: req}
+	ecs = clientSubnet(c.withClientSubnet(state).Req)
+	if ecs == nil || ecs.Family != 2 || ecs.SourceNetmask != 56 || !ecs.Address.Equal(net.ParseIP("fe80::")) {
+		t.Errorf("Expected fe80::/56, got %v", ecs)
+	}
+}
+
+func TestWithClientSubnetExisting(t *testing.T) {
+	c := &ecsConfig{v4Prefix: 24, v6Prefix: 56}
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	existing := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 16, Address: net.IPv4(192, 0, 0, 0)}
+	req.IsEdns0().Option = append(req.IsEdns0().Option, existing)
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: req}
+
+	if got := clientSubnet(c.withClientSubnet(state).Req); got != existing {
+		t.Errorf("Expected the ECS option of the query to be kept, got %v", got)
+	}
+
+	lookup := newLookupMsg(state, "b.example.com.", dns.TypeA, []uint16{dns.EDNS0SUBNET})
+	if got := clientSubnet(lookup); got != existing {
+		t.Errorf("Expected the ECS option to be carried into the lookup, got %v", got)
+	}
+}
+
+// subnetResolver records the EDNS Client Subnet option of the lookups.
+type subnetResolver struct {
+	stubResolver
+	subnets []*dns.EDNS0_SUBNET
+}
+
+func (r *subnetResolver) Lookup(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+	r.subnets = append(r.subnets, clientSubnet(state.Req))
+	return r.stubResolver.Lookup(ctx, state, name, typ)
+}
+
+func TestServeDNSECSWithoutEDNS(t *testing.T) {
+	resolver := &subnetResolver{stubResolver: stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+	}}}
+	f := New()
+	f.Resolver = resolver
+	f.ecs = &ecsConfig{v4Prefix: 24, v6Prefix: 56}
+	f.marker = defaultMarkerCode
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(resolver.subnets) != 1 || resolver.subnets[0] == nil {
+		t.Errorf("Expected the lookup to carry the client subnet, got %v", resolver.subnets)
+	}
+	if len(rec.Msg.Answer) != 2 {
+		t.Errorf("Expected the chain to be finalized, got %v", rec.Msg.Answer)
+	}
+	if rec.Msg.IsEdns0() != nil {
+		t.Errorf("Expected no OPT record in the reply to a query without one, got %v", rec.Msg.IsEdns0())
+	}
+}
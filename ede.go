@@ -0,0 +1,75 @@
+package finalize
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// answerOriginal is the action returning the original answer unfinalized.
+const answerOriginal = -1
+
+// errorActions maps the names accepted by on_error to the rcode of the
+// answer, or answerOriginal.
+var errorActions = map[string]int{
+	"original": answerOriginal,
+	"servfail": dns.RcodeServerFailure,
+	"empty":    dns.RcodeSuccess,
+}
+
+// writeAbandoned answers a request whose chain could not be finalized as set
+// by on_error, with an Extended DNS Error telling why, so that clients and
+// operators can tell why the answer was not finalized.
+func (s *Finalize) writeAbandoned(w dns.ResponseWriter, state request.Request, response *dns.Msg, code uint16, text string) (int, error) {
+	s.audit(state, response, "failed", text)
+	return s.writeAction(w, state, response, s.onError, code, text)
+}
+
+// writeAction writes response if rcode is answerOriginal, or an answer with
+// rcode and no records otherwise, along with an Extended DNS Error.
+func (s *Finalize) writeAction(w dns.ResponseWriter, state request.Request, response *dns.Msg, rcode int, code uint16, text string) (int, error) {
+	if rcode == answerOriginal {
+		addEDE(response, state, code, text)
+		return s.writeResponse(w, response)
+	}
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, rcode)
+	m.RecursionAvailable = response.RecursionAvailable
+	addEDE(m, state, code, text)
+	return s.writeResponse(w, m)
+}
+
+// parseAction parses the name of an action listed in actions.
+func parseAction(s string, actions map[string]int) (int, error) {
+	action, ok := actions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown action '%s'", s)
+	}
+	return action, nil
+}
+
+// edeFor returns the Extended DNS Error for a chain that could not be resolved
+// because of err: a Network Error for failed lookups or an open circuit, Other
+// otherwise.
+func edeFor(err error) (uint16, string) {
+	if errors.Is(err, errLookup) || errors.Is(err, errDeadline) || errors.Is(err, errCircuitOpen) {
+		return dns.ExtendedErrorCodeNetworkError, err.Error()
+	}
+	return dns.ExtendedErrorCodeOther, err.Error()
+}
+
+// addEDE adds an Extended DNS Error (RFC 8914) to m, if the client sent an
+// OPT record.
+func addEDE(m *dns.Msg, state request.Request, code uint16, text string) {
+	if state.Req.IsEdns0() == nil {
+		return
+	}
+	o := m.IsEdns0()
+	if o == nil {
+		m.SetEdns0(uint16(state.Size()), state.Do())
+		o = m.IsEdns0()
+	}
+	o.Option = append(o.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
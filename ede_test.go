@@ -0,0 +1,112 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// edeOf returns the Extended DNS Error of m, nil if there is none.
+func edeOf(m *dns.Msg) *dns.EDNS0_EDE {
+	o := m.IsEdns0()
+	if o == nil {
+		return nil
+	}
+	for _, opt := range o.Option {
+		if ede, ok := opt.(*dns.EDNS0_EDE); ok {
+			return ede
+		}
+	}
+	return nil
+}
+
+func TestServeDNSEDE(t *testing.T) {
+	tests := []struct {
+		answers map[string][]dns.RR
+		edns    bool
+		// code is the expected EDE, if edns is set.
+		code uint16
+	}{
+		{
+			answers: map[string][]dns.RR{},
+			edns:    true,
+			code:    dns.ExtendedErrorCodeNetworkError,
+		},
+		{
+			answers: map[string][]dns.RR{
+				"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com.")},
+				"c.example.com.": {plugintest.CNAME("c.example.com. 300 IN CNAME b.example.com.")},
+			},
+			edns: true,
+			code: dns.ExtendedErrorCodeOther,
+		},
+		{
+			answers: map[string][]dns.RR{},
+			edns:    false,
+		},
+	}
+
+	for i, tc := range tests {
+		f := New()
+		f.Resolver = &stubResolver{answers: tc.answers}
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		if tc.edns {
+			req.SetEdns0(4096, false)
+		}
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if len(rec.Msg.Answer) != 1 {
+			t.Errorf("Test %d: expected the original answer, got %v", i, rec.Msg.Answer)
+		}
+		ede := edeOf(rec.Msg)
+		switch {
+		case !tc.edns && ede != nil:
+			t.Errorf("Test %d: expected no EDE without EDNS, got %v", i, ede)
+		case tc.edns && (ede == nil || ede.InfoCode != tc.code || ede.ExtraText == ""):
+			t.Errorf("Test %d: expected EDE %d with a text, got %v", i, tc.code, ede)
+		}
+	}
+}
+
+func TestServeDNSOnError(t *testing.T) {
+	tests := []struct {
+		onError   int
+		wantRcode int
+		wantRRs   int
+	}{
+		{answerOriginal, dns.RcodeSuccess, 1},
+		{dns.RcodeServerFailure, dns.RcodeServerFailure, 0},
+		{dns.RcodeSuccess, dns.RcodeSuccess, 0},
+	}
+
+	for i, tc := range tests {
+		f := New()
+		f.Resolver = &stubResolver{answers: map[string][]dns.RR{}}
+		f.onError = tc.onError
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		req.SetEdns0(4096, false)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if rec.Msg.Rcode != tc.wantRcode || len(rec.Msg.Answer) != tc.wantRRs {
+			t.Errorf("Test %d: expected %s with %d records, got %v", i, dns.RcodeToString[tc.wantRcode], tc.wantRRs, rec.Msg)
+		}
+		if ede := edeOf(rec.Msg); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeNetworkError {
+			t.Errorf("Test %d: expected EDE Network Error, got %v", i, ede)
+		}
+	}
+}
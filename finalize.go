@@ -2,45 +2,300 @@ package finalize
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"regexp"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/dnstap"
 	"github.com/coredns/coredns/plugin/metrics"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/plugin/pkg/nonwriter"
 	"github.com/coredns/coredns/plugin/pkg/upstream"
 	"github.com/coredns/coredns/request"
+	"github.com/expr-lang/expr/vm"
 	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
 )
 
 const pluginName = "finalize_cname"
 
 var log = clog.NewWithPlugin(pluginName)
 
+// Errors returned by resolveChain. A failed lookup or an exceeded deadline
+// allows serving stale records, the others do not. A dangling CNAME and a
+// name error are returned along with the chain resolved so far.
+var (
+	errLookup    = errors.New("lookup failed")
+	errDeadline  = errors.New("deadline exceeded")
+	errMaxLookup = errors.New("max lookup reached")
+	errCircular  = errors.New("circular reference")
+	errDangling  = errors.New("dangling CNAME")
+	errNXDomain  = errors.New("name error")
+	errThrottled = errors.New("lookup rate limit reached")
+)
+
+// Errors returned by admit for requests whose chains are not resolved.
+var (
+	errCircuitOpen   = errors.New("upstream lookups keep failing")
+	errMaxConcurrent = errors.New("max concurrent reached")
+)
+
 // Rewrite is plugin to rewrite requests internally before being handled.
 type Finalize struct {
 	Next plugin.Handler
 
-	upstream  *upstream.Upstream
-	maxLookup int
+	// Resolver is used to look up the targets of a CNAME chain.
+	Resolver Resolver
+
+	// zones, when set, limits finalization to the responses to questions in
+	// them, and except excludes the questions in its zones.
+	zones  plugin.Zones
+	except plugin.Zones
+
+	// clients, when set, limits finalization to the clients in its networks,
+	// and exceptClients excludes the clients in its networks.
+	clients       networks
+	exceptClients networks
+
+	// allowTargets, when set, limits the targets chains may lead to, and
+	// denyTargets excludes targets. Chains leading elsewhere are answered as
+	// set by deniedAction, an rcode or answerOriginal.
+	allowTargets plugin.Zones
+	denyTargets  plugin.Zones
+	deniedAction int
+	// denyTargetPatterns excludes the targets matching any of its patterns,
+	// compiled once when the configuration is parsed.
+	denyTargetPatterns []*regexp.Regexp
+
+	// blockedNetworks, when set, holds the networks the addresses of chains
+	// leaving the configured zones must not point into.
+	blockedNetworks networks
+
+	// allowedNetworks, when set, holds the networks the addresses of
+	// finalized answers must point into. Other answers are answered as set by
+	// deniedAction.
+	allowedNetworks networks
+
+	// rpz, when set, holds the response policy zone every target of a chain
+	// is checked against.
+	rpz *rpzPolicy
+
+	// types, when set, limits finalization to questions of the types in it.
+	types map[uint16]struct{}
+	// when, when set, limits finalization to the requests for which all its
+	// expressions evaluate to true.
+	when []*vm.Program
+
+	// maxLookup bounds the number of lookups of a chain, if greater than 0.
+	// It can be changed at runtime through the admin endpoint.
+	maxLookup atomic.Int64
+	// maxZones bounds the number of registrable domains a chain may cross, if
+	// greater than 0.
+	maxZones int
+	// lookupTimeout bounds the duration of each lookup, if greater than 0.
+	lookupTimeout time.Duration
+	// deadline bounds the duration of resolving the whole chain, if greater than 0.
+	deadline time.Duration
+
+	// sem, when set, limits the number of chains resolved concurrently.
+	sem chan struct{}
+
+	// limiter, when set, limits the rate of lookups.
+	limiter *rate.Limiter
+	// budget, when set, limits the rate of lookups triggered by each client.
+	budget *clientBudget
+
+	// breaker, when set, skips finalization while upstream lookups keep failing.
+	breaker *circuitBreaker
+	// health, when set, counts the failed lookups reported by the health
+	// endpoint.
+	health *lookupHealth
+
+	// ecs, when set, adds an EDNS Client Subnet option to lookups for queries without one.
+	ecs *ecsConfig
+
+	// stability, when set, keeps the terminal records of an alias stable for a time window.
+	stability *stabilityCache
+
+	// cache, when set, caches the records resolved for a chain.
+	cache *chainCache
+
+	// admin, when set, serves the HTTP endpoints to inspect and control the plugin.
+	admin *adminServer
+	// audits, when set, records the chains that were blocked or failed.
+	audits *auditLog
+
+	// hops, when set, caches the records of each lookup of a chain.
+	hops *chainCache
+
+	// snapshot, when set, persists the cache across restarts.
+	snapshot *snapshotter
+
+	// negative, when set, remembers the targets for which lookups returned no answer.
+	negative *negativeCache
+
+	// cacheInterop prepares finalized answers to be stored by the cache plugin.
+	cacheInterop bool
+
+	// flatten removes the CNAMEs from finalized answers.
+	flatten bool
+
+	// minimal flattens finalized answers and removes their other sections.
+	minimal bool
+
+	// harmonizeTTL sets the TTL of the resolved records of finalized answers,
+	// or of all their records if harmonizeAll is true, to the lowest one.
+	harmonizeTTL bool
+	harmonizeAll bool
+
+	// minTTL and maxTTL, when greater than 0, bound the TTLs of the records
+	// added to finalized answers.
+	minTTL uint32
+	maxTTL uint32
+
+	// addressOrder, when set, reorders the address records of finalized answers.
+	addressOrder addressOrder
+
+	// maxAddresses, when greater than 0, limits the number of address records
+	// of finalized answers.
+	maxAddresses int
+
+	// mergeSections adds the authority and additional records of the last
+	// lookup to finalized answers.
+	mergeSections bool
+
+	// targetMap, when set, rewrites CNAME targets before they are looked up.
+	targetMap targetMap
+
+	// loopNonce is carried by the lookups to detect them re-entering the
+	// server.
+	loopNonce []byte
+
+	// marker, when not 0, is the EDNS0 option code of the marker stamped on
+	// finalized responses, and responses carrying it are not processed again.
+	marker uint16
+
+	// validate requires the replies to all lookups to be validated by the
+	// upstream, and fails the request otherwise.
+	validate bool
+
+	// dual answers A questions with the AAAA records of the terminal name too.
+	dual bool
+
+	// srvAdditional and mxAdditional add the addresses of the targets of SRV
+	// and MX answers to the additional section.
+	srvAdditional bool
+	mxAdditional  bool
+
+	// svcbAlias follows HTTPS and SVCB records in AliasMode, and svcbHints
+	// adds address hints to the records in ServiceMode found.
+	svcbAlias bool
+	svcbHints bool
+
+	// rcodePassthrough keeps the original answer if a name of the chain does
+	// not exist, instead of answering NXDOMAIN.
+	rcodePassthrough bool
+
+	// onError is the answer to requests whose chain could not be finalized,
+	// an rcode or answerOriginal.
+	onError int
+	// disabled, when set through the admin endpoint, passes all requests on
+	// untouched.
+	disabled atomic.Bool
+	// ready is set once the plugin reported it is ready.
+	ready atomic.Bool
+	// following are the instances of the later finalize_cname blocks of the
+	// server block. Handlers are registered by name, so only the first
+	// instance is known to the ready plugin and reports for all of them.
+	following []*Finalize
+
+	// onDangling is the answer to requests whose chain ends in a name without
+	// records, an rcode, answerOriginal or danglingUpstream.
+	onDangling int
+
+	// zoneLabels bounds the zones labeled in the request and outcome metrics.
+	zoneLabels *zoneLabels
+
+	// chainLog, when set, logs a line per finalized request.
+	chainLog *chainLog
+	// recent, when set, holds the last finalized requests.
+	recent *recentChains
+	// slowChain, if greater than 0, is the duration of finalizing a request
+	// above which its chain is logged as a warning.
+	slowChain time.Duration
+	// top, when set, counts the most frequently finalized names.
+	top *topTargets
+	// events logs the chains that could not be finalized at their level.
+	events *eventLog
+
+	// tapPlugins are the dnstap plugins of the server, which are sent the
+	// lookups of the chains.
+	tapPlugins []*dnstap.Dnstap
 }
 
 func New() *Finalize {
 	s := &Finalize{
-		upstream:  upstream.New(),
-		maxLookup: 10,
+		Resolver:     upstream.New(),
+		loopNonce:    newLoopNonce(),
+		deniedAction: answerOriginal,
+		onError:      answerOriginal,
+		onDangling:   danglingUpstream,
+		zoneLabels:   newZoneLabels(defaultZoneLabelLimit),
+		events:       newEventLog(),
 	}
+	s.maxLookup.Store(10)
 
 	return s
 }
 
+// claimKey is the context key of the request claimed by an instance.
+type claimKey struct{}
+
+// claim returns a context marking r as finalized by an instance, so that
+// the instances of later blocks pass it on untouched.
+func claim(ctx context.Context, r *dns.Msg) context.Context {
+	return context.WithValue(ctx, claimKey{}, r)
+}
+
+// claimed reports whether r is finalized by an instance configured before
+// this one. The lookups of the chain are new requests and are not claimed.
+func claimed(ctx context.Context, r *dns.Msg) bool {
+	m, _ := ctx.Value(claimKey{}).(*dns.Msg)
+	return m == r
+}
+
 // ServeDNS implements the plugin.Handler interface.
 func (s *Finalize) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	// fail fast if this is a lookup of this instance sent back to the server
+	if s.loopNonce != nil && len(r.Question) == 1 && hasLoopNonce(r, s.loopNonce) {
+		return s.serveLoop(ctx, w, r)
+	}
+
+	// pass questions outside of the configured zones, types and clients on
+	// untouched, and all of them while disabled or claimed by an instance
+	// configured in an earlier block
+	if s.disabled.Load() || claimed(ctx, r) || !s.processes(ctx, w, r) {
+		return plugin.NextOrFailure(s.Name(), s.Next, ctx, w, r)
+	}
+	ctx = claim(ctx, r)
+
+	// count the lookups made for the request, including none at all
+	ctx, lookups := withLookupTrace(ctx, s.recent != nil || s.slowChain > 0)
+	defer func() {
+		lookupsPerRequest.WithLabelValues(metrics.WithServer(ctx)).Observe(float64(lookups.count()))
+	}()
+
 	// create a dummy writer, which not actually writes a response to the client
 	nw := nonwriter.New(w)
-	// call the rest of the plugin chain and pass the dummy writer to them
+	// call the rest of the plugin chain and pass the dummy writer to them,
+	// timing it apart from the finalization
+	nextStart := time.Now()
 	rcode, err := plugin.NextOrFailure(s.Name(), s.Next, ctx, nw, r)
+	observeDuration(ctx, nextDuration.WithLabelValues(metrics.WithServer(ctx)), nextStart)
 	if err != nil {
 		return rcode, err
 	}
@@ -50,81 +305,428 @@ func (s *Finalize) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 		return dns.RcodeServerFailure, fmt.Errorf("no answer received")
 	}
 
-	// do not process if the question type is CNAME
-	if response.Question[0].Qtype == dns.TypeCNAME {
-		log.Debug("Request is a CNAME type question, skipping")
+	// do not process responses without exactly one question, as the chain
+	// to follow is not defined for them
+	if len(response.Question) != 1 || len(r.Question) != 1 {
+		malformedResponseCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		log.Warningf("Response with %d questions to request with %d questions, skipping", len(response.Question), len(r.Question))
+		return s.writeResponse(w, response)
+	}
+
+	// do not process if another instance finalized the response already
+	if s.marker != 0 && hasMarker(response, s.marker) {
+		log.Debug("Response is marked as finalized, skipping")
+		s.recordOutcome(ctx, w, r, outcomeAlreadyFinal)
+		return s.writeResponse(w, response)
+	}
+
+	// do not process if the question type is CNAME or DNAME
+	if qtype := response.Question[0].Qtype; qtype == dns.TypeCNAME || qtype == dns.TypeDNAME {
+		log.Debug("Request is a CNAME or DNAME type question, skipping")
+		s.recordOutcome(ctx, w, r, outcomeSkippedCNAME)
 		return s.writeResponse(w, response)
 	}
 
 	// do not process if no answer is received
 	if len(response.Answer) == 0 {
 		log.Debug("No answer received, skipping")
+		s.recordOutcome(ctx, w, r, outcomeNoAnswer)
 		return s.writeResponse(w, response)
 	}
 
+	// follow HTTPS and SVCB answers in AliasMode
+	if s.svcbAlias && aliasTarget(response.Answer, response.Question[0].Qtype) != "" {
+		return s.serveAlias(ctx, w, r, response)
+	}
+
+	// complete SRV and MX answers with the addresses of their targets
+	if len(s.additionalTargets(response.Answer)) > 0 {
+		return s.serveAdditional(ctx, w, r, response)
+	}
+
 	// do not process if the answer is already finalized by other plugins
 	for _, rr := range response.Answer {
-		if rr.Header().Rrtype != dns.TypeCNAME {
+		if isTerminal(rr, response.Question[0].Qtype) {
 			log.Debugf("Answer is already finalized: %+v, skipping", rr)
+			s.recordOutcome(ctx, w, r, outcomeAlreadyFinal)
 			return s.writeResponse(w, response)
 		}
 	}
 
 	log.Debugf("Finalizing CNAME for request: %+v", response)
-	requestCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-	defer recordDuration(ctx, time.Now())
+	s.recordRequest(ctx, w, r)
+	start := time.Now()
+	defer recordDuration(ctx, start)
+	// the outcome is set on every return that is not a failure
+	outcome := outcomeFailed
+	defer func() { s.recordOutcome(ctx, w, r, outcome) }()
+	if span, spanCtx := startSpan(ctx, pluginName+"/finalize"); span != nil {
+		ctx = spanCtx
+		defer func() {
+			span.SetTag("outcome", outcome)
+			span.Finish()
+		}()
+	}
+	if s.chainLog != nil {
+		defer func() {
+			s.chainLog.log(request.Request{W: w, Req: r}, lookups.count(), time.Since(start), outcome)
+		}()
+	}
+	if s.slowChain > 0 {
+		defer func() {
+			if d := time.Since(start); d > s.slowChain {
+				log.Warningf("Finalizing %s took %v, more than %v, with outcome %s: %s", r.Question[0].Name, d, s.slowChain, outcome, formatHops(lookups.recorded()))
+			}
+		}()
+	}
+	if s.recent != nil {
+		defer func() {
+			state := request.Request{W: w, Req: r}
+			s.recent.add(recentChain{
+				Time:     start,
+				Name:     state.Name(),
+				Type:     state.Type(),
+				Client:   state.IP(),
+				Hops:     lookups.recorded(),
+				Duration: time.Since(start).String(),
+				Outcome:  outcome,
+			})
+		}()
+	}
 
-	state := request.Request{W: w, Req: response}
-	// emulate hashset in go; https://emersion.fr/blog/2017/sets-in-go/
-	lookupedNames := make(map[string]struct{})
-	lookupCnt := 0
+	// state describes the original query, so that its EDNS0 options are carried
+	// over into the lookups
+	state := request.Request{W: w, Req: r}
+	// resolve the chain for A records if both A and AAAA records are asked for
+	qtype, dual := s.dualTypes(state.QType())
+	if qtype != state.QType() {
+		state = withQType(state, qtype)
+	}
+	// lookup is state as sent upstream, while the response is shaped for the
+	// query of the client as is
+	lookup := s.lookupState(state)
+	// add the CNAMEs implied by DNAME records, so that the chain can be followed
+	response.Answer = synthesizeCNAMEs(response.Answer, state.QName())
 	// copy the answer to avoid modifying the original
 	rrs := make([]dns.RR, len(response.Answer))
 	copy(rrs, response.Answer)
 	targetName, err := findLastTarget(rrs, state.QName())
 	if err != nil {
 		log.Errorf("Failed to find last target in CNAME chain: %v", err)
-		return s.writeResponse(w, response)
+		return s.writeAbandoned(w, state, response, dns.ExtendedErrorCodeOther, err.Error())
+	}
+	if err := s.checkTargets(rrs); err != nil {
+		outcome = outcomeBlocked
+		return s.writeDenied(ctx, w, state, response, err)
+	}
+	if err := s.checkZones(ctx, chainNames(state.QName(), rrs)); err != nil {
+		return s.writeAbandoned(w, state, response, dns.ExtendedErrorCodeOther, err.Error())
 	}
 
+	var keys []cacheKey
+	if s.cache != nil {
+		keys = s.cache.keysFor(lookup, targetName)
+		if cached, key, ok := s.cached(ctx, keys); ok {
+			// the chain may have been cached under another configuration,
+			// from a snapshot or by another instance sharing the cache
+			if err := s.checkTargets(cached); err != nil {
+				outcome = outcomeBlocked
+				return s.writeDenied(ctx, w, state, response, err)
+			}
+			log.Debugf("Serving cached chain for CNAME [%s]", targetName)
+			if s.cache.shouldPrefetch(key) && cacheable(state) {
+				go s.prefetch(context.WithoutCancel(ctx), lookup, targetName)
+			}
+			rrs = s.appendResolved(rrs, cached)
+			if err := s.checkZones(ctx, chainNames(state.QName(), rrs)); err != nil {
+				return s.writeAbandoned(w, state, response, dns.ExtendedErrorCodeOther, err.Error())
+			}
+			rrs, _ = s.followAliases(ctx, lookup, rrs, cached)
+			rrs = s.mergeDual(ctx, lookup, rrs, dual)
+			if err := s.checkAddresses(rrs); err != nil {
+				outcome = outcomeBlocked
+				return s.writeDenied(ctx, w, state, response, err)
+			}
+			// whether the cached records came from authoritative and
+			// validated replies is not known
+			response.Authoritative = false
+			response.AuthenticatedData = false
+			if s.stability != nil {
+				rrs = s.stabilize(ctx, lookup, rrs)
+			}
+			response.Answer = rrs
+			outcome = outcomeFlattened
+			return s.writeFinalized(ctx, w, state, response, outcomeFlattened)
+		}
+		cacheMissCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	}
+
+	release, err := s.admit(ctx)
+	if err != nil {
+		code, text := edeFor(err)
+		return s.writeAbandoned(w, state, response, code, text)
+	}
+	defer release()
+
+	ch, err := s.resolveChain(ctx, lookup, targetName)
+	if err != nil {
+		outcome = outcomeFor(err)
+	}
+	if errors.Is(err, errDenied) {
+		return s.writeDenied(ctx, w, state, response, err)
+	}
+	if errors.Is(err, errBogus) || errors.Is(err, errUnvalidated) {
+		return s.writeValidationFailure(ctx, w, state, err)
+	}
+	if rcode, ok := s.danglingRcode(err, ch); ok {
+		if rcode == answerOriginal {
+			return s.writeAction(w, state, response, answerOriginal, dns.ExtendedErrorCodeOther, err.Error())
+		}
+		return s.writeNegative(ctx, w, state, response, ch, rcode)
+	}
+	if err != nil {
+		if errors.Is(err, errLookup) || errors.Is(err, errDeadline) {
+			return s.writeStale(ctx, w, state, keys, response, err)
+		}
+		code, text := edeFor(err)
+		return s.writeAbandoned(w, state, response, code, text)
+	}
+	if s.cache != nil && cacheable(state) {
+		s.cacheChain(ctx, scopedCacheKey(lookup, targetName, ch.scope), ch.rrs)
+	}
+
+	rrs = s.appendResolved(rrs, ch.rrs)
+	// the chain of the original answer and the resolved one may cross
+	// max_zones only together
+	if err := s.checkZones(ctx, chainNames(state.QName(), rrs)); err != nil {
+		return s.writeAbandoned(w, state, response, dns.ExtendedErrorCodeOther, err.Error())
+	}
+	followed, aliased := s.followAliases(ctx, lookup, rrs, ch.rrs)
+	if aliased {
+		rrs = followed
+	}
+	rrs = s.mergeDual(ctx, lookup, rrs, dual)
+	if err := s.checkAddresses(rrs); err != nil {
+		outcome = outcomeBlocked
+		return s.writeDenied(ctx, w, state, response, err)
+	}
+
+	if s.mergeSections && ch.reply != nil {
+		mergeSections(response, ch.reply)
+	}
+	// the answer is only as authoritative and authenticated as all its parts,
+	// and records added by following aliases were not validated along with it
+	response.Authoritative = response.Authoritative && ch.authoritative && !aliased
+	response.AuthenticatedData = response.AuthenticatedData && ch.authenticated && !aliased
+	if s.stability != nil {
+		rrs = s.stabilize(ctx, lookup, rrs)
+	}
+	response.Answer = rrs
+	outcome = outcomeFlattened
+	return s.writeFinalized(ctx, w, state, response, outcomeFlattened)
+}
+
+// admit applies the circuit breaker and max_concurrent to a request whose
+// targets are about to be looked up. Once admitted, release must be called
+// when the lookups are done.
+func (s *Finalize) admit(ctx context.Context) (release func(), err error) {
+	if s.breaker != nil && !s.breaker.allow() {
+		circuitSkippedCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		log.Debug("Circuit breaker is open, skipping")
+		return nil, errCircuitOpen
+	}
+	if s.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case s.sem <- struct{}{}:
+		return func() { <-s.sem }, nil
+	default:
+		maxConcurrentRejectedCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		log.Debugf("Max concurrent %d reached, skipping", cap(s.sem))
+		return nil, errMaxConcurrent
+	}
+}
+
+// processes reports whether the question of r is in the configured zones, not
+// excluded by except, and of one of the configured types, whether the client
+// is in the configured networks and not excluded by except_clients, and
+// whether the when expressions hold for the request.
+func (s *Finalize) processes(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) bool {
+	if len(s.clients) > 0 || len(s.exceptClients) > 0 {
+		state := request.Request{W: w, Req: r}
+		ip := net.ParseIP(state.IP())
+		if len(s.clients) > 0 && !s.clients.contains(ip) {
+			return false
+		}
+		if s.exceptClients.contains(ip) {
+			return false
+		}
+	}
+	if len(r.Question) == 0 {
+		return true
+	}
+	q := r.Question[0]
+	if len(s.zones) > 0 && s.zones.Matches(q.Name) == "" {
+		return false
+	}
+	if s.types != nil {
+		if _, ok := s.types[q.Qtype]; !ok {
+			return false
+		}
+	}
+	if s.except.Matches(q.Name) != "" {
+		return false
+	}
+	return len(s.when) == 0 || s.matchesWhen(ctx, &request.Request{W: w, Req: r})
+}
+
+// isTerminal reports whether rr answers a question of type qtype rather than
+// being part of the chain. CNAME and DNAME records, signatures, denial of
+// existence records and OPT pseudo-records are not terminal, unless they are
+// of the type asked for.
+func isTerminal(rr dns.RR, qtype uint16) bool {
+	switch rr.Header().Rrtype {
+	case qtype:
+		return true
+	case dns.TypeCNAME, dns.TypeDNAME, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeOPT:
+		return false
+	}
+	return true
+}
+
+// cached returns the records cached under the first of keys found in the
+// cache or, failing that, in the shared cache.
+func (s *Finalize) cached(ctx context.Context, keys []cacheKey) ([]dns.RR, cacheKey, bool) {
+	for _, key := range keys {
+		if rrs, ok := s.cache.get(key); ok {
+			cacheHitCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+			return rrs, key, true
+		}
+	}
+	if s.cache.shared != nil {
+		for _, key := range keys {
+			if rrs, ok := s.cache.getShared(ctx, key); ok {
+				return rrs, key, true
+			}
+		}
+	}
+	return nil, cacheKey{}, false
+}
+
+// prefetch resolves the chain starting at targetName again and refreshes its
+// cache entry. The chain is left to expire if resolving fails.
+func (s *Finalize) prefetch(ctx context.Context, state request.Request, targetName string) {
+	if s.breaker != nil && !s.breaker.allow() {
+		return
+	}
+	prefetchCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	ch, err := s.resolveChain(ctx, state, targetName)
+	if err != nil {
+		log.Debugf("Failed to prefetch CNAME [%s]: %v", targetName, err)
+		return
+	}
+	s.cacheChain(ctx, scopedCacheKey(state, targetName, ch.scope), ch.rrs)
+}
+
+// cacheChain stores the records resolved for a chain in the cache and, in
+// the background, in the shared cache if one is configured.
+func (s *Finalize) cacheChain(ctx context.Context, key cacheKey, rrs []dns.RR) {
+	s.cache.store(ctx, key, rrs)
+	if s.cache.shared != nil {
+		go s.cache.addShared(context.WithoutCancel(ctx), key, rrs)
+	}
+}
+
+// chain is the outcome of resolving a CNAME chain.
+type chain struct {
+	// rrs holds the records of all lookups.
+	rrs []dns.RR
+	// scope is the largest EDNS Client Subnet scope prefix length of the
+	// replies, 0 if none carried one.
+	scope uint8
+	// reply is the reply to the last lookup, nil if it was taken from the hop cache.
+	reply *dns.Msg
+	// authoritative and authenticated report whether all replies had the AA
+	// and the AD bit set. Lookups taken from the hop cache count as neither.
+	authoritative bool
+	authenticated bool
+}
+
+// resolveChain looks up the targets of the CNAME chain starting at targetName
+// until a record of the question type of state is found. An error is returned
+// if the chain can not be resolved. If the last lookup returned no answer, the
+// chain resolved so far is returned along with the error.
+func (s *Finalize) resolveChain(ctx context.Context, state request.Request, targetName string) (chain, error) {
+	inflight := inflightChains.WithLabelValues(metrics.WithServer(ctx))
+	inflight.Inc()
+	defer inflight.Dec()
+
+	if s.deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.deadline)
+		defer cancel()
+	}
+
+	// emulate hashset in go; https://emersion.fr/blog/2017/sets-in-go/
+	lookupedNames := make(map[string]struct{})
+	lookupCnt := 0
+	ch := chain{authoritative: true, authenticated: true}
+	// the names of the chain, checked against max_zones before each lookup
+	crossed := []string{state.QName()}
+
 	for {
 		log.Debugf("Trying to resolve CNAME [%+v] via upstream", targetName)
 
-		if s.maxLookup > 0 && lookupCnt >= s.maxLookup {
+		if s.deadlineExceeded(ctx) {
+			return chain{}, errDeadline
+		}
+		if canceled(ctx) {
+			return chain{}, ctx.Err()
+		}
+
+		if maxLookup := int(s.maxLookup.Load()); maxLookup > 0 && lookupCnt >= maxLookup {
 			maxLookupReachedCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-			log.Errorf("Max lookup %d reached for resolving CNAME records", s.maxLookup)
-			return s.writeResponse(w, response)
+			s.events.logf(eventMaxLookup, "Max lookup %d reached for resolving CNAME records", maxLookup)
+			return chain{}, errMaxLookup
 		}
 		lookupCnt++
 
+		if err := s.checkTarget(targetName); err != nil {
+			return chain{}, err
+		}
+		crossed = append(crossed, targetName)
+		if err := s.checkZones(ctx, crossed); err != nil {
+			return chain{}, err
+		}
+
 		if _, ok := lookupedNames[targetName]; ok {
 			circularReferenceCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-			log.Errorf("Detected circular reference in CNAME chain. CNAME [%s] already processed", targetName)
-			return s.writeResponse(w, response)
+			s.events.logf(eventCircular, "Detected circular reference in CNAME chain. CNAME [%s] already processed", targetName)
+			return chain{}, errCircular
 		}
 
-		lookupMsg, err := s.upstream.Lookup(ctx, state, targetName, state.QType())
+		lookupRRs, hopScope, reply, err := s.resolveHop(ctx, state, targetName)
+		ch.reply = reply
+		ch.authoritative = ch.authoritative && reply != nil && reply.Authoritative
+		ch.authenticated = ch.authenticated && reply != nil && reply.AuthenticatedData
 		if err != nil {
-			upstreamErrorCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-			log.Errorf("Failed to lookup CNAME [%+v] from upstream: [%+v]", targetName, err)
-			return s.writeResponse(w, response)
+			if errors.Is(err, errDangling) || errors.Is(err, errNXDomain) {
+				return ch, err
+			}
+			return chain{}, err
 		}
-
-		lookupRRs := lookupMsg.Answer
-		if len(lookupRRs) == 0 {
-			danglingCNameCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-			log.Errorf("Received no answer from upstream: [%+v]", lookupMsg)
-			return s.writeResponse(w, response)
+		if err := s.checkTargets(lookupRRs); err != nil {
+			return chain{}, err
 		}
-
-		rrs = append(rrs, lookupRRs...)
+		ch.rrs = append(ch.rrs, lookupRRs...)
+		ch.scope = max(ch.scope, hopScope)
 
 		// if answer is finalized, return it
 		for _, rr := range lookupRRs {
-			if rr.Header().Rrtype != dns.TypeCNAME {
+			if rr.Header().Rrtype == state.QType() {
 				log.Debugf("Recieved finalized answer: %+v", lookupRRs)
-				response.Answer = rrs
-				return s.writeResponse(w, response)
+				return ch, nil
 			}
 		}
 
@@ -135,12 +737,446 @@ func (s *Finalize) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Ms
 		targetName, err = findLastTarget(lookupRRs, targetName)
 		if err != nil {
 			log.Errorf("Failed to find last target in CNAME chain: %v", err)
-			return s.writeResponse(w, response)
+			return chain{}, err
 		}
 		log.Debugf("Found next target name: %s", targetName)
 	}
 }
 
+// resolveHop returns the records answering the lookup of a single target of the
+// chain, the EDNS Client Subnet scope prefix length of the reply and the reply
+// itself. In validate mode, lookups are made with the DO bit and an error is
+// returned if the reply was not validated. With hop memoization, the records
+// are taken from and stored in the hop cache, in which case no reply is
+// returned. If the reply holds no answer, it is returned along with
+// errDangling, or errNXDomain if the name does not exist.
+func (s *Finalize) resolveHop(ctx context.Context, state request.Request, targetName string) ([]dns.RR, uint8, *dns.Msg, error) {
+	if s.hops != nil {
+		for _, key := range s.hops.keysFor(state, targetName) {
+			if rrs, ok := s.hops.get(key); ok {
+				hopCacheHitCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+				log.Debugf("Using cached lookup of CNAME [%s]", targetName)
+				return rrs, key.scope, nil, nil
+			}
+		}
+	}
+
+	if s.negative != nil {
+		if reply, ok := s.negative.get(newCacheKey(state, targetName)); ok {
+			negativeCacheHitCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+			log.Debugf("CNAME [%s] is known to have no answer, skipping", targetName)
+			return nil, 0, reply, noAnswerErr(reply)
+		}
+	}
+
+	if s.limiter != nil && !s.limiter.Allow() {
+		throttledCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		log.Debugf("Lookup rate limit reached, not resolving CNAME [%s]", targetName)
+		return nil, 0, nil, errThrottled
+	}
+	if s.budget != nil && !s.budget.allow(state.IP()) {
+		budgetExceededCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		log.Debugf("Lookup budget of client %s exceeded, not resolving CNAME [%s]", state.IP(), targetName)
+		return nil, 0, nil, errBudget
+	}
+
+	lookupName := targetName
+	if len(s.targetMap) > 0 {
+		if mapped := s.targetMap.rewrite(targetName); mapped != dns.CanonicalName(targetName) {
+			log.Debugf("Looking up CNAME [%s] as [%s]", targetName, mapped)
+			lookupName = mapped
+		}
+	}
+
+	lookupState := state
+	if s.validates(state) && !state.Do() {
+		lookupState = withDO(state)
+	}
+	lookupMsg, err := s.lookup(ctx, lookupState, lookupName)
+	if err != nil {
+		if canceled(ctx) {
+			return nil, 0, nil, ctx.Err()
+		}
+		if s.deadlineExceeded(ctx) {
+			return nil, 0, nil, errDeadline
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			lookupTimeoutCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		}
+		upstreamErrorCount.WithLabelValues(metrics.WithServer(ctx), upstreamAddr(err)).Inc()
+		s.events.logf(eventUpstreamError, "Failed to lookup CNAME [%+v] from upstream: [%+v]", targetName, err)
+		s.recordFailure(ctx)
+		return nil, 0, nil, fmt.Errorf("%w of %s: %w", errLookup, targetName, err)
+	}
+	if s.loopNonce != nil && hasLoopNonce(lookupMsg, s.loopNonce) {
+		log.Errorf("Lookup of CNAME [%s] was sent back to this server, check the upstreams for loops", targetName)
+		return nil, 0, nil, fmt.Errorf("%w for %s", errLoop, targetName)
+	}
+	if len(lookupMsg.Question) != 1 {
+		malformedResponseCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		log.Errorf("Received reply with %d questions for CNAME [%s] from upstream", len(lookupMsg.Question), targetName)
+		return nil, 0, nil, fmt.Errorf("%w of %s: reply with %d questions", errLookup, targetName, len(lookupMsg.Question))
+	}
+	s.recordSuccess(ctx)
+	if s.validates(state) {
+		if err := checkValidated(lookupMsg, targetName); err != nil {
+			return nil, 0, lookupMsg, err
+		}
+	}
+	if !state.Do() {
+		stripDNSSEC(lookupMsg)
+	}
+
+	var scope uint8
+	if ecs := clientSubnet(lookupMsg); ecs != nil {
+		scope = ecs.SourceScope
+	}
+
+	answer := synthesizeCNAMEs(lookupMsg.Answer, lookupName)
+	lookupRRs, dropped := validAnswer(answer, lookupName, state.QType(), state.Do())
+	if dropped > 0 {
+		invalidRecordCount.WithLabelValues(metrics.WithServer(ctx)).Add(float64(dropped))
+		log.Warningf("Dropped %d records not matching lookup of %s from upstream answer", dropped, lookupName)
+	}
+	if lookupName != targetName {
+		lookupRRs = renameOwner(lookupRRs, lookupName, targetName)
+	}
+	if len(lookupRRs) == 0 {
+		danglingCNameCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		s.events.logf(eventDangling, "Received no answer from upstream: [%+v]", lookupMsg)
+		if s.negative != nil && cacheable(state) {
+			s.negative.add(newCacheKey(state, targetName), lookupMsg)
+		}
+		return nil, 0, lookupMsg, noAnswerErr(lookupMsg)
+	}
+	if s.hops != nil && cacheable(state) {
+		s.hops.add(scopedCacheKey(state, targetName, scope), lookupRRs)
+	}
+
+	return lookupRRs, scope, lookupMsg, nil
+}
+
+// noAnswerErr returns the error for reply holding no answer to a lookup.
+func noAnswerErr(reply *dns.Msg) error {
+	if reply.Rcode == dns.RcodeNameError {
+		return errNXDomain
+	}
+	return errDangling
+}
+
+// recordFailure feeds a failed lookup to the health stats and the circuit
+// breaker.
+func (s *Finalize) recordFailure(ctx context.Context) {
+	if s.health != nil {
+		s.health.add(true)
+	}
+	if s.breaker == nil || !s.breaker.failure() {
+		return
+	}
+	circuitOpenCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	circuitOpen.WithLabelValues(metrics.WithServer(ctx)).Set(1)
+	log.Warningf("Upstream lookups keep failing, skipping finalization for %v", s.breaker.cooldown)
+}
+
+// recordSuccess feeds a successful lookup to the health stats and the
+// circuit breaker.
+func (s *Finalize) recordSuccess(ctx context.Context) {
+	if s.health != nil {
+		s.health.add(false)
+	}
+	if s.breaker == nil || !s.breaker.success() {
+		return
+	}
+	circuitOpen.WithLabelValues(metrics.WithServer(ctx)).Set(0)
+	log.Info("Upstream lookups succeed again, resuming finalization")
+}
+
+// lookupResult is the outcome of a lookup running in the background.
+type lookupResult struct {
+	msg *dns.Msg
+	err error
+}
+
+// deadlineExceeded reports whether the deadline for resolving the chain has
+// passed, and records it if so.
+func (s *Finalize) deadlineExceeded(ctx context.Context) bool {
+	if s.deadline <= 0 || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return false
+	}
+	deadlineExceededCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	log.Errorf("Deadline of %v exceeded while resolving CNAME chain", s.deadline)
+	return true
+}
+
+// canceled reports whether ctx was canceled, e.g. because the client went
+// away or the server is shutting down, in which case resolving the chain is
+// abandoned.
+func canceled(ctx context.Context) bool {
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		return false
+	}
+	canceledCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	log.Debug("Context canceled while resolving CNAME chain")
+	return true
+}
+
+// lookup resolves a single target of the CNAME chain for the question type of
+// the request. If a lookup timeout is configured or ctx can be canceled, lookup
+// returns as soon as the timeout passes or ctx is done, even if the resolver
+// does not honor it.
+func (s *Finalize) lookup(ctx context.Context, state request.Request, name string) (*dns.Msg, error) {
+	if s.lookupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.lookupTimeout)
+		defer cancel()
+	}
+	if ctx.Done() == nil {
+		return s.resolve(ctx, state, name)
+	}
+
+	ch := make(chan lookupResult, 1)
+	go func() {
+		msg, err := s.resolve(ctx, state, name)
+		ch <- lookupResult{msg: msg, err: err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.msg, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("lookup of %s: %w", name, ctx.Err())
+	}
+}
+
+// resolve sends the lookup of name to the resolver. The lookup is counted as in
+// flight until the resolver returns, even if lookup gave up on it before.
+func (s *Finalize) resolve(ctx context.Context, state request.Request, name string) (*dns.Msg, error) {
+	inflight := inflightLookups.WithLabelValues(metrics.WithServer(ctx))
+	inflight.Inc()
+	defer inflight.Dec()
+	trace, _ := ctx.Value(lookupTraceKey{}).(*lookupTrace)
+	if trace != nil {
+		trace.start()
+	}
+	span, ctx := startSpan(ctx, pluginName+"/lookup")
+
+	start := time.Now()
+	reply, err := lookupVia(ctx, s.Resolver, state, name, state.QType())
+	if trace != nil {
+		trace.done(name, time.Since(start), lookupOutcome(reply, err))
+	}
+	if span != nil {
+		span.SetTag("target", name)
+		span.SetTag("outcome", lookupOutcome(reply, err))
+		span.Finish()
+	}
+	s.toDnstap(ctx, state, name, reply, start)
+	return reply, err
+}
+
+// stabilize replaces the terminal records in rrs, the ones owned by the last
+// target of the chain, with the ones previously served for the same question
+// and target, if they are still within the stability window.
+func (s *Finalize) stabilize(ctx context.Context, state request.Request, rrs []dns.RR) []dns.RR {
+	target, err := findLastTarget(rrs, state.QName())
+	if err != nil {
+		return rrs
+	}
+	target = dns.CanonicalName(target)
+	chain := make([]dns.RR, 0, len(rrs))
+	terminal := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeCNAME && dns.CanonicalName(rr.Header().Name) == target {
+			terminal = append(terminal, rr)
+		} else {
+			chain = append(chain, rr)
+		}
+	}
+
+	stable, replaced := s.stability.stabilize(newCacheKey(state, state.Name()), target, terminal)
+	if replaced {
+		stabilizedAnswerCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		log.Debugf("Serving stable answer for %s: %+v", state.Name(), stable)
+	}
+
+	return append(chain, stable...)
+}
+
+// Ready implements the ready.Readiness interface. The plugin is ready once
+// the instances of all its blocks are.
+func (s *Finalize) Ready() bool {
+	ready := s.instanceReady()
+	for _, f := range s.following {
+		ready = f.instanceReady() && ready
+	}
+	return ready
+}
+
+// instanceReady reports whether the upstream servers of the instance, if any,
+// have replied to a first health check and the cache snapshot, if any, has
+// been loaded. It stays ready afterwards, failing upstream servers are handled
+// by their health checks.
+func (s *Finalize) instanceReady() bool {
+	if s.ready.Load() {
+		return true
+	}
+	if s.snapshot != nil && !s.snapshot.loaded.Load() {
+		return false
+	}
+	if !resolverReady(s.Resolver) {
+		return false
+	}
+	s.ready.Store(true)
+	return true
+}
+
+// OnStartup starts the health checks of the upstream servers, loads the cache
+// snapshot, opens the audit log and starts the admin server, if configured.
+func (s *Finalize) OnStartup() error {
+	startResolver(s.Resolver)
+	if s.snapshot != nil {
+		s.snapshot.start()
+	}
+	if s.audits != nil {
+		if err := s.audits.open(); err != nil {
+			return err
+		}
+	}
+	if s.admin != nil {
+		return s.admin.start()
+	}
+	return nil
+}
+
+// OnShutdown closes the resolver if it holds any connections, and stops
+// everything started by OnStartup.
+func (s *Finalize) OnShutdown() error {
+	err := closeResolver(s.Resolver)
+	if s.audits != nil {
+		err = errors.Join(err, s.audits.close())
+	}
+	if s.admin != nil {
+		err = errors.Join(err, s.admin.shutdown())
+	}
+	if s.snapshot != nil {
+		err = errors.Join(err, s.snapshot.shutdown())
+	}
+	if s.cache != nil && s.cache.shared != nil {
+		err = errors.Join(err, s.cache.shared.Close())
+	}
+	return err
+}
+
+// appendResolved appends the records resolved for a chain to rrs, with their
+// TTLs bounded by minTTL and maxTTL.
+func (s *Finalize) appendResolved(rrs, resolved []dns.RR) []dns.RR {
+	if s.minTTL > 0 || s.maxTTL > 0 {
+		resolved = clampTTLs(resolved, s.minTTL, s.maxTTL)
+	}
+	return append(rrs, resolved...)
+}
+
+// writeStale writes response with the expired records cached under the first
+// of keys appended, if serving stale records is enabled and they are not too
+// old. Otherwise response is written as is, with the Extended DNS Error for
+// err, the reason the chain could not be resolved. Stale records pointing to
+// denied targets or holding addresses that are not allowed are denied as
+// fresh ones would be.
+func (s *Finalize) writeStale(ctx context.Context, w dns.ResponseWriter, state request.Request, keys []cacheKey, response *dns.Msg, err error) (int, error) {
+	code, text := edeFor(err)
+	if s.cache == nil || s.cache.staleFor == 0 {
+		return s.writeAbandoned(w, state, response, code, text)
+	}
+	for _, key := range keys {
+		if stale, ok := s.cache.getStale(key); ok {
+			answer := s.appendResolved(response.Answer, stale)
+			if err := s.checkTargets(stale); err != nil {
+				return s.writeDenied(ctx, w, state, response, err)
+			}
+			if err := s.checkAddresses(answer); err != nil {
+				return s.writeDenied(ctx, w, state, response, err)
+			}
+			staleAnswerCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+			log.Debugf("Serving stale chain for CNAME [%s]", key.name)
+			response.Answer = answer
+			response.Authoritative = false
+			response.AuthenticatedData = false
+			addEDE(response, state, dns.ExtendedErrorCodeStaleAnswer, text)
+			return s.writeFinalized(ctx, w, state, response, outcomeFor(err))
+		}
+	}
+	return s.writeAbandoned(w, state, response, code, text)
+}
+
+// writeNegative writes response completed with ch, the chain resolved up to
+// a name that does not exist or has no records of the question type, with
+// rcode and the SOA record of the reply to the last lookup as authority, so
+// that the client can cache the negative answer, as in RFC 2308 and RFC 6604.
+func (s *Finalize) writeNegative(ctx context.Context, w dns.ResponseWriter, state request.Request, response *dns.Msg, ch chain, rcode int) (int, error) {
+	response.Rcode = rcode
+	response.Answer = s.appendResolved(response.Answer, ch.rrs)
+	response.Ns = negativeAuthority(ch.reply)
+	response.Authoritative = response.Authoritative && ch.authoritative
+	response.AuthenticatedData = response.AuthenticatedData && ch.authenticated
+	return s.writeFinalized(ctx, w, state, response, outcomeDangling)
+}
+
+// writeFinalized writes a response whose answer was completed with the records
+// resolved for the chain, without duplicates and shaped as configured, with the
+// addresses of SRV and MX targets added and the marker stamped if enabled. In
+// cache interop mode the TTLs of the answer are set to the lowest one, so that
+// the cache plugin serves all records of the chain for the same time, and the
+// AD bit is cleared, as the records appended were not validated along with the
+// original answer. Responses too large for the client are compressed, and
+// truncated if that is not enough. The outcome of the request is published
+// along with the chain.
+func (s *Finalize) writeFinalized(ctx context.Context, w dns.ResponseWriter, state request.Request, response *dns.Msg, outcome string) (int, error) {
+	if len(s.additionalTargets(response.Answer)) > 0 {
+		s.addAdditional(ctx, state, response)
+	}
+	response.Answer = dedup(response.Answer)
+	if depth := countCNAMEs(response.Answer); depth > 0 {
+		chainDepth.WithLabelValues(metrics.WithServer(ctx)).Observe(float64(depth))
+	}
+	publishChain(ctx, response.Question[0].Name, response.Answer, outcome)
+	if s.top != nil {
+		if target, err := findLastTarget(response.Answer, response.Question[0].Name); err == nil {
+			s.top.add(dns.CanonicalName(response.Question[0].Name), dns.CanonicalName(target))
+		}
+	}
+	if s.blockedNetworks != nil {
+		response.Answer = s.dropPrivate(ctx, response.Answer)
+		s.dropPrivateAdditional(ctx, response)
+	}
+	if s.harmonizeTTL || s.cacheInterop {
+		response.Answer = harmonizeTTLs(response.Answer, s.harmonizeAll || s.cacheInterop)
+	}
+	// flattening would leave the signatures asked for without records
+	if (s.flatten || s.minimal) && !state.Do() {
+		response.Answer = flatten(response.Answer, response.Question[0].Name)
+	}
+	if s.minimal {
+		minimize(response)
+	}
+	if s.addressOrder != nil {
+		s.addressOrder.order(response.Answer)
+	}
+	if s.maxAddresses > 0 {
+		response.Answer = trimAddresses(response.Answer, s.maxAddresses)
+	}
+	if s.marker != 0 {
+		addMarker(response, state, s.marker)
+	}
+	saved, trimmed := fitResponse(response, state)
+	if saved > 0 {
+		compressionSavedBytes.WithLabelValues(metrics.WithServer(ctx)).Add(float64(saved))
+	}
+	if trimmed != "" {
+		oversizedResponseCount.WithLabelValues(metrics.WithServer(ctx), trimmed).Inc()
+	}
+	return s.writeResponse(w, response)
+}
+
 func (s *Finalize) writeResponse(w dns.ResponseWriter, response *dns.Msg) (int, error) {
 	err := w.WriteMsg(response)
 	if err != nil {
@@ -149,12 +1185,81 @@ func (s *Finalize) writeResponse(w dns.ResponseWriter, response *dns.Msg) (int,
 	return dns.RcodeSuccess, nil
 }
 
+// countCNAMEs returns the number of CNAME records of rrs, i.e. the number of
+// hops of the chain they hold.
+func countCNAMEs(rrs []dns.RR) int {
+	n := 0
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			n++
+		}
+	}
+	return n
+}
+
 // Name implements the Handler interface.
 func (al *Finalize) Name() string { return pluginName }
 
 func recordDuration(ctx context.Context, start time.Time) {
-	requestDuration.WithLabelValues(metrics.WithServer(ctx)).
-		Observe(time.Since(start).Seconds())
+	observeDuration(ctx, requestDuration.WithLabelValues(metrics.WithServer(ctx)), start)
+}
+
+// validAnswer returns the records of rrs that answer a lookup of name and
+// qtype, i.e. the CNAME chain starting at name, the records of type qtype
+// owned by any name of that chain, and the DNAME records the chain was
+// synthesized from. If do is true, the signatures of those records are kept
+// as well. The number of dropped records is returned as well.
+func validAnswer(rrs []dns.RR, name string, qtype uint16, do bool) ([]dns.RR, int) {
+	chain := map[string]struct{}{dns.CanonicalName(name): {}}
+	for grown := true; grown; {
+		grown = false
+		for _, rr := range rrs {
+			cname, ok := rr.(*dns.CNAME)
+			if !ok {
+				continue
+			}
+			if _, ok := chain[dns.CanonicalName(cname.Hdr.Name)]; !ok {
+				continue
+			}
+			if _, ok := chain[dns.CanonicalName(cname.Target)]; !ok {
+				chain[dns.CanonicalName(cname.Target)] = struct{}{}
+				grown = true
+			}
+		}
+	}
+
+	valid := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rrtype := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if !do {
+				continue
+			}
+			rrtype = sig.TypeCovered
+		}
+		switch rrtype {
+		case dns.TypeCNAME, qtype:
+			if _, ok := chain[dns.CanonicalName(rr.Header().Name)]; ok {
+				valid = append(valid, rr)
+			}
+		case dns.TypeDNAME:
+			if redirects(rr.Header().Name, chain) {
+				valid = append(valid, rr)
+			}
+		}
+	}
+	return valid, len(rrs) - len(valid)
+}
+
+// redirects reports whether a DNAME record owned by owner applies to any of
+// names, i.e. whether one of them is below owner.
+func redirects(owner string, names map[string]struct{}) bool {
+	for name := range names {
+		if name != dns.CanonicalName(owner) && dns.IsSubDomain(owner, name) {
+			return true
+		}
+	}
+	return false
 }
 
 // findLastTarget finds the last target in a CNAME chain.
@@ -1,10 +1,19 @@
 package finalize
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
 )
 
 func TestFindLastTarget(t *testing.T) {
@@ -77,3 +86,1230 @@ func TestFindLastTarget(t *testing.T) {
 		})
 	}
 }
+
+func TestValidAnswer(t *testing.T) {
+	rrs := []dns.RR{
+		plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com."),
+		plugintest.A("C.example.com. 300 IN A 192.0.2.1"),
+		plugintest.AAAA("c.example.com. 300 IN AAAA 2001:db8::1"),
+		plugintest.A("evil.example.net. 300 IN A 198.51.100.1"),
+		plugintest.CNAME("x.example.com. 300 IN CNAME b.example.com."),
+	}
+
+	valid, dropped := validAnswer(rrs, "b.example.com.", dns.TypeA, false)
+	if dropped != 3 {
+		t.Errorf("Expected 3 dropped records, got %d", dropped)
+	}
+	if len(valid) != 2 || valid[0] != rrs[0] || valid[1] != rrs[1] {
+		t.Errorf("Expected the CNAME and the A record of the chain, got %v", valid)
+	}
+}
+
+func TestValidAnswerTypes(t *testing.T) {
+	rrs := []dns.RR{
+		plugintest.DNAME("example.com. 300 IN DNAME example.net."),
+		plugintest.DNAME("example.org. 300 IN DNAME example.net."),
+		plugintest.CNAME("b.example.com. 300 IN CNAME b.example.net."),
+		plugintest.RRSIG("b.example.com. 300 IN RRSIG CNAME 8 3 300 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl"),
+		plugintest.A("b.example.net. 300 IN A 192.0.2.1"),
+		plugintest.RRSIG("b.example.net. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 12345 example.net. c2lnbmF0dXJl"),
+		plugintest.TXT("b.example.net. 300 IN TXT \"unrelated\""),
+		plugintest.RRSIG("b.example.net. 300 IN RRSIG TXT 8 3 300 20300101000000 20200101000000 12345 example.net. c2lnbmF0dXJl"),
+	}
+
+	valid, dropped := validAnswer(rrs, "b.example.com.", dns.TypeA, false)
+	if dropped != 5 || len(valid) != 3 || valid[0] != rrs[0] || valid[1] != rrs[2] || valid[2] != rrs[4] {
+		t.Errorf("Expected the DNAME, the CNAME and the A record, got %v", valid)
+	}
+
+	valid, dropped = validAnswer(rrs, "b.example.com.", dns.TypeA, true)
+	if dropped != 3 || len(valid) != 5 || valid[2] != rrs[3] || valid[4] != rrs[5] {
+		t.Errorf("Expected the signatures of the CNAME and the A record as well, got %v", valid)
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	tests := []struct {
+		rr    dns.RR
+		qtype uint16
+		want  bool
+	}{
+		{plugintest.A("a.example.com. 300 IN A 192.0.2.1"), dns.TypeA, true},
+		{plugintest.TXT("a.example.com. 300 IN TXT \"text\""), dns.TypeA, true},
+		{plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."), dns.TypeA, false},
+		{plugintest.DNAME("example.com. 300 IN DNAME example.net."), dns.TypeA, false},
+		{plugintest.RRSIG("a.example.com. 300 IN RRSIG CNAME 8 3 300 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl"), dns.TypeA, false},
+		{plugintest.RRSIG("a.example.com. 300 IN RRSIG CNAME 8 3 300 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl"), dns.TypeRRSIG, true},
+		{plugintest.NSEC("a.example.com. 300 IN NSEC b.example.com. CNAME RRSIG NSEC"), dns.TypeA, false},
+	}
+
+	for i, tc := range tests {
+		if got := isTerminal(tc.rr, tc.qtype); got != tc.want {
+			t.Errorf("Test %d: expected %v for %v, got %v", i, tc.want, tc.rr, got)
+		}
+	}
+}
+
+// stubResolver is a Resolver answering lookups from a static table of RRs
+// keyed by the looked up name.
+type stubResolver struct {
+	answers map[string][]dns.RR
+	lookups []string
+
+	// rcodes and authority set the rcode and the authority section of the
+	// replies for a looked up name.
+	rcodes    map[string]int
+	authority map[string][]dns.RR
+
+	// authoritative and authenticated set the AA and AD bits of the replies.
+	authoritative bool
+	authenticated bool
+}
+
+func (r *stubResolver) Lookup(_ context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+	r.lookups = append(r.lookups, name)
+	rrs, ok := r.answers[name]
+	if !ok {
+		return nil, errors.New("no such name")
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(name, typ)
+	m.Response = true
+	m.Rcode = r.rcodes[name]
+	m.Authoritative = r.authoritative
+	m.AuthenticatedData = r.authenticated
+	m.Answer = rrs
+	m.Ns = r.authority[name]
+	return m, nil
+}
+
+// cnameHandler returns a plugin.Handler that answers every query with rrs.
+func cnameHandler(rrs ...dns.RR) plugin.Handler {
+	return plugintest.HandlerFunc(func(_ context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = rrs
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+}
+
+func TestServeDNSUnlimitedLookups(t *testing.T) {
+	// a chain of 12 lookups, beyond the default limit of 10
+	answers := make(map[string][]dns.RR)
+	for i := 1; i < 12; i++ {
+		answers[fmt.Sprintf("h%d.example.com.", i)] = []dns.RR{plugintest.CNAME(fmt.Sprintf("h%d.example.com. 300 IN CNAME h%d.example.com.", i, i+1))}
+	}
+	answers["h12.example.com."] = []dns.RR{plugintest.A("h12.example.com. 300 IN A 192.0.2.1")}
+
+	f := New()
+	f.Resolver = &stubResolver{answers: answers}
+	f.Next = cnameHandler(plugintest.CNAME("h0.example.com. 300 IN CNAME h1.example.com."))
+
+	for _, limit := range []int64{10, 0} {
+		f.maxLookup.Store(limit)
+		req := new(dns.Msg)
+		req.SetQuestion("h0.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		finalized := rec.Msg.Answer[len(rec.Msg.Answer)-1].Header().Rrtype == dns.TypeA
+		if finalized != (limit == 0) {
+			t.Errorf("Expected the chain finalized only without a limit, got %v with max_lookup %d", rec.Msg.Answer, limit)
+		}
+	}
+}
+
+func TestServeDNSInstances(t *testing.T) {
+	answers := map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+		"b.example.net.": {plugintest.A("b.example.net. 300 IN A 192.0.2.2")},
+	}
+	first, second := &stubResolver{answers: answers}, &stubResolver{answers: answers}
+
+	// the first instance is scoped to example.com., the second to all names
+	inner := New()
+	inner.Resolver = second
+	outer := New()
+	outer.zones = plugin.Zones{"example.com."}
+	outer.Resolver = first
+	outer.Next = inner
+
+	tests := []struct {
+		qname, target string
+		resolver      *stubResolver
+	}{
+		{"a.example.com.", "b.example.com.", first},
+		{"a.example.net.", "b.example.net.", second},
+	}
+
+	for i, test := range tests {
+		first.lookups, second.lookups = nil, nil
+		inner.Next = cnameHandler(plugintest.CNAME(test.qname + " 300 IN CNAME " + test.target))
+
+		req := new(dns.Msg)
+		req.SetQuestion(test.qname, dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := outer.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+		if len(rec.Msg.Answer) != 2 {
+			t.Errorf("Test %d: expected a finalized answer, got %v", i, rec.Msg.Answer)
+		}
+		if len(first.lookups)+len(second.lookups) != 1 || len(test.resolver.lookups) != 1 {
+			t.Errorf("Test %d: expected a single lookup by the first instance in scope, got %v and %v", i, first.lookups, second.lookups)
+		}
+	}
+}
+
+func TestServeDNSWithResolver(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com.")},
+		"c.example.com.": {plugintest.A("c.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(resolver.lookups) != 2 {
+		t.Errorf("Expected 2 lookups, got %v", resolver.lookups)
+	}
+	if len(rec.Msg.Answer) != 3 {
+		t.Fatalf("Expected 3 answers, got %v", rec.Msg.Answer)
+	}
+	if a, ok := rec.Msg.Answer[2].(*dns.A); !ok || a.A.String() != "192.0.2.1" {
+		t.Errorf("Expected final A record 192.0.2.1, got %v", rec.Msg.Answer[2])
+	}
+}
+
+func TestLookupTrace(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com.")},
+		"c.example.com.": {plugintest.A("c.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	ctx, lookups := withLookupTrace(context.Background(), true)
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: req}
+	if _, err := f.resolveChain(ctx, state, "b.example.com."); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if n := lookups.count(); n != 2 {
+		t.Errorf("Expected 2 lookups to be counted, got %d", n)
+	}
+	if hops := lookups.recorded(); len(hops) != 2 || hops[0].Name != "b.example.com." || hops[1].Outcome != "NOERROR" {
+		t.Errorf("Expected the 2 lookups to be recorded, got %v", hops)
+	}
+}
+
+func TestServeDNSSignedCNAME(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.Next = cnameHandler(
+		plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."),
+		plugintest.RRSIG("a.example.com. 300 IN RRSIG CNAME 8 3 300 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl"),
+	)
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(resolver.lookups) != 1 || len(rec.Msg.Answer) != 3 || rec.Msg.Answer[2].Header().Rrtype != dns.TypeA {
+		t.Errorf("Expected the signed CNAME to be finalized, got %v", rec.Msg.Answer)
+	}
+}
+
+func TestServeDNSCache(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com.")},
+		"c.example.com.": {plugintest.A("c.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.cache = newChainCache(10, time.Minute)
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(rec.Msg.Answer) != 3 {
+			t.Fatalf("Expected 3 answers, got %v", rec.Msg.Answer)
+		}
+	}
+
+	if len(resolver.lookups) != 2 {
+		t.Errorf("Expected the second query to be served from the cache, got lookups %v", resolver.lookups)
+	}
+}
+
+func TestServeDNSCacheDeniedTarget(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {
+			plugintest.CNAME("b.example.com. 300 IN CNAME c.external.corp."),
+			plugintest.A("c.external.corp. 300 IN A 192.0.2.1"),
+		},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.cache = newChainCache(10, time.Hour)
+	f.deniedAction = dns.RcodeRefused
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// the chain was cached before the target was denied, e.g. by a reload
+	f.denyTargets = plugin.Zones{"external.corp."}
+	rec = dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(resolver.lookups) != 1 {
+		t.Errorf("Expected the second request to hit the cache, got lookups %v", resolver.lookups)
+	}
+	if rec.Msg.Rcode != dns.RcodeRefused || len(rec.Msg.Answer) != 0 {
+		t.Errorf("Expected the cached chain to the denied target refused, got %v", rec.Msg)
+	}
+}
+
+func TestServeDNSDedup(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {
+			plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com."),
+			plugintest.A("c.example.com. 300 IN A 192.0.2.1"),
+			plugintest.A("C.example.com. 60 IN A 192.0.2.1"),
+		},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(rec.Msg.Answer) != 3 {
+		t.Errorf("Expected 3 answers without duplicates, got %v", rec.Msg.Answer)
+	}
+}
+
+func TestServeDNSDedupKeepsNextRecords(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+	}}
+	// the zone data of the next plugin repeats the CNAME with a lower TTL
+	zone := plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com.")
+
+	f := New()
+	f.Resolver = resolver
+	f.Next = cnameHandler(zone, plugintest.CNAME("A.example.com. 60 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(rec.Msg.Answer) != 2 || rec.Msg.Answer[0].Header().Ttl != 60 {
+		t.Errorf("Expected the duplicate CNAME merged with the lower TTL, got %v", rec.Msg.Answer)
+	}
+	if zone.Header().Ttl != 300 {
+		t.Errorf("Expected the record of the next plugin unchanged, got TTL %d", zone.Header().Ttl)
+	}
+}
+
+func TestServeDNSTargetMap(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.internal-cdn.corp.": {plugintest.A("b.internal-cdn.corp. 300 IN A 10.0.0.1")},
+	}}
+	rule, _ := newTargetRule("suffix", "external-cdn.com.", "internal-cdn.corp.")
+
+	f := New()
+	f.Resolver = resolver
+	f.targetMap = targetMap{rule}
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.external-cdn.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(rec.Msg.Answer) != 2 || rec.Msg.Answer[1].Header().Name != "b.external-cdn.com." {
+		t.Errorf("Expected the internal address answered under the original target, got %v", rec.Msg.Answer)
+	}
+}
+
+func TestServeDNSDNAME(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.net.": {
+			plugintest.DNAME("example.net. 300 IN DNAME example.org."),
+			plugintest.A("b.example.org. 300 IN A 192.0.2.1"),
+		},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.Next = cnameHandler(plugintest.DNAME("example.com. 300 IN DNAME example.net."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("b.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(rec.Msg.Answer) != 5 {
+		t.Fatalf("Expected 2 DNAMEs, 2 synthesized CNAMEs and the A record, got %v", rec.Msg.Answer)
+	}
+	if a, ok := rec.Msg.Answer[4].(*dns.A); !ok || a.A.String() != "192.0.2.1" {
+		t.Errorf("Expected final A record 192.0.2.1, got %v", rec.Msg.Answer[4])
+	}
+}
+
+func TestServeDNSFlatten(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com.")},
+		"c.example.com.": {plugintest.A("c.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.flatten = true
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(rec.Msg.Answer) != 1 {
+		t.Fatalf("Expected 1 answer, got %v", rec.Msg.Answer)
+	}
+	if a, ok := rec.Msg.Answer[0].(*dns.A); !ok || a.Hdr.Name != "a.example.com." || a.A.String() != "192.0.2.1" {
+		t.Errorf("Expected A record a.example.com. 192.0.2.1, got %v", rec.Msg.Answer[0])
+	}
+}
+
+func TestServeDNSDNSSEC(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {
+			plugintest.A("b.example.com. 300 IN A 192.0.2.1"),
+			plugintest.RRSIG("b.example.com. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl"),
+		},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.flatten = true
+	f.Next = cnameHandler(
+		plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."),
+		plugintest.RRSIG("a.example.com. 300 IN RRSIG CNAME 8 3 300 20300101000000 20200101000000 12345 example.com. c2lnbmF0dXJl"),
+	)
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("Expected the flattened A record only, got %v", rec.Msg.Answer)
+	}
+
+	req.SetEdns0(4096, true)
+	rec = dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rec.Msg.Answer) != 4 {
+		t.Fatalf("Expected the chain with its signatures, got %v", rec.Msg.Answer)
+	}
+	for i, want := range []uint16{dns.TypeCNAME, dns.TypeRRSIG, dns.TypeA, dns.TypeRRSIG} {
+		if rec.Msg.Answer[i].Header().Rrtype != want {
+			t.Errorf("Expected %s record at %d, got %v", dns.TypeToString[want], i, rec.Msg.Answer[i])
+		}
+	}
+}
+
+func TestServeDNSCacheInterop(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 60 IN A 192.0.2.1")},
+	}}
+	cname := plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com.")
+
+	f := New()
+	f.Resolver = resolver
+	f.cacheInterop = true
+	f.Next = plugintest.HandlerFunc(func(_ context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.AuthenticatedData = true
+		m.Answer = []dns.RR{cname}
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for _, rr := range rec.Msg.Answer {
+		if rr.Header().Ttl != 60 {
+			t.Errorf("Expected a TTL of 60, got %v", rr)
+		}
+	}
+	if cname.Header().Ttl != 300 {
+		t.Errorf("Expected the original answer to be left unmodified, got %v", cname)
+	}
+}
+
+func TestServeDNSFlags(t *testing.T) {
+	tests := []struct {
+		authoritative, authenticated bool
+	}{
+		{false, false},
+		{true, false},
+		{true, true},
+	}
+
+	for i, tc := range tests {
+		resolver := &stubResolver{
+			answers: map[string][]dns.RR{
+				"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com.")},
+				"c.example.com.": {plugintest.A("c.example.com. 300 IN A 192.0.2.1")},
+			},
+			authoritative: tc.authoritative,
+			authenticated: tc.authenticated,
+		}
+
+		f := New()
+		f.Resolver = resolver
+		f.Next = plugintest.HandlerFunc(func(_ context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Authoritative = true
+			m.AuthenticatedData = true
+			m.RecursionAvailable = true
+			m.Answer = []dns.RR{plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com.")}
+			w.WriteMsg(m)
+			return dns.RcodeSuccess, nil
+		})
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if rec.Msg.Authoritative != tc.authoritative || rec.Msg.AuthenticatedData != tc.authenticated || !rec.Msg.RecursionAvailable {
+			t.Errorf("Test %d: expected AA %v, AD %v and RA, got %v", i, tc.authoritative, tc.authenticated, rec.Msg.MsgHdr)
+		}
+	}
+}
+
+func TestServeDNSHopCache(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com.")},
+		"c.example.com.": {plugintest.A("c.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.cache = newChainCache(10, time.Minute)
+	f.hops = newChainCache(10, time.Minute)
+
+	for _, alias := range []string{"a.example.com.", "x.example.com."} {
+		f.Next = cnameHandler(plugintest.CNAME(alias + " 300 IN CNAME b.example.com."))
+
+		req := new(dns.Msg)
+		req.SetQuestion(alias, dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(rec.Msg.Answer) != 3 {
+			t.Fatalf("Expected 3 answers, got %v", rec.Msg.Answer)
+		}
+	}
+
+	if len(resolver.lookups) != 2 {
+		t.Errorf("Expected the hops of the second chain to be served from the hop cache, got lookups %v", resolver.lookups)
+	}
+}
+
+func TestServeDNSPrefetch(t *testing.T) {
+	now := time.Unix(1000, 0)
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 60 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.cache = newChainCache(10, time.Minute)
+	f.cache.prefetchHits = 1
+	f.cache.prefetchWindow = time.Minute
+	f.cache.prefetchPercentage = 10
+	f.cache.now = func() time.Time { return now }
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	if _, err := f.ServeDNS(context.Background(), dnstest.NewRecorder(&plugintest.ResponseWriter{}), req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	now = now.Add(55 * time.Second)
+	if _, err := f.ServeDNS(context.Background(), dnstest.NewRecorder(&plugintest.ResponseWriter{}), req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for i := 0; i < 100 && f.cache.len() == 1; i++ {
+		f.cache.mu.Lock()
+		refreshed := f.cache.entries[newCacheKey(request.Request{Req: req}, "b.example.com.")].Value.(*cacheEntry).stored.Equal(now)
+		f.cache.mu.Unlock()
+		if refreshed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected the chain to be refreshed in the background")
+}
+
+func TestServeDNSServeStale(t *testing.T) {
+	now := time.Unix(1000, 0)
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 60 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.cache = newChainCache(10, time.Minute)
+	f.cache.staleFor = time.Hour
+	f.cache.now = func() time.Time { return now }
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	resolver.answers = nil
+	rec = dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rec.Msg.Answer) != 2 {
+		t.Fatalf("Expected the stale answer, got %v", rec.Msg.Answer)
+	}
+	if ttl := rec.Msg.Answer[1].Header().Ttl; ttl != staleTTL {
+		t.Errorf("Expected stale TTL %d, got %d", staleTTL, ttl)
+	}
+}
+
+func TestServeDNSServeStaleDenied(t *testing.T) {
+	now := time.Unix(1000, 0)
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 60 IN A 198.51.100.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.cache = newChainCache(10, time.Minute)
+	f.cache.staleFor = time.Hour
+	f.cache.now = func() time.Time { return now }
+	f.allowedNetworks, _ = parseNetworks([]string{"192.0.2.0/24"})
+	f.deniedAction = dns.RcodeRefused
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if rec.Msg.Rcode != dns.RcodeRefused || len(rec.Msg.Answer) != 0 {
+			t.Errorf("Request %d: expected the denied address refused, got %v", i, rec.Msg)
+		}
+		// the chain cached by the first request turns stale
+		now = now.Add(2 * time.Minute)
+		resolver.answers = nil
+	}
+}
+
+// scopeResolver is a Resolver answering every lookup with an A record and an
+// EDNS Client Subnet option of the given scope.
+type scopeResolver struct {
+	scope   uint8
+	lookups int
+}
+
+func (r *scopeResolver) Lookup(_ context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+	r.lookups++
+	m := new(dns.Msg)
+	m.SetQuestion(name, typ)
+	m.Answer = []dns.RR{plugintest.A(name + " 60 IN A 192.0.2.1")}
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	ecs := *clientSubnet(state.Req)
+	ecs.SourceScope = r.scope
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &ecs)
+	return m, nil
+}
+
+func TestServeDNSCacheECSScope(t *testing.T) {
+	tests := []struct {
+		scope   uint8
+		lookups int
+	}{
+		{0, 1},
+		{16, 1},
+		{24, 2},
+	}
+
+	for i, test := range tests {
+		resolver := &scopeResolver{scope: test.scope}
+		f := New()
+		f.Resolver = resolver
+		f.cache = newChainCache(10, time.Minute)
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+		// two clients in different /24 networks of the same /16
+		for _, subnet := range []string{"10.240.1.0", "10.240.2.0"} {
+			req := new(dns.Msg)
+			req.SetQuestion("a.example.com.", dns.TypeA)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(subnet).To4(),
+			})
+			rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+			if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatalf("Test %d: expected no error, got %v", i, err)
+			}
+		}
+
+		if resolver.lookups != test.lookups {
+			t.Errorf("Test %d: expected %d lookups for scope %d, got %d", i, test.lookups, test.scope, resolver.lookups)
+		}
+	}
+}
+
+func TestServeDNSNegativeCache(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.negative = newNegativeCache(time.Minute)
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(rec.Msg.Answer) != 1 {
+			t.Fatalf("Expected the original answer, got %v", rec.Msg.Answer)
+		}
+	}
+
+	if len(resolver.lookups) != 1 {
+		t.Errorf("Expected the dangling target to be looked up once, got %v", resolver.lookups)
+	}
+}
+
+func TestServeDNSNameError(t *testing.T) {
+	soa := plugintest.SOA("example.net. 60 IN SOA ns.example.net. hostmaster.example.net. 1 7200 3600 1209600 60")
+	resolver := &stubResolver{
+		answers: map[string][]dns.RR{
+			"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.net.")},
+			"c.example.net.": {},
+		},
+		rcodes:    map[string]int{"c.example.net.": dns.RcodeNameError},
+		authority: map[string][]dns.RR{"c.example.net.": {soa}},
+	}
+
+	tests := []struct {
+		passthrough bool
+		rcode       int
+		answers     int
+	}{
+		{false, dns.RcodeNameError, 2},
+		{true, dns.RcodeSuccess, 1},
+	}
+
+	for i, tc := range tests {
+		f := New()
+		f.Resolver = resolver
+		f.rcodePassthrough = tc.passthrough
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if rec.Msg.Rcode != tc.rcode || len(rec.Msg.Answer) != tc.answers {
+			t.Errorf("Test %d: expected rcode %d with %d answers, got %v", i, tc.rcode, tc.answers, rec.Msg)
+		}
+		if !tc.passthrough && (len(rec.Msg.Ns) != 1 || rec.Msg.Ns[0] != soa) {
+			t.Errorf("Test %d: expected the SOA record of the last lookup, got %v", i, rec.Msg.Ns)
+		}
+	}
+}
+
+func TestServeDNSNoData(t *testing.T) {
+	soa := plugintest.SOA("example.net. 60 IN SOA ns.example.net. hostmaster.example.net. 1 7200 3600 1209600 60")
+	resolver := &stubResolver{
+		answers: map[string][]dns.RR{
+			"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.net.")},
+			"c.example.net.": {},
+		},
+		authority: map[string][]dns.RR{"c.example.net.": {soa}},
+	}
+
+	f := New()
+	f.Resolver = resolver
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if rec.Msg.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) != 2 {
+		t.Errorf("Expected NOERROR with the chain, got %v", rec.Msg)
+	}
+	if len(rec.Msg.Ns) != 1 || rec.Msg.Ns[0] != soa {
+		t.Errorf("Expected the SOA record of the last lookup, got %v", rec.Msg.Ns)
+	}
+}
+
+func TestServeDNSInvalidRecords(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {
+			plugintest.A("evil.example.net. 300 IN A 198.51.100.1"),
+			plugintest.A("b.example.com. 300 IN A 192.0.2.1"),
+		},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(rec.Msg.Answer) != 2 {
+		t.Fatalf("Expected 2 answers, got %v", rec.Msg.Answer)
+	}
+	if rec.Msg.Answer[1].Header().Name != "b.example.com." {
+		t.Errorf("Expected the record of the chain, got %v", rec.Msg.Answer[1])
+	}
+}
+
+func TestServeDNSZones(t *testing.T) {
+	tests := []struct {
+		qname string
+		want  int
+	}{
+		{"a.example.com.", 2},
+		{"a.sub.example.com.", 1},
+		{"a.example.org.", 1},
+	}
+
+	for i, tc := range tests {
+		resolver := &stubResolver{answers: map[string][]dns.RR{
+			"b.example.net.": {plugintest.A("b.example.net. 300 IN A 192.0.2.1")},
+		}}
+
+		f := New()
+		f.Resolver = resolver
+		f.zones = plugin.Zones{"example.com.", "cdn.net."}
+		f.except = plugin.Zones{"sub.example.com."}
+		f.Next = cnameHandler(plugintest.CNAME(tc.qname + " 300 IN CNAME b.example.net."))
+
+		req := new(dns.Msg)
+		req.SetQuestion(tc.qname, dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if len(rec.Msg.Answer) != tc.want {
+			t.Errorf("Test %d: expected %d records for %s, got %v", i, tc.want, tc.qname, rec.Msg.Answer)
+		}
+	}
+}
+
+func TestServeDNSTypes(t *testing.T) {
+	for i, qtype := range []uint16{dns.TypeA, dns.TypeTXT} {
+		resolver := &stubResolver{answers: map[string][]dns.RR{
+			"b.example.com.": {
+				plugintest.A("b.example.com. 300 IN A 192.0.2.1"),
+				plugintest.TXT("b.example.com. 300 IN TXT \"text\""),
+			},
+		}}
+
+		f := New()
+		f.Resolver = resolver
+		f.types = map[uint16]struct{}{dns.TypeA: {}}
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", qtype)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		want := 1
+		if qtype == dns.TypeA {
+			want = 2
+		}
+		if len(rec.Msg.Answer) != want {
+			t.Errorf("Test %d: expected %d records for type %s, got %v", i, want, dns.TypeToString[qtype], rec.Msg.Answer)
+		}
+	}
+}
+
+func TestServeDNSClients(t *testing.T) {
+	// the test response writer has the client address 10.240.0.1
+	tests := []struct {
+		clients, except []string
+		want            int
+	}{
+		{nil, nil, 2},
+		{[]string{"10.240.0.0/16"}, nil, 2},
+		{[]string{"10.9.0.0/16"}, nil, 1},
+		{nil, []string{"10.240.0.1"}, 1},
+		{[]string{"10.240.0.0/16"}, []string{"10.240.0.0/24"}, 1},
+	}
+
+	for i, tc := range tests {
+		resolver := &stubResolver{answers: map[string][]dns.RR{
+			"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+		}}
+
+		f := New()
+		f.Resolver = resolver
+		f.clients, _ = parseNetworks(tc.clients)
+		f.exceptClients, _ = parseNetworks(tc.except)
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if len(rec.Msg.Answer) != tc.want {
+			t.Errorf("Test %d: expected %d records, got %v", i, tc.want, rec.Msg.Answer)
+		}
+	}
+}
+
+func TestServeDNSQuestions(t *testing.T) {
+	for i, questions := range [][]dns.Question{
+		nil,
+		{{Name: "a.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, {Name: "b.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+	} {
+		resolver := &stubResolver{answers: map[string][]dns.RR{
+			"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+		}}
+
+		f := New()
+		f.Resolver = resolver
+		f.Next = plugintest.HandlerFunc(func(_ context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Question = questions
+			m.Answer = []dns.RR{plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com.")}
+			w.WriteMsg(m)
+			return dns.RcodeSuccess, nil
+		})
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if len(resolver.lookups) != 0 || len(rec.Msg.Answer) != 1 {
+			t.Errorf("Test %d: expected the response to be passed through, got %v", i, rec.Msg)
+		}
+	}
+}
+
+func TestServeDNSResolverError(t *testing.T) {
+	f := New()
+	f.Resolver = &stubResolver{}
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected the original answer, got %v", rec.Msg.Answer)
+	}
+}
+
+// slowResolver is a Resolver that ignores the context and replies after delay.
+type slowResolver struct {
+	delay time.Duration
+}
+
+func (r *slowResolver) Lookup(_ context.Context, _ request.Request, name string, typ uint16) (*dns.Msg, error) {
+	time.Sleep(r.delay)
+	m := new(dns.Msg)
+	m.SetQuestion(name, typ)
+	m.Answer = []dns.RR{plugintest.A(name + " 60 IN A 192.0.2.1")}
+	return m, nil
+}
+
+func TestServeDNSLookupTimeout(t *testing.T) {
+	f := New()
+	f.Resolver = &slowResolver{delay: time.Second}
+	f.lookupTimeout = 10 * time.Millisecond
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	start := time.Now()
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Expected the lookup to be abandoned after the timeout, took %v", d)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected the original answer, got %v", rec.Msg.Answer)
+	}
+}
+
+func TestReady(t *testing.T) {
+	f := New()
+	if !f.Ready() {
+		t.Errorf("Expected the plugin to be ready when resolving through the plugin chain")
+	}
+
+	dead := newTestUpstream(deadAddr(t))
+	defer dead.Close()
+	f = New()
+	f.Resolver = &routeTable{fallback: &stubResolver{}, resolvers: map[string]Resolver{"example.com.": dead}}
+	if f.Ready() {
+		t.Errorf("Expected the plugin not to be ready while a route has no replying server")
+	}
+
+	f = New()
+	f.snapshot = &snapshotter{}
+	if f.Ready() {
+		t.Errorf("Expected the plugin not to be ready before the cache snapshot is loaded")
+	}
+	f.snapshot.loaded.Store(true)
+	if !f.Ready() {
+		t.Errorf("Expected the plugin to be ready once the cache snapshot is loaded")
+	}
+}
+
+func TestServeDNSDeadline(t *testing.T) {
+	f := New()
+	f.Resolver = &slowResolver{delay: time.Second}
+	f.deadline = 10 * time.Millisecond
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	start := time.Now()
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Expected finalization to be abandoned after the deadline, took %v", d)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected the original answer, got %v", rec.Msg.Answer)
+	}
+}
+
+func TestServeDNSCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := New()
+	f.Resolver = &slowResolver{delay: time.Second}
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := f.ServeDNS(ctx, rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Expected finalization to be abandoned once canceled, took %v", d)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected the original answer, got %v", rec.Msg.Answer)
+	}
+
+	// a canceled context stops the chain before the next lookup
+	resolver := &stubResolver{}
+	f = New()
+	f.Resolver = resolver
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+	rec = dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(ctx, rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(resolver.lookups) != 0 {
+		t.Errorf("Expected no lookups, got %v", resolver.lookups)
+	}
+}
+
+func TestServeDNSCircuitBreaker(t *testing.T) {
+	resolver := &stubResolver{}
+	f := New()
+	f.Resolver = resolver
+	f.breaker = newCircuitBreaker(2, time.Minute)
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(rec.Msg.Answer) != 1 {
+			t.Errorf("Expected the original answer, got %v", rec.Msg.Answer)
+		}
+	}
+
+	if len(resolver.lookups) != 2 {
+		t.Errorf("Expected lookups to stop once the circuit opened, got %v", resolver.lookups)
+	}
+}
+
+func TestServeDNSMaxConcurrent(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+	}}
+	f := New()
+	f.Resolver = resolver
+	f.sem = make(chan struct{}, 1)
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+
+	// occupy the only slot, as a concurrent finalization would
+	f.sem <- struct{}{}
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	f.ServeDNS(context.Background(), rec, req)
+	if len(rec.Msg.Answer) != 1 || len(resolver.lookups) != 0 {
+		t.Errorf("Expected the original answer without lookups, got %v", rec.Msg.Answer)
+	}
+
+	<-f.sem
+	rec = dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	f.ServeDNS(context.Background(), rec, req)
+	if len(rec.Msg.Answer) != 2 {
+		t.Errorf("Expected a finalized answer, got %v", rec.Msg.Answer)
+	}
+	if len(f.sem) != 0 {
+		t.Errorf("Expected the slot to be released after finalization")
+	}
+}
+
+func TestServeDNSRateLimit(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+	}}
+	f := New()
+	f.Resolver = resolver
+	f.limiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	for i, want := range []int{2, 1} {
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		f.ServeDNS(context.Background(), rec, req)
+		if len(rec.Msg.Answer) != want {
+			t.Errorf("Request %d: expected %d answers, got %v", i, want, rec.Msg.Answer)
+		}
+	}
+	if len(resolver.lookups) != 1 {
+		t.Errorf("Expected a single lookup, got %v", resolver.lookups)
+	}
+}
@@ -0,0 +1,102 @@
+package finalize
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// grpcUpstream resolves CNAME targets by querying another CoreDNS instance
+// over the CoreDNS gRPC protocol.
+type grpcUpstream struct {
+	addr        string
+	ednsOptions []uint16
+	loopNonce   []byte
+
+	conn   *grpc.ClientConn
+	client pb.DnsServiceClient
+}
+
+// newGRPCUpstream returns a gRPC upstream for addr. Without a TLS
+// configuration the connection is made without transport security.
+func newGRPCUpstream(addr string, opts upstreamOptions) (*grpcUpstream, error) {
+	creds := insecure.NewCredentials()
+	if opts.tlsConfig != nil {
+		creds = credentials.NewTLS(opts.tlsConfig)
+	}
+
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if d := dialer("tcp", opts.bindAddr); d != nil {
+		dialOpts = append(dialOpts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		}))
+	}
+
+	conn, err := grpc.NewClient(addr, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &grpcUpstream{
+		addr:        addr,
+		ednsOptions: opts.ednsOptions,
+		loopNonce:   opts.loopNonce,
+		conn:        conn,
+		client:      pb.NewDnsServiceClient(conn),
+	}, nil
+}
+
+// Lookup sends a query for name and typ to the gRPC upstream and waits for a response.
+func (g *grpcUpstream) Lookup(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+	req := newLookupMsg(state, name, typ, g.ednsOptions)
+	if g.loopNonce != nil {
+		addLoopNonce(req, g.loopNonce)
+	}
+
+	msg, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	reply, err := g.client.Query(ctx, &pb.DnsPacket{Msg: msg})
+	observeDuration(ctx, lookupDuration.WithLabelValues(metrics.WithServer(ctx), g.addr), start)
+	if err != nil {
+		// the CoreDNS gRPC server reports NXDOMAIN as a NotFound status
+		if status.Code(err) == codes.NotFound {
+			return new(dns.Msg).SetRcode(req, dns.RcodeNameError), nil
+		}
+		return nil, &upstreamError{addr: g.addr, err: err}
+	}
+
+	ret := new(dns.Msg)
+	if err := ret.Unpack(reply.Msg); err != nil {
+		return nil, &upstreamError{addr: g.addr, err: err}
+	}
+
+	return ret, nil
+}
+
+// ready reports whether the connection to the gRPC upstream is established,
+// and starts connecting if it is idle.
+func (g *grpcUpstream) ready() bool {
+	if g.conn.GetState() == connectivity.Ready {
+		return true
+	}
+	g.conn.Connect()
+	return false
+}
+
+// Close tears down the underlying gRPC connection.
+func (g *grpcUpstream) Close() error { return g.conn.Close() }
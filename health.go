@@ -0,0 +1,122 @@
+package finalize
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHealthWindow is the window the error rate of the lookups is
+	// computed over.
+	defaultHealthWindow = time.Minute
+	// healthSlots is the number of slots the window is split into, as it
+	// slides a slot at a time.
+	healthSlots = 6
+	// minHealthLookups is the number of lookups within the window below which
+	// the error rate does not make the plugin unhealthy.
+	minHealthLookups = 10
+)
+
+// lookupHealth counts the lookups of CNAME targets and their failures over a
+// sliding window, to report the health of the finalization path.
+type lookupHealth struct {
+	window time.Duration
+	// maxErrorRate is the error rate above which the plugin is unhealthy, 0
+	// means the error rate is only reported.
+	maxErrorRate float64
+	now          func() time.Time
+
+	mu    sync.Mutex
+	slots []*healthSlot
+}
+
+// healthSlot holds the counts of a slot of the window.
+type healthSlot struct {
+	start    time.Time
+	lookups  int
+	failures int
+}
+
+// healthStatus is the reply of the health endpoint.
+type healthStatus struct {
+	Healthy bool `json:"healthy"`
+	// Circuit is the state of the circuit breaker, empty if it is disabled.
+	Circuit   string  `json:"circuit,omitempty"`
+	Window    string  `json:"window"`
+	Lookups   int     `json:"lookups"`
+	Failures  int     `json:"failures"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+func newLookupHealth(window time.Duration, maxErrorRate float64) *lookupHealth {
+	return &lookupHealth{window: window, maxErrorRate: maxErrorRate, now: time.Now}
+}
+
+// add counts a lookup, which failed if failed is true.
+func (h *lookupHealth) add(failed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	start := now.Truncate(h.window / healthSlots)
+	if len(h.slots) == 0 || !h.slots[len(h.slots)-1].start.Equal(start) {
+		h.slots = slices.DeleteFunc(h.slots, func(s *healthSlot) bool { return now.Sub(s.start) >= h.window })
+		h.slots = append(h.slots, &healthSlot{start: start})
+	}
+	slot := h.slots[len(h.slots)-1]
+	slot.lookups++
+	if failed {
+		slot.failures++
+	}
+}
+
+// status returns the lookups and failures within the window. The status is
+// unhealthy if the error rate exceeds the maximum over at least
+// minHealthLookups lookups.
+func (h *lookupHealth) status() healthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	status := healthStatus{Healthy: true, Window: h.window.String()}
+	for _, s := range h.slots {
+		if now.Sub(s.start) >= h.window {
+			continue
+		}
+		status.Lookups += s.lookups
+		status.Failures += s.failures
+	}
+	if status.Lookups > 0 {
+		status.ErrorRate = float64(status.Failures) / float64(status.Lookups)
+	}
+	if h.maxErrorRate > 0 && status.Lookups >= minHealthLookups && status.ErrorRate > h.maxErrorRate {
+		status.Healthy = false
+	}
+	return status
+}
+
+// serveHealth reports the health of the finalization path on GET, with the
+// status 503 Service Unavailable while the circuit breaker is open or the
+// error rate of the lookups is too high.
+func (s *Finalize) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := s.health.status()
+	if s.breaker != nil {
+		status.Circuit = s.breaker.state()
+		if status.Circuit == circuitStateOpen {
+			status.Healthy = false
+		}
+	}
+	if !status.Healthy {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, status)
+}
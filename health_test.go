@@ -0,0 +1,80 @@
+package finalize
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLookupHealth(t *testing.T) {
+	now := time.Unix(0, 0)
+	h := newLookupHealth(time.Minute, 0.5)
+	h.now = func() time.Time { return now }
+
+	for i := 0; i < 9; i++ {
+		h.add(true)
+	}
+	if status := h.status(); !status.Healthy || status.Lookups != 9 || status.Failures != 9 {
+		t.Errorf("Expected healthy below %d lookups, got %+v", minHealthLookups, status)
+	}
+
+	now = now.Add(30 * time.Second)
+	h.add(false)
+	if status := h.status(); status.Healthy || status.ErrorRate != 0.9 {
+		t.Errorf("Expected unhealthy at an error rate of 0.9, got %+v", status)
+	}
+
+	// the slot of the failed lookups leaves the window
+	now = now.Add(40 * time.Second)
+	if status := h.status(); !status.Healthy || status.Lookups != 1 || status.Failures != 0 {
+		t.Errorf("Expected the failures to leave the window, got %+v", status)
+	}
+}
+
+func TestServeHealth(t *testing.T) {
+	now := time.Unix(1000, 0)
+	f := New()
+	f.health = newLookupHealth(time.Minute, 0)
+	f.breaker = newCircuitBreaker(1, 30*time.Second)
+	f.breaker.now = func() time.Time { return now }
+
+	tests := []struct {
+		failed  bool
+		code    int
+		circuit string
+	}{
+		{false, http.StatusOK, circuitStateClosed},
+		{true, http.StatusServiceUnavailable, circuitStateOpen},
+	}
+
+	for i, test := range tests {
+		if test.failed {
+			f.breaker.failure()
+		}
+		rec := httptest.NewRecorder()
+		f.serveHealth(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+		if rec.Code != test.code {
+			t.Errorf("Test %d: expected status %d, got %d", i, test.code, rec.Code)
+		}
+		var status healthStatus
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatalf("Test %d: expected a JSON reply, got %v", i, err)
+		}
+		if status.Circuit != test.circuit || status.Healthy != (test.code == http.StatusOK) {
+			t.Errorf("Test %d: expected circuit %s, got %+v", i, test.circuit, status)
+		}
+	}
+
+	now = now.Add(31 * time.Second)
+	if state := f.breaker.state(); state != circuitStateHalfOpen {
+		t.Errorf("Expected the circuit to be half open after the cooldown, got %s", state)
+	}
+
+	rec := httptest.NewRecorder()
+	f.serveHealth(rec, httptest.NewRequest(http.MethodPost, "/health", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected POST to be rejected, got %d", rec.Code)
+	}
+}
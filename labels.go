@@ -0,0 +1,88 @@
+package finalize
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultZoneLabelLimit is the number of distinct zones labeled in the
+	// request and outcome metrics by default.
+	defaultZoneLabelLimit = 100
+	// otherZone is the zone label of the questions in zones beyond the limit.
+	otherZone = "other"
+)
+
+// zoneLabels bounds the cardinality of the zone label: the first limit zones
+// seen are labeled as such, all others as otherZone.
+type zoneLabels struct {
+	limit int
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newZoneLabels(limit int) *zoneLabels {
+	return &zoneLabels{limit: limit, seen: make(map[string]struct{})}
+}
+
+// label returns the label of zone. With a limit of 0, the label is always
+// empty.
+func (z *zoneLabels) label(zone string) string {
+	if z.limit == 0 {
+		return ""
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if _, ok := z.seen[zone]; ok {
+		return zone
+	}
+	if len(z.seen) >= z.limit {
+		return otherZone
+	}
+	z.seen[zone] = struct{}{}
+	return zone
+}
+
+// zoneOf returns the zone of name, the longest matching zone if finalization
+// is limited to zones, the registrable domain otherwise.
+func (s *Finalize) zoneOf(name string) string {
+	if zone := s.zones.Matches(name); zone != "" {
+		return zone
+	}
+	return registrableDomain(name)
+}
+
+// clientProto returns the transport the request was received over: udp or
+// tcp for plain DNS, the transport of the server otherwise, e.g. tls, https
+// or grpc.
+func clientProto(ctx context.Context, w dns.ResponseWriter) string {
+	if trans, _, ok := strings.Cut(metrics.WithServer(ctx), "://"); ok && trans != transport.DNS {
+		return trans
+	}
+	state := request.Request{W: w}
+	return state.Proto()
+}
+
+// questionLabels returns the server, proto, type and zone labels for the
+// question of r, which must hold exactly one.
+func (s *Finalize) questionLabels(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) []string {
+	q := r.Question[0]
+	return []string{metrics.WithServer(ctx), clientProto(ctx, w), dns.Type(q.Qtype).String(), s.zoneLabels.label(s.zoneOf(q.Name))}
+}
+
+func (s *Finalize) recordRequest(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+	requestCount.WithLabelValues(s.questionLabels(ctx, w, r)...).Inc()
+}
+
+func (s *Finalize) recordOutcome(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, result string) {
+	outcomeCount.WithLabelValues(append(s.questionLabels(ctx, w, r), result)...).Inc()
+}
@@ -0,0 +1,69 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestZoneLabels(t *testing.T) {
+	z := newZoneLabels(2)
+	for i, test := range []struct {
+		zone string
+		want string
+	}{
+		{"example.com.", "example.com."},
+		{"example.net.", "example.net."},
+		{"example.org.", otherZone},
+		{"example.com.", "example.com."},
+	} {
+		if got := z.label(test.zone); got != test.want {
+			t.Errorf("Test %d: expected label %q for %s, got %q", i, test.want, test.zone, got)
+		}
+	}
+
+	if got := newZoneLabels(0).label("example.com."); got != "" {
+		t.Errorf("Expected an empty label without limit, got %q", got)
+	}
+}
+
+func TestZoneOf(t *testing.T) {
+	s := New()
+	if got := s.zoneOf("a.b.example.co.uk."); got != "example.co.uk." {
+		t.Errorf("Expected the registrable domain example.co.uk., got %s", got)
+	}
+
+	s.zones = plugin.Zones{"b.example.co.uk."}
+	if got := s.zoneOf("a.b.example.co.uk."); got != "b.example.co.uk." {
+		t.Errorf("Expected the configured zone b.example.co.uk., got %s", got)
+	}
+}
+
+func TestClientProto(t *testing.T) {
+	tests := []struct {
+		server string
+		w      dns.ResponseWriter
+		want   string
+	}{
+		{"", &plugintest.ResponseWriter{}, "udp"},
+		{"dns://.:53", &plugintest.ResponseWriter{}, "udp"},
+		{"dns://.:53", &plugintest.ResponseWriter{TCP: true}, "tcp"},
+		{"tls://.:853", &plugintest.ResponseWriter{TCP: true}, "tls"},
+		{"https://.:443", &plugintest.ResponseWriter{TCP: true}, "https"},
+		{"grpc://.:443", &plugintest.ResponseWriter{TCP: true}, "grpc"},
+	}
+
+	for i, test := range tests {
+		ctx := context.Background()
+		if test.server != "" {
+			ctx = context.WithValue(ctx, dnsserver.Key{}, &dnsserver.Server{Addr: test.server})
+		}
+		if got := clientProto(ctx, test.w); got != test.want {
+			t.Errorf("Test %d: expected %s, got %s", i, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package finalize
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The kinds of messages logged for chains that could not be finalized, whose
+// level can be configured.
+const (
+	eventDangling      = "dangling"
+	eventCircular      = "circular"
+	eventMaxLookup     = "max_lookup"
+	eventUpstreamError = "upstream_error"
+)
+
+// The levels messages can be logged at.
+const (
+	levelDebug   = "debug"
+	levelInfo    = "info"
+	levelWarning = "warning"
+	levelError   = "error"
+)
+
+// logLimitWindow is the window in which log_limit messages of each kind are
+// logged at most.
+const logLimitWindow = time.Minute
+
+// eventLog logs the messages of the kinds above at their configured level,
+// at most limit of each kind per window, if limit is greater than 0.
+type eventLog struct {
+	levels map[string]string
+	limit  int
+	now    func() time.Time
+
+	mu      sync.Mutex
+	windows map[string]*logWindow
+}
+
+// logWindow counts the messages of a kind logged and suppressed since start.
+type logWindow struct {
+	start      time.Time
+	logged     int
+	suppressed int
+}
+
+// newEventLog returns an event log with the default levels: dangling chains
+// are common in normal operation and logged at info level, the rest as errors.
+func newEventLog() *eventLog {
+	return &eventLog{
+		levels: map[string]string{
+			eventDangling:      levelInfo,
+			eventCircular:      levelError,
+			eventMaxLookup:     levelError,
+			eventUpstreamError: levelError,
+		},
+		now:     time.Now,
+		windows: make(map[string]*logWindow),
+	}
+}
+
+// logf logs a message of kind event, unless the limit of its kind is reached.
+func (l *eventLog) logf(event, format string, v ...any) {
+	ok, suppressed := l.allow(event)
+	if suppressed > 0 {
+		l.print(event, fmt.Sprintf("Suppressed %d %s messages in the last %v", suppressed, event, logLimitWindow))
+	}
+	if ok {
+		l.print(event, fmt.Sprintf(format, v...))
+	}
+}
+
+// allow reports whether a message of kind event may be logged, and returns
+// the number of messages suppressed in the window that just ended, if any.
+func (l *eventLog) allow(event string) (bool, int) {
+	if l.limit == 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	w, ok := l.windows[event]
+	suppressed := 0
+	if !ok || now.Sub(w.start) >= logLimitWindow {
+		if ok {
+			suppressed = w.suppressed
+		}
+		w = &logWindow{start: now}
+		l.windows[event] = w
+	}
+	if w.logged >= l.limit {
+		w.suppressed++
+		return false, suppressed
+	}
+	w.logged++
+	return true, suppressed
+}
+
+func (l *eventLog) print(event, msg string) {
+	switch l.levels[event] {
+	case levelDebug:
+		log.Debug(msg)
+	case levelInfo:
+		log.Info(msg)
+	case levelWarning:
+		log.Warning(msg)
+	default:
+		log.Error(msg)
+	}
+}
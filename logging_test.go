@@ -0,0 +1,42 @@
+package finalize
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventLogLimit(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newEventLog()
+	l.limit = 2
+	l.now = func() time.Time { return now }
+
+	for i, want := range []bool{true, true, false, false} {
+		if ok, _ := l.allow(eventDangling); ok != want {
+			t.Errorf("Message %d: expected allowed %t, got %t", i, want, ok)
+		}
+	}
+	if ok, _ := l.allow(eventCircular); !ok {
+		t.Error("Expected the limit to apply to each kind of message separately")
+	}
+
+	now = now.Add(logLimitWindow)
+	if ok, suppressed := l.allow(eventDangling); !ok || suppressed != 2 {
+		t.Errorf("Expected a new window reporting 2 suppressed messages, got %t and %d", ok, suppressed)
+	}
+	if _, suppressed := l.allow(eventDangling); suppressed != 0 {
+		t.Errorf("Expected the suppressed messages to be reported once, got %d", suppressed)
+	}
+}
+
+func TestEventLogUnlimited(t *testing.T) {
+	l := newEventLog()
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.allow(eventDangling); !ok {
+			t.Fatalf("Message %d: expected no limit", i)
+		}
+	}
+	if l.levels[eventDangling] != levelInfo {
+		t.Errorf("Expected dangling chains to be logged at info level, got %s", l.levels[eventDangling])
+	}
+}
@@ -0,0 +1,63 @@
+package finalize
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// loopOptionCode is the EDNS0 option code of the nonce carried by lookups to
+// detect them re-entering the server they were sent from, from the range
+// reserved for local use (RFC 6891).
+const loopOptionCode uint16 = 65501
+
+// errLoop is returned for lookups that were sent back to the server itself.
+var errLoop = errors.New("lookup loop detected")
+
+func newLoopNonce() []byte {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return b
+}
+
+// addLoopNonce adds nonce to m, a lookup sent to an external upstream. m
+// must have an OPT record.
+func addLoopNonce(m *dns.Msg, nonce []byte) {
+	o := m.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: loopOptionCode, Data: nonce})
+}
+
+// hasLoopNonce reports whether m carries nonce.
+func hasLoopNonce(m *dns.Msg, nonce []byte) bool {
+	o := m.IsEdns0()
+	if o == nil {
+		return false
+	}
+	for _, opt := range o.Option {
+		if local, ok := opt.(*dns.EDNS0_LOCAL); ok && local.Code == loopOptionCode && bytes.Equal(local.Data, nonce) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveLoop answers a lookup of this instance that re-entered the server with
+// SERVFAIL, echoing the nonce so that the instance waiting for the reply
+// fails fast instead of chasing the chain through the loop.
+func (s *Finalize) serveLoop(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	loopDetectedCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	s.recordOutcome(ctx, w, r, outcomeLoop)
+	log.Errorf("Lookup of %s re-entered this server: upstreams must not send lookups back to it", r.Question[0].Name)
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	state := request.Request{W: w, Req: r}
+	addEDE(m, state, dns.ExtendedErrorCodeOther, errLoop.Error())
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: loopOptionCode, Data: s.loopNonce})
+	return s.writeResponse(w, m)
+}
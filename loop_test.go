@@ -0,0 +1,72 @@
+package finalize
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// loopResolver sends lookups back to the server, as a misconfigured upstream
+// forwarding to it would.
+type loopResolver struct {
+	f       *Finalize
+	lookups int
+}
+
+func (r *loopResolver) Lookup(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+	r.lookups++
+	req := newLookupMsg(state, name, typ, nil)
+	addLoopNonce(req, r.f.loopNonce)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := r.f.ServeDNS(ctx, rec, req); err != nil {
+		return nil, err
+	}
+	return rec.Msg, nil
+}
+
+func TestServeDNSLoop(t *testing.T) {
+	f := New()
+	resolver := &loopResolver{f: f}
+	f.Resolver = resolver
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if resolver.lookups != 1 {
+		t.Errorf("Expected the loop to be detected at the first lookup, got %d lookups", resolver.lookups)
+	}
+	if len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected the original answer, got %v", rec.Msg.Answer)
+	}
+	if ede := edeOf(rec.Msg); ede == nil || !strings.Contains(ede.ExtraText, "loop") {
+		t.Errorf("Expected an EDE reporting the loop, got %v", ede)
+	}
+	if hasLoopNonce(rec.Msg, f.loopNonce) {
+		t.Errorf("Expected the nonce not to be sent to the client")
+	}
+}
+
+func TestNewLookupMsgLoopNonce(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	addLoopNonce(req, []byte("other"))
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: req}
+
+	m := newLookupMsg(state, "b.example.com.", dns.TypeA, []uint16{loopOptionCode})
+	addLoopNonce(m, []byte("nonce"))
+	if !hasLoopNonce(m, []byte("nonce")) || hasLoopNonce(m, []byte("other")) {
+		t.Errorf("Expected the nonce to replace the one of another instance, got %v", m)
+	}
+}
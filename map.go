@@ -0,0 +1,70 @@
+package finalize
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// targetRule rewrites the CNAME targets below suffix, or matching re, to to.
+type targetRule struct {
+	suffix string
+	re     *regexp.Regexp
+	to     string
+}
+
+// targetMap holds the rules rewriting CNAME targets before they are looked
+// up. The first matching rule applies.
+type targetMap []targetRule
+
+// newTargetRule returns a rule of kind suffix or regex rewriting from to to.
+// A regex rule may refer to the groups of from in to, e.g. as $1.
+func newTargetRule(kind, from, to string) (targetRule, error) {
+	switch kind {
+	case "suffix":
+		return targetRule{suffix: dns.CanonicalName(from), to: dns.CanonicalName(to)}, nil
+	case "regex":
+		re, err := regexp.Compile(from)
+		if err != nil {
+			return targetRule{}, err
+		}
+		return targetRule{re: re, to: to}, nil
+	}
+	return targetRule{}, fmt.Errorf("unknown map type '%s'", kind)
+}
+
+// rewrite returns the name to look up instead of name, or name itself if no
+// rule matches.
+func (m targetMap) rewrite(name string) string {
+	name = dns.CanonicalName(name)
+	for _, r := range m {
+		if r.re != nil {
+			match := r.re.FindStringSubmatchIndex(name)
+			if match == nil {
+				continue
+			}
+			return dns.Fqdn(string(r.re.ExpandString(nil, r.to, name, match)))
+		}
+		if dns.IsSubDomain(r.suffix, name) {
+			return strings.TrimSuffix(name, r.suffix) + r.to
+		}
+	}
+	return name
+}
+
+// renameOwner returns rrs with the records owned by from renamed to to, so
+// that the answer to a rewritten lookup continues the chain at to.
+func renameOwner(rrs []dns.RR, from, to string) []dns.RR {
+	renamed := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, from) {
+			renamed[i] = rr
+			continue
+		}
+		renamed[i] = dns.Copy(rr)
+		renamed[i].Header().Name = to
+	}
+	return renamed
+}
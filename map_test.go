@@ -0,0 +1,58 @@
+package finalize
+
+import (
+	"testing"
+
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestTargetMap(t *testing.T) {
+	suffix, err := newTargetRule("suffix", "External-CDN.com", "internal-cdn.corp.")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	regex, err := newTargetRule("regex", `^(.*)\.edge\.example\.net\.$`, "$1.origin.corp.")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	m := targetMap{suffix, regex}
+
+	tests := []struct {
+		name, want string
+	}{
+		{"b.external-cdn.com.", "b.internal-cdn.corp."},
+		{"B.External-CDN.com.", "b.internal-cdn.corp."},
+		{"b.notexternal-cdn.com.", "b.notexternal-cdn.com."},
+		{"www.edge.example.net.", "www.origin.corp."},
+		{"www.example.net.", "www.example.net."},
+	}
+
+	for i, tc := range tests {
+		if got := m.rewrite(tc.name); got != tc.want {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.want, got)
+		}
+	}
+
+	if _, err := newTargetRule("regex", "(", "x."); err == nil {
+		t.Errorf("Expected an error for an invalid regular expression")
+	}
+	if _, err := newTargetRule("exact", "a.", "b."); err == nil {
+		t.Errorf("Expected an error for an unknown map type")
+	}
+}
+
+func TestRenameOwner(t *testing.T) {
+	rrs := []dns.RR{
+		plugintest.CNAME("b.internal-cdn.corp. 300 IN CNAME c.internal-cdn.corp."),
+		plugintest.A("c.internal-cdn.corp. 300 IN A 192.0.2.1"),
+	}
+
+	renamed := renameOwner(rrs, "b.internal-cdn.corp.", "b.external-cdn.com.")
+	if renamed[0].Header().Name != "b.external-cdn.com." || renamed[1] != rrs[1] {
+		t.Errorf("Expected only the CNAME to be renamed, got %v", renamed)
+	}
+	if rrs[0].Header().Name != "b.internal-cdn.corp." {
+		t.Errorf("Expected the original records to be left unmodified, got %v", rrs[0])
+	}
+}
@@ -0,0 +1,38 @@
+package finalize
+
+import (
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// defaultMarkerCode is the EDNS0 option code of the marker stamped on
+// finalized responses, from the range reserved for local use (RFC 6891).
+const defaultMarkerCode uint16 = 65500
+
+// hasMarker reports whether m carries the marker with the given option code.
+func hasMarker(m *dns.Msg, code uint16) bool {
+	o := m.IsEdns0()
+	if o == nil {
+		return false
+	}
+	for _, opt := range o.Option {
+		if opt.Option() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// addMarker stamps m with the marker with the given option code, if the
+// client sent an OPT record.
+func addMarker(m *dns.Msg, state request.Request, code uint16) {
+	if state.Req.IsEdns0() == nil || hasMarker(m, code) {
+		return
+	}
+	o := m.IsEdns0()
+	if o == nil {
+		m.SetEdns0(uint16(state.Size()), state.Do())
+		o = m.IsEdns0()
+	}
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: code})
+}
@@ -0,0 +1,69 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSMarker(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.marker = defaultMarkerCode
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rec.Msg.Answer) != 2 || !hasMarker(rec.Msg, defaultMarkerCode) {
+		t.Fatalf("Expected a marked finalized answer, got %v", rec.Msg)
+	}
+
+	// a second instance gets a response marked by the first one
+	marked := rec.Msg.Copy()
+	marked.Answer = marked.Answer[:1]
+	resolver.lookups = nil
+	f.Next = plugintest.HandlerFunc(func(_ context.Context, w dns.ResponseWriter, _ *dns.Msg) (int, error) {
+		w.WriteMsg(marked)
+		return dns.RcodeSuccess, nil
+	})
+	rec = dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(resolver.lookups) != 0 || len(rec.Msg.Answer) != 1 {
+		t.Errorf("Expected the marked response to be passed through, got %v", rec.Msg)
+	}
+}
+
+func TestAddMarker(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: req}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	addMarker(m, state, defaultMarkerCode)
+	if m.IsEdns0() != nil {
+		t.Errorf("Expected no OPT record for a client without EDNS, got %v", m)
+	}
+
+	req.SetEdns0(4096, false)
+	addMarker(m, state, defaultMarkerCode)
+	addMarker(m, state, defaultMarkerCode)
+	if o := m.IsEdns0(); o == nil || len(o.Option) != 1 || !hasMarker(m, defaultMarkerCode) {
+		t.Errorf("Expected a single marker, got %v", m)
+	}
+}
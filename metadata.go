@@ -0,0 +1,44 @@
+package finalize
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// chainMetadataKey is the context key of the chainMetadata of a request.
+type chainMetadataKey struct{}
+
+// chainMetadata holds the chain of a finalized answer, as published through
+// the metadata plugin.
+type chainMetadata struct {
+	length    int
+	target    string
+	flattened bool
+}
+
+// Metadata implements the metadata.Provider interface. The values are only
+// known once the answer is finalized, until then they are their zero values.
+func (s *Finalize) Metadata(ctx context.Context, _ request.Request) context.Context {
+	m := new(chainMetadata)
+	metadata.SetValueFunc(ctx, pluginName+"/chain_length", func() string { return strconv.Itoa(m.length) })
+	metadata.SetValueFunc(ctx, pluginName+"/final_target", func() string { return m.target })
+	metadata.SetValueFunc(ctx, pluginName+"/flattened", func() string { return strconv.FormatBool(m.flattened) })
+	return context.WithValue(ctx, chainMetadataKey{}, m)
+}
+
+// publishChain records the chain of the finalized answer to qname for the
+// metadata plugin, if it is enabled. The answer is only reported as flattened
+// for the outcome of the same name, not for negative or stale answers.
+func publishChain(ctx context.Context, qname string, answer []dns.RR, outcome string) {
+	m, ok := ctx.Value(chainMetadataKey{}).(*chainMetadata)
+	if !ok {
+		return
+	}
+	m.length = countCNAMEs(answer)
+	m.target, _ = findLastTarget(answer, qname)
+	m.flattened = outcome == outcomeFlattened
+}
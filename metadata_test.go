@@ -0,0 +1,106 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestMetadata(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com.")},
+		"c.example.com.": {plugintest.A("c.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	tests := []struct {
+		answer []dns.RR
+		want   map[string]string
+	}{
+		{
+			answer: []dns.RR{plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com.")},
+			want: map[string]string{
+				"finalize_cname/chain_length": "2",
+				"finalize_cname/final_target": "c.example.com.",
+				"finalize_cname/flattened":    "true",
+			},
+		},
+		{
+			answer: []dns.RR{plugintest.A("a.example.com. 300 IN A 192.0.2.2")},
+			want: map[string]string{
+				"finalize_cname/chain_length": "0",
+				"finalize_cname/final_target": "",
+				"finalize_cname/flattened":    "false",
+			},
+		},
+	}
+
+	for i, tc := range tests {
+		f := New()
+		f.Resolver = resolver
+		f.Next = cnameHandler(tc.answer...)
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		w := &plugintest.ResponseWriter{}
+		ctx := f.Metadata(metadata.ContextWithMetadata(context.Background()), request.Request{W: w, Req: req})
+		if _, err := f.ServeDNS(ctx, dnstest.NewRecorder(w), req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		for label, want := range tc.want {
+			if got := metadata.ValueFunc(ctx, label)(); got != want {
+				t.Errorf("Test %d: expected %s to be %q, got %q", i, label, want, got)
+			}
+		}
+	}
+}
+
+func TestMetadataNotFlattened(t *testing.T) {
+	serve := func(f *Finalize) context.Context {
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		w := &plugintest.ResponseWriter{}
+		ctx := f.Metadata(metadata.ContextWithMetadata(context.Background()), request.Request{W: w, Req: req})
+		if _, err := f.ServeDNS(ctx, dnstest.NewRecorder(w), req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return ctx
+	}
+
+	// a negative answer
+	f := New()
+	f.Resolver = &stubResolver{
+		answers: map[string][]dns.RR{"b.example.com.": {}},
+		rcodes:  map[string]int{"b.example.com.": dns.RcodeNameError},
+	}
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+	if got := metadata.ValueFunc(serve(f), "finalize_cname/flattened")(); got != "false" {
+		t.Errorf("Expected a negative answer not to be flattened, got %q", got)
+	}
+
+	// a stale answer
+	now := time.Unix(1000, 0)
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 60 IN A 192.0.2.1")},
+	}}
+	f = New()
+	f.Resolver = resolver
+	f.cache = newChainCache(10, time.Minute)
+	f.cache.staleFor = time.Hour
+	f.cache.now = func() time.Time { return now }
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+	if got := metadata.ValueFunc(serve(f), "finalize_cname/flattened")(); got != "true" {
+		t.Fatalf("Expected a fresh answer to be flattened, got %q", got)
+	}
+	now = now.Add(2 * time.Minute)
+	resolver.answers = nil
+	if got := metadata.ValueFunc(serve(f), "finalize_cname/flattened")(); got != "false" {
+		t.Errorf("Expected a stale answer not to be flattened, got %q", got)
+	}
+}
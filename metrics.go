@@ -15,7 +15,7 @@ var requestCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Subsystem: pluginName,
 	Name:      "request_count_total",
 	Help:      "Counter of requests processed.",
-}, []string{"server"})
+}, []string{"server", "proto", "type", "zone"})
 
 var circularReferenceCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Namespace: plugin.Namespace,
@@ -31,6 +31,41 @@ var danglingCNameCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help:      "Counter of CNAMES that couldn't be resolved.",
 }, []string{"server"})
 
+var malformedResponseCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "malformed_response_count_total",
+	Help:      "Counter of responses passed through unfinalized and lookup replies rejected because they did not hold exactly one question.",
+}, []string{"server"})
+
+var loopDetectedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "loop_detected_count_total",
+	Help:      "Counter of lookups that were sent back to the server they came from.",
+}, []string{"server"})
+
+var blockedChainCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "blocked_chain_count_total",
+	Help:      "Counter of chains not finalized because they led to a target or an address that is not allowed.",
+}, []string{"server"})
+
+var privateAddressCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "private_address_count_total",
+	Help:      "Counter of addresses dropped from finalized answers because they pointed into blocked networks.",
+}, []string{"server"})
+
+var invalidRecordCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "invalid_record_count_total",
+	Help:      "Counter of records dropped from lookup answers because they did not match the looked up name and type.",
+}, []string{"server"})
+
 var maxLookupReachedCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Namespace: plugin.Namespace,
 	Subsystem: pluginName,
@@ -38,13 +73,244 @@ var maxLookupReachedCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Help:      "Counter of incidents when the maximum lookup depth was reached while trying to resolve a CNAME.",
 }, []string{"server"})
 
+var maxZonesReachedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "max_zones_reached_count_total",
+	Help:      "Counter of chains not finalized because they crossed more registrable domains than allowed.",
+}, []string{"server"})
+
+var budgetExceededCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "budget_exceeded_count_total",
+	Help:      "Counter of requests passed through unfinalized because the client exceeded its lookup budget.",
+}, []string{"server"})
+
 var upstreamErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
 	Namespace: plugin.Namespace,
 	Subsystem: pluginName,
 	Name:      "upstream_error_count_total",
 	Help:      "Counter of upstream errors received.",
+}, []string{"server", "to"})
+
+var lookupTimeoutCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "lookup_timeout_count_total",
+	Help:      "Counter of lookups that did not complete within the lookup timeout.",
+}, []string{"server"})
+
+var deadlineExceededCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "deadline_exceeded_count_total",
+	Help:      "Counter of requests for which resolving the CNAME chain exceeded the deadline.",
+}, []string{"server"})
+
+var canceledCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "canceled_count_total",
+	Help:      "Counter of requests for which resolving the CNAME chain was abandoned because the context was canceled.",
+}, []string{"server"})
+
+var circuitOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "circuit_open",
+	Help:      "Whether the circuit breaker is open (1) or closed (0).",
+}, []string{"server"})
+
+var inflightChains = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "inflight_chains",
+	Help:      "Number of chains being resolved.",
+}, []string{"server"})
+
+var inflightLookups = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "inflight_lookups",
+	Help:      "Number of lookups waiting for the resolver.",
+}, []string{"server"})
+
+var circuitOpenCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "circuit_open_count_total",
+	Help:      "Counter of times the circuit breaker opened.",
+}, []string{"server"})
+
+var circuitSkippedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "circuit_skipped_count_total",
+	Help:      "Counter of requests passed through unfinalized because the circuit breaker was open.",
+}, []string{"server"})
+
+var maxConcurrentRejectedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "max_concurrent_rejected_count_total",
+	Help:      "Counter of requests passed through unfinalized because the maximum number of concurrent finalizations was reached.",
+}, []string{"server"})
+
+var throttledCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "throttled_count_total",
+	Help:      "Counter of requests passed through unfinalized because the lookup rate limit was reached.",
+}, []string{"server"})
+
+var stabilizedAnswerCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "stabilized_answer_count_total",
+	Help:      "Counter of answers in which previously served records were kept because of the stability window.",
+}, []string{"server"})
+
+var cacheHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "cache_hits_total",
+	Help:      "Counter of chains served from the cache.",
+}, []string{"server"})
+
+var cacheMissCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "cache_misses_total",
+	Help:      "Counter of chains not found in the cache.",
+}, []string{"server"})
+
+var cacheEvictionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "cache_evictions_total",
+	Help:      "Counter of cached chains evicted to make room for new ones.",
+}, []string{"server"})
+
+var cacheEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "cache_entries",
+	Help:      "Number of chains in the cache.",
+}, []string{"server"})
+
+var hopCacheHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "hop_cache_hits_total",
+	Help:      "Counter of lookups of a chain served from the hop cache.",
 }, []string{"server"})
 
+var sharedCacheHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "shared_cache_hits_total",
+	Help:      "Counter of chains served from the shared cache.",
+}, []string{"server"})
+
+var sharedCacheMissCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "shared_cache_misses_total",
+	Help:      "Counter of chains not found in the shared cache.",
+}, []string{"server"})
+
+var sharedCacheErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "shared_cache_errors_total",
+	Help:      "Counter of failed operations on the shared cache.",
+}, []string{"server"})
+
+var prefetchCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "prefetch_count_total",
+	Help:      "Counter of cached chains refreshed in the background.",
+}, []string{"server"})
+
+var staleAnswerCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "stale_answer_count_total",
+	Help:      "Counter of answers finalized with expired cached records because resolving the chain failed.",
+}, []string{"server"})
+
+var oversizedResponseCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "oversized_response_count_total",
+	Help:      "Counter of finalized answers exceeding the buffer size of the client even when compressed, by how they were made to fit.",
+}, []string{"server", "action"})
+
+var compressionSavedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "compression_saved_bytes_total",
+	Help:      "Counter of bytes saved by compressing finalized answers exceeding the buffer size of the client.",
+}, []string{"server"})
+
+var negativeCacheHitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "negative_cache_hits_total",
+	Help:      "Counter of lookups skipped because the target was known to have no answer.",
+}, []string{"server"})
+
+var upstreamRequestCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "upstream_request_count_total",
+	Help:      "Counter of lookups sent to each upstream server.",
+}, []string{"server", "to"})
+
+var truncatedRetryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "truncated_retry_count_total",
+	Help:      "Counter of lookups retried over TCP because the UDP reply was truncated.",
+}, []string{"server", "to"})
+
+var cookieMismatchCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "cookie_mismatch_count_total",
+	Help:      "Counter of replies rejected because they did not carry the client cookie.",
+}, []string{"server", "to"})
+
+var caseMismatchCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "case_mismatch_count_total",
+	Help:      "Counter of replies rejected because their question did not match the randomized query name.",
+}, []string{"server", "to"})
+
+var healthcheckFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "healthcheck_failure_count_total",
+	Help:      "Counter of failed health checks of upstream servers.",
+}, []string{"to"})
+
+var validationFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "validation_failures_total",
+	Help:      "Counter of requests failed because a lookup of the chain was not validated.",
+}, []string{"server"})
+
+var outcomeCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "outcomes_total",
+	Help:      "Counter of requests processed by their outcome.",
+}, []string{"server", "proto", "type", "zone", "result"})
+
 var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	Namespace: plugin.Namespace,
 	Subsystem: pluginName,
@@ -53,4 +319,36 @@ var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	Help:      "Histogram of the time each request took.",
 }, []string{"server"})
 
+var nextDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "next_duration_seconds",
+	Buckets:   plugin.TimeBuckets,
+	Help:      "Histogram of the time the next plugins took to answer each request.",
+}, []string{"server"})
+
+var lookupDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "lookup_duration_seconds",
+	Buckets:   plugin.TimeBuckets,
+	Help:      "Histogram of the time each lookup of a CNAME target took.",
+}, []string{"server", "to"})
+
+var lookupsPerRequest = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "lookups_per_request",
+	Buckets:   []float64{0, 1, 2, 3, 4, 5, 6, 8, 10, 15, 20},
+	Help:      "Histogram of the number of lookups made for each request.",
+}, []string{"server"})
+
+var chainDepth = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: pluginName,
+	Name:      "chain_depth",
+	Buckets:   []float64{1, 2, 3, 4, 5, 6, 8, 10, 15, 20},
+	Help:      "Histogram of the number of CNAMEs in the chain of each finalized answer.",
+}, []string{"server"})
+
 var _ sync.Once
@@ -0,0 +1,81 @@
+package finalize
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxNegativeEntries is the number of entries after which expired entries are swept.
+const maxNegativeEntries = 10000
+
+// negativeCache remembers CNAME targets for which a lookup returned no
+// answer, so that they are not looked up again until ttl has passed.
+type negativeCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]*negativeEntry
+}
+
+type negativeEntry struct {
+	reply   *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[cacheKey]*negativeEntry),
+	}
+}
+
+// get returns the reply without answer to the lookup of key, if known, with
+// the TTLs of its authority records decreased by the time passed.
+func (c *negativeCache) get(key cacheKey) (*dns.Msg, bool) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	elapsed := uint32(now.Sub(e.stored).Seconds())
+	reply := e.reply.Copy()
+	for _, rr := range reply.Ns {
+		rr.Header().Ttl -= min(rr.Header().Ttl, elapsed)
+	}
+	return reply, true
+}
+
+// add remembers that the lookup of key returned reply without answer.
+func (c *negativeCache) add(key cacheKey, reply *dns.Msg) {
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxNegativeEntries {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = &negativeEntry{
+		reply:   reply.Copy(),
+		stored:  now,
+		expires: now.Add(c.ttl),
+	}
+}
@@ -0,0 +1,46 @@
+package finalize
+
+import (
+	"testing"
+	"time"
+
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestNegativeCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newNegativeCache(10 * time.Second)
+	c.now = func() time.Time { return now }
+
+	key := cacheKey{name: "b.example.com.", qtype: dns.TypeA}
+	if _, ok := c.get(key); ok {
+		t.Fatalf("Expected empty cache")
+	}
+
+	reply := new(dns.Msg)
+	reply.SetQuestion("b.example.com.", dns.TypeA)
+	reply.Rcode = dns.RcodeNameError
+	reply.Ns = []dns.RR{plugintest.SOA("example.com. 60 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 60")}
+	c.add(key, reply)
+
+	now = now.Add(5 * time.Second)
+	cached, ok := c.get(key)
+	if !ok {
+		t.Fatalf("Expected key to be cached")
+	}
+	if cached.Rcode != dns.RcodeNameError || cached.Ns[0].Header().Ttl != 55 {
+		t.Errorf("Expected the reply with the SOA TTL decreased to 55, got %v", cached)
+	}
+	if reply.Ns[0].Header().Ttl != 60 {
+		t.Errorf("Expected the original reply to be left unmodified, got %v", reply)
+	}
+	if _, ok := c.get(cacheKey{name: "b.example.com.", qtype: dns.TypeAAAA}); ok {
+		t.Errorf("Expected other question types not to be cached")
+	}
+
+	now = now.Add(5 * time.Second)
+	if _, ok := c.get(key); ok {
+		t.Errorf("Expected key to expire")
+	}
+}
@@ -0,0 +1,45 @@
+package finalize
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// networks is a list of IP networks.
+type networks []*net.IPNet
+
+// parseNetworks parses the networks given as CIDR, or as single addresses.
+func parseNetworks(args []string) (networks, error) {
+	var nets networks
+	for _, arg := range args {
+		if !strings.Contains(arg, "/") {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%s'", arg)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network '%s'", arg)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// contains reports whether ip is in any of the networks.
+func (n networks) contains(ip net.IP) bool {
+	for _, ipnet := range n {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package finalize
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := parseNetworks([]string{"10.9.0.0/16", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.9.1.2", true},
+		{"10.10.1.2", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for i, tc := range tests {
+		if got := nets.contains(net.ParseIP(tc.ip)); got != tc.want {
+			t.Errorf("Test %d: expected %v for %s, got %v", i, tc.want, tc.ip, got)
+		}
+	}
+
+	for _, arg := range []string{"10.9.0.0/33", "example.com"} {
+		if _, err := parseNetworks([]string{arg}); err == nil {
+			t.Errorf("Expected an error for %q", arg)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package finalize
+
+import "errors"
+
+// The results of the outcome counter, one per request reaching the plugin
+// that is not passed on untouched.
+const (
+	outcomeFlattened    = "flattened"
+	outcomeSkippedCNAME = "skipped_cname_qtype"
+	outcomeNoAnswer     = "skipped_no_answer"
+	outcomeAlreadyFinal = "already_final"
+	outcomeLoop         = "loop"
+	outcomeMaxDepth     = "max_depth"
+	outcomeDangling     = "dangling"
+	outcomeUpstream     = "upstream_error"
+	outcomeDeadline     = "deadline"
+	outcomeBlocked      = "blocked"
+	outcomeFailed       = "failed"
+)
+
+// outcomeFor returns the outcome of a request whose chain could not be
+// resolved because of err.
+func outcomeFor(err error) string {
+	switch {
+	case errors.Is(err, errCircular), errors.Is(err, errLoop):
+		return outcomeLoop
+	case errors.Is(err, errMaxLookup):
+		return outcomeMaxDepth
+	case errors.Is(err, errDangling), errors.Is(err, errNXDomain):
+		return outcomeDangling
+	case errors.Is(err, errDeadline):
+		return outcomeDeadline
+	case errors.Is(err, errLookup):
+		return outcomeUpstream
+	case errors.Is(err, errDenied), errors.Is(err, errAddressDenied):
+		return outcomeBlocked
+	}
+	return outcomeFailed
+}
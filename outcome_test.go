@@ -0,0 +1,32 @@
+package finalize
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestOutcomeFor(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("%w: a.example.", errCircular), outcomeLoop},
+		{errLoop, outcomeLoop},
+		{errMaxLookup, outcomeMaxDepth},
+		{fmt.Errorf("%w: a.example.", errDangling), outcomeDangling},
+		{errNXDomain, outcomeDangling},
+		{fmt.Errorf("%w: %w", errLookup, errDeadline), outcomeDeadline},
+		{fmt.Errorf("%w: timeout", errLookup), outcomeUpstream},
+		{&rpzError{name: "a.example.", action: rpzNXDomain}, outcomeBlocked},
+		{errAddressDenied, outcomeBlocked},
+		{errBogus, outcomeFailed},
+		{errors.New("other"), outcomeFailed},
+	}
+
+	for i, test := range tests {
+		if got := outcomeFor(test.err); got != test.want {
+			t.Errorf("Test %d: expected %s for %v, got %s", i, test.want, test.err, got)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package finalize
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/rand"
+)
+
+// policy defines how the servers of a dnsUpstream are ordered for a lookup.
+type policy interface {
+	List([]*upstreamHost) []*upstreamHost
+	String() string
+}
+
+// newPolicy returns a new instance of the policy called name.
+func newPolicy(name string) (policy, error) {
+	switch name {
+	case "random":
+		return &random{}, nil
+	case "round_robin":
+		return &roundRobin{}, nil
+	case "sequential":
+		return &sequential{}, nil
+	}
+	return nil, fmt.Errorf("unknown policy '%s'", name)
+}
+
+// random is a policy that implements random upstream selection.
+type random struct{}
+
+func (r *random) String() string { return "random" }
+
+func (r *random) List(h []*upstreamHost) []*upstreamHost {
+	switch len(h) {
+	case 1:
+		return h
+	case 2:
+		if rn.Int()%2 == 0 {
+			return []*upstreamHost{h[1], h[0]} // swap
+		}
+		return h
+	}
+
+	perms := rn.Perm(len(h))
+	rnd := make([]*upstreamHost, len(h))
+
+	for i, p := range perms {
+		rnd[i] = h[p]
+	}
+	return rnd
+}
+
+// roundRobin is a policy that selects hosts based on round robin ordering.
+type roundRobin struct {
+	robin uint32
+}
+
+func (r *roundRobin) String() string { return "round_robin" }
+
+func (r *roundRobin) List(h []*upstreamHost) []*upstreamHost {
+	poolLen := uint32(len(h))
+	i := atomic.AddUint32(&r.robin, 1) % poolLen
+
+	robin := []*upstreamHost{h[i]}
+	robin = append(robin, h[:i]...)
+	robin = append(robin, h[i+1:]...)
+
+	return robin
+}
+
+// sequential is a policy that selects hosts based on sequential ordering.
+type sequential struct{}
+
+func (r *sequential) String() string { return "sequential" }
+
+func (r *sequential) List(h []*upstreamHost) []*upstreamHost {
+	return h
+}
+
+var rn = rand.New(time.Now().UnixNano())
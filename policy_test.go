@@ -0,0 +1,37 @@
+package finalize
+
+import "testing"
+
+func TestPolicies(t *testing.T) {
+	hosts := []*upstreamHost{{addr: "a"}, {addr: "b"}, {addr: "c"}}
+
+	seq := (&sequential{}).List(hosts)
+	if seq[0].addr != "a" || seq[1].addr != "b" || seq[2].addr != "c" {
+		t.Errorf("Expected sequential order, got %v", seq)
+	}
+
+	rr := &roundRobin{}
+	first := rr.List(hosts)[0].addr
+	second := rr.List(hosts)[0].addr
+	if first == second {
+		t.Errorf("Expected round robin to start with a different host, got %s twice", first)
+	}
+	if len(rr.List(hosts)) != len(hosts) {
+		t.Errorf("Expected round robin to return all hosts")
+	}
+
+	rnd := (&random{}).List(hosts)
+	if len(rnd) != len(hosts) {
+		t.Errorf("Expected random to return all hosts, got %v", rnd)
+	}
+
+	for _, name := range []string{"random", "round_robin", "sequential"} {
+		p, err := newPolicy(name)
+		if err != nil || p.String() != name {
+			t.Errorf("Expected policy %s, got %v (%v)", name, p, err)
+		}
+	}
+	if _, err := newPolicy("fastest"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+}
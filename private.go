@@ -0,0 +1,117 @@
+package finalize
+
+import (
+	"context"
+	"net"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/miekg/dns"
+)
+
+// privateNetworks are the networks blocked by block_private by default: the
+// private (RFC 1918, RFC 4193), shared (RFC 6598), "this network", loopback,
+// link-local and unspecified networks.
+var privateNetworks, _ = parseNetworks([]string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+})
+
+// dropPrivate removes the A and AAAA records of rrs pointing into the blocked
+// networks, along with their signatures, if the CNAME chain of rrs leaves the
+// configured zones. With no zones configured, every chain does.
+func (s *Finalize) dropPrivate(ctx context.Context, rrs []dns.RR) []dns.RR {
+	if !s.leavesZones(rrs) {
+		return rrs
+	}
+	return s.dropBlocked(ctx, rrs)
+}
+
+// dropPrivateAdditional removes the A and AAAA records of the additional
+// section of m pointing into the blocked networks, along with their
+// signatures, if the SRV or MX targets of the answer or the CNAME chains
+// followed for them leave the configured zones.
+func (s *Finalize) dropPrivateAdditional(ctx context.Context, m *dns.Msg) {
+	if !s.leavesZones(m.Extra) && !s.targetsLeaveZones(m.Answer) {
+		return
+	}
+	m.Extra = s.dropBlocked(ctx, m.Extra)
+}
+
+// dropBlocked removes the A and AAAA records of rrs pointing into the blocked
+// networks, along with their signatures. IPv4-mapped IPv6 addresses are
+// matched as the IPv4 addresses they map.
+func (s *Finalize) dropBlocked(ctx context.Context, rrs []dns.RR) []dns.RR {
+	type rrset struct {
+		name  string
+		qtype uint16
+	}
+	dropped := make(map[rrset]struct{})
+	kept := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if ip != nil && s.blockedNetworks.contains(ip) {
+			dropped[rrset{dns.CanonicalName(rr.Header().Name), rr.Header().Rrtype}] = struct{}{}
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	if len(dropped) == 0 {
+		return rrs
+	}
+	privateAddressCount.WithLabelValues(metrics.WithServer(ctx)).Add(float64(len(rrs) - len(kept)))
+	log.Warningf("Dropped addresses in blocked networks from records leaving the configured zones: %v", rrs)
+
+	// the signatures of the RRsets records were removed from no longer match
+	rrs = kept
+	kept = make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if _, ok := dropped[rrset{dns.CanonicalName(sig.Hdr.Name), sig.TypeCovered}]; ok {
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+// leavesZones reports whether the target of a CNAME of rrs is outside the
+// configured zones.
+func (s *Finalize) leavesZones(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok && (len(s.zones) == 0 || s.zones.Matches(cname.Target) == "") {
+			return true
+		}
+	}
+	return false
+}
+
+// targetsLeaveZones reports whether an SRV or MX target of rrs whose
+// addresses are added to the additional section is outside the configured
+// zones.
+func (s *Finalize) targetsLeaveZones(rrs []dns.RR) bool {
+	for _, target := range s.additionalTargets(rrs) {
+		if len(s.zones) == 0 || s.zones.Matches(target) == "" {
+			return true
+		}
+	}
+	return false
+}
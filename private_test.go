@@ -0,0 +1,76 @@
+package finalize
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestDropPrivate(t *testing.T) {
+	rrs := []dns.RR{
+		plugintest.CNAME("a.example.com. 300 IN CNAME b.attacker.net."),
+		plugintest.A("b.attacker.net. 300 IN A 192.168.1.1"),
+		plugintest.RRSIG("b.attacker.net. 300 IN RRSIG A 8 3 300 20300101000000 20200101000000 12345 attacker.net. c2lnbmF0dXJl"),
+		plugintest.A("b.attacker.net. 300 IN A 192.0.2.1"),
+		plugintest.AAAA("b.attacker.net. 300 IN AAAA fe80::1"),
+	}
+
+	f := New()
+	f.blockedNetworks = privateNetworks
+	got := f.dropPrivate(context.Background(), rrs)
+	if len(got) != 2 || got[0] != rrs[0] || got[1] != rrs[3] {
+		t.Errorf("Expected the CNAME and the public address, got %v", got)
+	}
+
+	// the chain stays within the zones of the plugin
+	f.zones = plugin.Zones{"example.com.", "attacker.net."}
+	if got := f.dropPrivate(context.Background(), rrs); len(got) != len(rrs) {
+		t.Errorf("Expected the answer to be left as is, got %v", got)
+	}
+}
+
+func TestDropPrivateRanges(t *testing.T) {
+	f := New()
+	f.blockedNetworks = privateNetworks
+
+	for _, addr := range []string{"0.0.0.0", "100.64.0.1", "::", "::ffff:10.0.0.1", "::ffff:127.0.0.1"} {
+		rrs := []dns.RR{plugintest.CNAME("a.example.com. 300 IN CNAME b.attacker.net.")}
+		if strings.Contains(addr, ":") {
+			rrs = append(rrs, plugintest.AAAA("b.attacker.net. 300 IN AAAA "+addr))
+		} else {
+			rrs = append(rrs, plugintest.A("b.attacker.net. 300 IN A "+addr))
+		}
+		if got := f.dropPrivate(context.Background(), rrs); len(got) != 1 {
+			t.Errorf("Expected %s to be dropped, got %v", addr, got)
+		}
+	}
+}
+
+func TestServeDNSDropPrivateAdditional(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"mail.attacker.net.": {plugintest.A("mail.attacker.net. 300 IN A 192.168.1.1")},
+	}}
+	f := New()
+	f.Resolver = resolver
+	f.blockedNetworks = privateNetworks
+	f.mxAdditional = true
+	f.Next = cnameHandler(plugintest.MX("example.com. 300 IN MX 10 mail.attacker.net."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeMX)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(resolver.lookups) == 0 {
+		t.Fatal("Expected the target to be looked up")
+	}
+	if len(rec.Msg.Extra) != 0 {
+		t.Errorf("Expected the private address of the target to be dropped, got %v", rec.Msg.Extra)
+	}
+}
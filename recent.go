@@ -0,0 +1,140 @@
+package finalize
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lookupTraceKey is the context key of the lookupTrace of a request.
+type lookupTraceKey struct{}
+
+// lookupTrace records the lookups made for a request: their number, and with
+// detailed set, the name, duration and outcome of each.
+type lookupTrace struct {
+	detailed bool
+
+	mu   sync.Mutex
+	n    int64
+	hops []recentHop
+}
+
+// withLookupTrace returns a context recording the lookups made with it.
+func withLookupTrace(ctx context.Context, detailed bool) (context.Context, *lookupTrace) {
+	t := &lookupTrace{detailed: detailed}
+	return context.WithValue(ctx, lookupTraceKey{}, t), t
+}
+
+// start counts a lookup when it is sent.
+func (t *lookupTrace) start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n++
+}
+
+// done records the lookup of name once it returns, if detailed.
+func (t *lookupTrace) done(name string, d time.Duration, outcome string) {
+	if !t.detailed {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hops = append(t.hops, recentHop{Name: name, Duration: d.String(), Outcome: outcome})
+}
+
+// count returns the number of lookups sent.
+func (t *lookupTrace) count() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.n
+}
+
+// recorded returns a copy of the lookups recorded so far.
+func (t *lookupTrace) recorded() []recentHop {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]recentHop(nil), t.hops...)
+}
+
+// formatHops formats the lookups of a chain for the log, e.g.
+// "b.example.com. 1.2ms NOERROR -> c.example.net. 480ms SERVFAIL".
+func formatHops(hops []recentHop) string {
+	if len(hops) == 0 {
+		return "no lookups"
+	}
+	parts := make([]string, len(hops))
+	for i, h := range hops {
+		parts[i] = h.Name + " " + h.Duration + " " + h.Outcome
+	}
+	return strings.Join(parts, " -> ")
+}
+
+// recentChain is a finalized request as listed by the chains endpoint.
+type recentChain struct {
+	Time     time.Time   `json:"time"`
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Client   string      `json:"client"`
+	Hops     []recentHop `json:"hops"`
+	Duration string      `json:"duration"`
+	Outcome  string      `json:"outcome"`
+}
+
+// recentHop is a lookup of a recentChain.
+type recentHop struct {
+	Name     string `json:"name"`
+	Duration string `json:"duration"`
+	Outcome  string `json:"outcome"`
+}
+
+// recentChains is a ring buffer of the last finalized requests.
+type recentChains struct {
+	mu      sync.Mutex
+	entries []recentChain
+	next    int
+	full    bool
+}
+
+func newRecentChains(size int) *recentChains {
+	return &recentChains{entries: make([]recentChain, size)}
+}
+
+// add records c, replacing the oldest entry if the buffer is full.
+func (r *recentChains) add(c recentChain) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries[r.next] = c
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the recorded entries, the most recent first.
+func (r *recentChains) list() []recentChain {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	list := make([]recentChain, 0, n)
+	for i := 1; i <= n; i++ {
+		list = append(list, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return list
+}
+
+// serveChains lists the last finalized requests on GET.
+func (s *Finalize) serveChains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.recent.list())
+}
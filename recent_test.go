@@ -0,0 +1,131 @@
+package finalize
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	golog "log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestRecentChains(t *testing.T) {
+	r := newRecentChains(2)
+	if list := r.list(); len(list) != 0 {
+		t.Errorf("Expected no entries, got %v", list)
+	}
+
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		r.add(recentChain{Name: name})
+	}
+	list := r.list()
+	if len(list) != 2 || list[0].Name != "c.example.com." || list[1].Name != "b.example.com." {
+		t.Errorf("Expected the last 2 entries, most recent first, got %v", list)
+	}
+}
+
+func TestServeChains(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.recent = newRecentChains(10)
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	if _, err := f.ServeDNS(context.Background(), dnstest.NewRecorder(&plugintest.ResponseWriter{}), req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	f.serveChains(rec, httptest.NewRequest(http.MethodGet, "/chains", nil))
+	var chains []recentChain
+	if err := json.NewDecoder(rec.Body).Decode(&chains); err != nil {
+		t.Fatalf("Expected a JSON list, got %v", err)
+	}
+	if len(chains) != 1 {
+		t.Fatalf("Expected 1 chain, got %v", chains)
+	}
+	c := chains[0]
+	if c.Name != "a.example.com." || c.Client != "10.240.0.1" || c.Outcome != outcomeFlattened {
+		t.Errorf("Expected the finalized request, got %+v", c)
+	}
+	if len(c.Hops) != 1 || c.Hops[0].Name != "b.example.com." || c.Hops[0].Outcome != "NOERROR" {
+		t.Errorf("Expected the lookup of b.example.com., got %v", c.Hops)
+	}
+
+	rec = httptest.NewRecorder()
+	f.serveChains(rec, httptest.NewRequest(http.MethodDelete, "/chains", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestFormatHops(t *testing.T) {
+	tests := []struct {
+		hops []recentHop
+		want string
+	}{
+		{nil, "no lookups"},
+		{[]recentHop{{Name: "b.example.com.", Duration: "1ms", Outcome: "NOERROR"}}, "b.example.com. 1ms NOERROR"},
+		{
+			[]recentHop{{Name: "b.example.com.", Duration: "1ms", Outcome: "NOERROR"}, {Name: "c.example.net.", Duration: "2s", Outcome: "error"}},
+			"b.example.com. 1ms NOERROR -> c.example.net. 2s error",
+		},
+	}
+
+	for i, test := range tests {
+		if got := formatHops(test.hops); got != test.want {
+			t.Errorf("Test %d: expected %s, got %s", i, test.want, got)
+		}
+	}
+}
+
+func TestServeDNSSlowChain(t *testing.T) {
+	var buf bytes.Buffer
+	golog.SetOutput(&buf)
+	defer golog.SetOutput(os.Stderr)
+
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	for _, threshold := range []time.Duration{time.Nanosecond, time.Hour} {
+		f.slowChain = threshold
+		buf.Reset()
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		logged := buf.String()
+		if threshold == time.Hour {
+			if logged != "" {
+				t.Errorf("Expected no warning below the threshold, got %q", logged)
+			}
+			continue
+		}
+		if !strings.Contains(logged, "[WARNING]") || !strings.Contains(logged, "Finalizing a.example.com.") ||
+			!strings.Contains(logged, "with outcome flattened: b.example.com. ") || !strings.Contains(logged, " NOERROR") {
+			t.Errorf("Expected a warning with the lookups of the chain, got %q", logged)
+		}
+	}
+}
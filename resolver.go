@@ -0,0 +1,248 @@
+package finalize
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	pkgparse "github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/pkg/upstream"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Resolver looks up a single target of a CNAME chain. The default
+// implementation is upstream.Upstream, which resolves names through the
+// plugin chain of the server handling the request. Other plugins can set
+// Finalize.Resolver to inject their own implementation.
+type Resolver interface {
+	Lookup(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error)
+}
+
+// upstreamError is the error of a lookup failed at the upstream server addr.
+type upstreamError struct {
+	addr string
+	err  error
+}
+
+func (e *upstreamError) Error() string { return e.addr + ": " + e.err.Error() }
+
+func (e *upstreamError) Unwrap() error { return e.err }
+
+// upstreamAddr returns the address of the upstream server the lookup failed
+// at with err, or an empty string for lookups through the plugin chain.
+func upstreamAddr(err error) string {
+	var ue *upstreamError
+	if errors.As(err, &ue) {
+		return ue.addr
+	}
+	return ""
+}
+
+// lookupVia sends a lookup for name and typ to r. External upstreams record
+// the duration of each lookup per address, lookups through the plugin chain
+// are recorded here without one.
+func lookupVia(ctx context.Context, r Resolver, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+	if _, ok := r.(*upstream.Upstream); !ok {
+		return r.Lookup(ctx, state, name, typ)
+	}
+	start := time.Now()
+	defer func() {
+		observeDuration(ctx, lookupDuration.WithLabelValues(metrics.WithServer(ctx), ""), start)
+	}()
+	return r.Lookup(ctx, state, name, typ)
+}
+
+// upstreamOptions holds the settings applied to all upstreams configured in the Corefile.
+type upstreamOptions struct {
+	tlsConfig     *tls.Config
+	tlsServerName string
+	maxFails      uint32
+	hcInterval    time.Duration
+	policy        string
+	forceTCP      bool
+	preferUDP     bool
+	cookies       bool
+	randomizeCase bool
+	// bindAddr is the local address outgoing lookups are sent from, nil lets the system choose.
+	bindAddr net.IP
+	// ednsOptions are the codes of the EDNS0 options copied from the client query into lookups.
+	ednsOptions []uint16
+	// loopNonce is added to lookups to detect them being sent back to the server.
+	loopNonce []byte
+}
+
+func newUpstreamOptions() upstreamOptions {
+	return upstreamOptions{
+		ednsOptions: []uint16{dns.EDNS0SUBNET},
+		policy:      "sequential",
+		maxFails:    defaultMaxFails,
+		hcInterval:  defaultHCInterval,
+	}
+}
+
+// newResolver returns a Resolver sending lookups to the upstream servers in
+// to. Plain DNS and DNS over TLS servers can be combined, a gRPC upstream must
+// be the only server.
+func newResolver(to []string, opts upstreamOptions) (Resolver, error) {
+	hosts, err := pkgparse.HostPortOrFile(to...)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := newPolicy(opts.policy)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &dnsUpstream{
+		maxFails:    opts.maxFails,
+		policy:      p,
+		ednsOptions: opts.ednsOptions,
+		loopNonce:   opts.loopNonce,
+		forceTCP:    opts.forceTCP,
+		preferUDP:   opts.preferUDP,
+
+		randomizeCase: opts.randomizeCase,
+	}
+	for _, host := range hosts {
+		trans, addr := pkgparse.Transport(host)
+		switch trans {
+		case transport.GRPC:
+			if len(hosts) != 1 {
+				return nil, fmt.Errorf("a gRPC upstream can not be combined with other upstreams: %v", to)
+			}
+			return newGRPCUpstream(addr, opts)
+		case transport.DNS, transport.TLS:
+			u.hosts = append(u.hosts, newUpstreamHost(trans, addr, opts))
+		default:
+			return nil, fmt.Errorf("unsupported transport %s for upstream %s", trans, host)
+		}
+	}
+
+	return u, nil
+}
+
+// newLookupMsg returns the query sent to an external upstream to look up name.
+// The EDNS0 options of the original query with one of the given codes are
+// carried over, except for the loop detection nonce of another instance.
+func newLookupMsg(state request.Request, name string, typ uint16, codes []uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, typ)
+	req.RecursionDesired = true
+	req.CheckingDisabled = state.Req.CheckingDisabled
+	req.SetEdns0(dns.DefaultMsgSize, state.Do())
+
+	if o := state.Req.IsEdns0(); o != nil {
+		lookupOpt := req.IsEdns0()
+		for _, opt := range o.Option {
+			if slices.Contains(codes, opt.Option()) && opt.Option() != loopOptionCode {
+				lookupOpt.Option = append(lookupOpt.Option, opt)
+			}
+		}
+	}
+
+	return req
+}
+
+// edns0Codes maps the names accepted by edns0_passthrough to EDNS0 option codes.
+var edns0Codes = map[string]uint16{
+	"NSID":          dns.EDNS0NSID,
+	"ECS":           dns.EDNS0SUBNET,
+	"SUBNET":        dns.EDNS0SUBNET,
+	"EXPIRE":        dns.EDNS0EXPIRE,
+	"COOKIE":        dns.EDNS0COOKIE,
+	"TCP-KEEPALIVE": dns.EDNS0TCPKEEPALIVE,
+	"PADDING":       dns.EDNS0PADDING,
+}
+
+// parseEDNS0Code parses an EDNS0 option given by name or by number.
+func parseEDNS0Code(s string) (uint16, error) {
+	if code, ok := edns0Codes[strings.ToUpper(s)]; ok {
+		return code, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown EDNS0 option '%s'", s)
+	}
+	return uint16(n), nil
+}
+
+// readier is implemented by the resolvers that have to reach their upstream
+// servers before the plugin reports it is ready.
+type readier interface {
+	ready() bool
+}
+
+// resolverReady reports whether r is ready to look up targets. Resolvers not
+// implementing readier, such as the plugin chain, always are.
+func resolverReady(r Resolver) bool {
+	if rd, ok := r.(readier); ok {
+		return rd.ready()
+	}
+	return true
+}
+
+// starter is implemented by the resolvers that health check their upstream
+// servers, which they only start doing once the server starts up.
+type starter interface {
+	start()
+}
+
+// startResolver starts r if it health checks its upstream servers.
+func startResolver(r Resolver) {
+	if s, ok := r.(starter); ok {
+		s.start()
+	}
+}
+
+// closeResolver closes r if it holds any connections.
+func closeResolver(r Resolver) error {
+	if c, ok := r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// parseBindAddr parses s as an IP address or, failing that, as the name of a
+// network interface whose first address is used.
+func parseBindAddr(s string) (net.IP, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("not an IP address or interface: %q", s)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			return ipnet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %q has no IP address", s)
+}
+
+// dialer returns a dialer for network that sends from bindAddr, or nil if
+// bindAddr is not set.
+func dialer(network string, bindAddr net.IP) *net.Dialer {
+	if bindAddr == nil {
+		return nil
+	}
+	if network == "udp" {
+		return &net.Dialer{LocalAddr: &net.UDPAddr{IP: bindAddr}}
+	}
+	return &net.Dialer{LocalAddr: &net.TCPAddr{IP: bindAddr}}
+}
@@ -0,0 +1,100 @@
+package finalize
+
+import (
+	"testing"
+
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestNewLookupMsg(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	req.SetEdns0(1232, true)
+	req.CheckingDisabled = true
+	o := req.IsEdns0()
+	o.Option = append(o.Option,
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+		&dns.EDNS0_PADDING{Padding: make([]byte, 8)},
+	)
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: req}
+
+	tests := []struct {
+		codes []uint16
+		want  []uint16
+	}{
+		{nil, nil},
+		{[]uint16{dns.EDNS0SUBNET}, []uint16{dns.EDNS0SUBNET}},
+		{[]uint16{dns.EDNS0COOKIE, dns.EDNS0PADDING}, []uint16{dns.EDNS0COOKIE, dns.EDNS0PADDING}},
+		{[]uint16{dns.EDNS0NSID}, nil},
+	}
+
+	for i, test := range tests {
+		m := newLookupMsg(state, "b.example.com.", dns.TypeAAAA, test.codes)
+		if m.Question[0].Name != "b.example.com." || m.Question[0].Qtype != dns.TypeAAAA || !m.RecursionDesired || !m.CheckingDisabled {
+			t.Errorf("Test %d: unexpected question %v", i, m.Question)
+		}
+		opt := m.IsEdns0()
+		if opt == nil || !opt.Do() {
+			t.Fatalf("Test %d: expected an OPT record with the DO bit set", i)
+		}
+		if len(opt.Option) != len(test.want) {
+			t.Fatalf("Test %d: expected %d options, got %v", i, len(test.want), opt.Option)
+		}
+		for j, code := range test.want {
+			if opt.Option[j].Option() != code {
+				t.Errorf("Test %d: expected option %d, got %d", i, code, opt.Option[j].Option())
+			}
+		}
+	}
+}
+
+func TestParseEDNS0Code(t *testing.T) {
+	tests := []struct {
+		input     string
+		code      uint16
+		shouldErr bool
+	}{
+		{"ECS", dns.EDNS0SUBNET, false},
+		{"cookie", dns.EDNS0COOKIE, false},
+		{"PADDING", dns.EDNS0PADDING, false},
+		{"65001", 65001, false},
+		{"65536", 0, true},
+		{"unknown", 0, true},
+	}
+
+	for i, test := range tests {
+		code, err := parseEDNS0Code(test.input)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: expected error %v, got %v", i, test.shouldErr, err)
+		}
+		if code != test.code {
+			t.Errorf("Test %d: expected code %d, got %d", i, test.code, code)
+		}
+	}
+}
+
+func TestParseBindAddr(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"lo", false},
+		{"no-such-interface0", true},
+		{"127.0.0.1:53", true},
+	}
+
+	for i, test := range tests {
+		ip, err := parseBindAddr(test.input)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: expected error %v, got %v", i, test.shouldErr, err)
+		}
+		if err == nil && ip == nil {
+			t.Errorf("Test %d: expected an address, got none", i)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package finalize
+
+import (
+	"context"
+	"errors"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// routeTable is a Resolver that sends lookups for names below one of its zones
+// to the resolver configured for the (longest) matching zone, and all other
+// lookups to its default resolver.
+type routeTable struct {
+	zones     plugin.Zones
+	resolvers map[string]Resolver
+	fallback  Resolver
+}
+
+// Lookup implements the Resolver interface.
+func (r *routeTable) Lookup(ctx context.Context, state request.Request, name string, typ uint16) (*dns.Msg, error) {
+	return lookupVia(ctx, r.resolverFor(name), state, name, typ)
+}
+
+func (r *routeTable) resolverFor(name string) Resolver {
+	if zone := r.zones.Matches(name); zone != "" {
+		return r.resolvers[zone]
+	}
+	return r.fallback
+}
+
+// ready reports whether all resolvers of the table are ready.
+func (r *routeTable) ready() bool {
+	ready := resolverReady(r.fallback)
+	for _, res := range r.resolvers {
+		ready = resolverReady(res) && ready
+	}
+	return ready
+}
+
+// start starts all resolvers of the table that health check their upstream
+// servers.
+func (r *routeTable) start() {
+	startResolver(r.fallback)
+	for _, res := range r.resolvers {
+		startResolver(res)
+	}
+}
+
+// Close closes all resolvers of the table that hold connections.
+func (r *routeTable) Close() error {
+	errs := []error{closeResolver(r.fallback)}
+	for _, res := range r.resolvers {
+		errs = append(errs, closeResolver(res))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,80 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestRouteTable(t *testing.T) {
+	consul := &stubResolver{answers: map[string][]dns.RR{
+		"web.service.consul.": {plugintest.A("web.service.consul. 0 IN A 10.1.0.1")},
+	}}
+	corp := &stubResolver{answers: map[string][]dns.RR{
+		"a.corp.example.": {plugintest.A("a.corp.example. 60 IN A 10.2.0.1")},
+	}}
+	dc := &stubResolver{answers: map[string][]dns.RR{
+		"a.dc.corp.example.": {plugintest.A("a.dc.corp.example. 60 IN A 10.3.0.1")},
+	}}
+	fallback := &stubResolver{answers: map[string][]dns.RR{
+		"www.example.com.": {plugintest.A("www.example.com. 60 IN A 192.0.2.1")},
+	}}
+
+	table := &routeTable{
+		zones: plugin.Zones{"consul.", "corp.example.", "dc.corp.example."},
+		resolvers: map[string]Resolver{
+			"consul.":          consul,
+			"corp.example.":    corp,
+			"dc.corp.example.": dc,
+		},
+		fallback: fallback,
+	}
+
+	tests := []struct {
+		name     string
+		resolver *stubResolver
+	}{
+		{"web.service.consul.", consul},
+		{"a.corp.example.", corp},
+		{"a.dc.corp.example.", dc},
+		{"www.example.com.", fallback},
+	}
+
+	state := request.Request{W: &plugintest.ResponseWriter{}, Req: new(dns.Msg)}
+	for _, test := range tests {
+		if _, err := table.Lookup(context.Background(), state, test.name, dns.TypeA); err != nil {
+			t.Errorf("Expected no error for %s, got %v", test.name, err)
+		}
+		if n := len(test.resolver.lookups); n == 0 || test.resolver.lookups[n-1] != test.name {
+			t.Errorf("Expected %s to be looked up by the routed resolver, got %v", test.name, test.resolver.lookups)
+		}
+	}
+}
+
+type startedResolver struct {
+	stubResolver
+	started bool
+}
+
+func (r *startedResolver) start() { r.started = true }
+
+func TestRouteTableStart(t *testing.T) {
+	consul, fallback := &startedResolver{}, &startedResolver{}
+	f := New()
+	f.Resolver = &routeTable{
+		zones:     plugin.Zones{"consul."},
+		resolvers: map[string]Resolver{"consul.": consul},
+		fallback:  fallback,
+	}
+
+	if err := f.OnStartup(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !consul.started || !fallback.started {
+		t.Errorf("Expected all resolvers of the table to be started, got %v and %v", consul.started, fallback.started)
+	}
+}
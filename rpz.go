@@ -0,0 +1,178 @@
+package finalize
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rpzAction is the action of a response policy zone rule.
+type rpzAction int
+
+const (
+	// rpzNXDomain answers with NXDOMAIN, from CNAME .
+	rpzNXDomain rpzAction = iota
+	// rpzNoData answers with NOERROR and no records, from CNAME *.
+	rpzNoData
+	// rpzPassthru exempts the name from the policy, from CNAME rpz-passthru.
+	rpzPassthru
+	// rpzDrop does not answer at all, from CNAME rpz-drop.
+	rpzDrop
+)
+
+func (a rpzAction) String() string {
+	switch a {
+	case rpzNXDomain:
+		return "nxdomain"
+	case rpzNoData:
+		return "nodata"
+	case rpzPassthru:
+		return "passthru"
+	case rpzDrop:
+		return "drop"
+	}
+	return "unknown"
+}
+
+// rpzTriggers are the labels of the triggers other than QNAME, which are not
+// supported.
+var rpzTriggers = []string{"rpz-ip", "rpz-nsip", "rpz-nsdname", "rpz-client-ip"}
+
+// rpzPolicy holds the QNAME rules of a response policy zone.
+type rpzPolicy struct {
+	origin string
+	// exact maps the names of the rules to their action.
+	exact map[string]rpzAction
+	// wildcard maps the parents of the wildcard rules, e.g. example.com. for
+	// *.example.com., to their action.
+	wildcard map[string]rpzAction
+}
+
+// rpzError is returned for chains leading to a target matching a rule of
+// the response policy zone.
+type rpzError struct {
+	name   string
+	action rpzAction
+}
+
+func (e *rpzError) Error() string {
+	return fmt.Sprintf("response policy %s for %s", e.action, e.name)
+}
+
+// Unwrap makes rpzError match errDenied, so that it is handled as the other
+// denied targets.
+func (e *rpzError) Unwrap() error { return errDenied }
+
+// loadRPZ reads the response policy zone in file. The origin is the SOA
+// owner, unless origin is given. Rules with triggers other than QNAME and
+// rules with local data are skipped with a warning.
+func loadRPZ(file, origin string) (*rpzPolicy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(f, dns.Fqdn(origin), file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+		if soa, isSOA := rr.(*dns.SOA); isSOA && origin == "" {
+			origin = soa.Hdr.Name
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if origin == "" {
+		return nil, fmt.Errorf("no SOA record in response policy zone %s", file)
+	}
+
+	p := &rpzPolicy{
+		origin:   dns.CanonicalName(origin),
+		exact:    make(map[string]rpzAction),
+		wildcard: make(map[string]rpzAction),
+	}
+	skipped := 0
+	for _, rr := range rrs {
+		name := dns.CanonicalName(rr.Header().Name)
+		if name == p.origin || !dns.IsSubDomain(p.origin, name) {
+			continue
+		}
+		name = strings.TrimSuffix(name, p.origin)
+		action, ok := rpzActionOf(rr)
+		if !ok || hasRPZTrigger(name) {
+			skipped++
+			continue
+		}
+		if rest, ok := strings.CutPrefix(name, "*."); ok {
+			p.wildcard[dns.Fqdn(rest)] = action
+		} else {
+			p.exact[dns.Fqdn(name)] = action
+		}
+	}
+	if skipped > 0 {
+		log.Warningf("Skipped %d unsupported rules of response policy zone %s", skipped, file)
+	}
+
+	return p, nil
+}
+
+// rpzActionOf returns the action of the rule rr, which is false for local
+// data.
+func rpzActionOf(rr dns.RR) (rpzAction, bool) {
+	cname, ok := rr.(*dns.CNAME)
+	if !ok {
+		return 0, false
+	}
+	switch dns.CanonicalName(cname.Target) {
+	case ".":
+		return rpzNXDomain, true
+	case "*.":
+		return rpzNoData, true
+	case "rpz-passthru.":
+		return rpzPassthru, true
+	case "rpz-drop.":
+		return rpzDrop, true
+	}
+	return 0, false
+}
+
+// hasRPZTrigger reports whether the relative name of a rule holds the label
+// of a trigger other than QNAME.
+func hasRPZTrigger(name string) bool {
+	for _, label := range dns.SplitDomainName(name) {
+		for _, trigger := range rpzTriggers {
+			if label == trigger {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// match returns the action for name. Exact rules take precedence over
+// wildcard rules, and wildcard rules closer to name over those further up.
+func (p *rpzPolicy) match(name string) (rpzAction, bool) {
+	name = dns.CanonicalName(name)
+	if action, ok := p.exact[name]; ok {
+		return action, true
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if action, ok := p.wildcard[name[off:]]; ok {
+			return action, true
+		}
+	}
+	return 0, false
+}
+
+// check returns an rpzError if name matches a rule blocking it.
+func (p *rpzPolicy) check(name string) error {
+	action, ok := p.match(name)
+	if !ok || action == rpzPassthru {
+		return nil
+	}
+	return &rpzError{name: name, action: action}
+}
@@ -0,0 +1,126 @@
+package finalize
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+const testRPZ = `$ORIGIN rpz.local.
+@ 300 IN SOA ns.rpz.local. admin.rpz.local. 1 3600 600 86400 300
+@ 300 IN NS ns.rpz.local.
+bad.example.com CNAME .
+*.bad.example.com CNAME .
+ok.bad.example.com CNAME rpz-passthru.
+empty.example.com CNAME *.
+*.drop.example.com CNAME rpz-drop.
+garden.example.com CNAME walled.example.net.
+32.1.2.0.192.rpz-ip CNAME .
+`
+
+func writeRPZ(t *testing.T) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "db.rpz")
+	if err := os.WriteFile(file, []byte(testRPZ), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadRPZ(t *testing.T) {
+	p, err := loadRPZ(writeRPZ(t), "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if p.origin != "rpz.local." {
+		t.Errorf("Expected origin rpz.local., got %s", p.origin)
+	}
+
+	tests := []struct {
+		name   string
+		action rpzAction
+		match  bool
+	}{
+		{"bad.example.com.", rpzNXDomain, true},
+		{"BAD.example.com.", rpzNXDomain, true},
+		{"a.b.bad.example.com.", rpzNXDomain, true},
+		{"ok.bad.example.com.", rpzPassthru, true},
+		{"empty.example.com.", rpzNoData, true},
+		{"a.drop.example.com.", rpzDrop, true},
+		{"drop.example.com.", 0, false},
+		{"garden.example.com.", 0, false},
+		{"example.com.", 0, false},
+	}
+	for i, tc := range tests {
+		action, ok := p.match(tc.name)
+		if ok != tc.match || action != tc.action {
+			t.Errorf("Test %d: expected %v %t for %s, got %v %t", i, tc.action, tc.match, tc.name, action, ok)
+		}
+	}
+
+	if _, err := loadRPZ(filepath.Join(t.TempDir(), "missing"), ""); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestServeDNSRPZ(t *testing.T) {
+	p, err := loadRPZ(writeRPZ(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target    string
+		wantRcode int
+		wantRRs   int
+		written   bool
+	}{
+		{"b.example.org.", dns.RcodeSuccess, 2, true},
+		{"bad.example.com.", dns.RcodeNameError, 0, true},
+		{"ok.bad.example.com.", dns.RcodeSuccess, 3, true},
+		{"empty.example.com.", dns.RcodeSuccess, 0, true},
+		{"x.drop.example.com.", 0, 0, false},
+	}
+
+	for i, tc := range tests {
+		// the target is found by the lookup of b.example.org., so that it is
+		// checked before its own lookup
+		answers := map[string][]dns.RR{
+			"b.example.org.": {plugintest.A("b.example.org. 300 IN A 192.0.2.1")},
+		}
+		if tc.target != "b.example.org." {
+			answers["b.example.org."] = []dns.RR{plugintest.CNAME("b.example.org. 300 IN CNAME " + tc.target)}
+			answers[tc.target] = []dns.RR{plugintest.A(tc.target + " 300 IN A 192.0.2.1")}
+		}
+
+		f := New()
+		f.Resolver = &stubResolver{answers: answers}
+		f.rpz = p
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.org."))
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if !tc.written {
+			if rec.Msg != nil {
+				t.Errorf("Test %d: expected no answer, got %v", i, rec.Msg)
+			}
+			continue
+		}
+		if rec.Msg == nil {
+			t.Fatalf("Test %d: expected an answer", i)
+		}
+		if rec.Msg.Rcode != tc.wantRcode || len(rec.Msg.Answer) != tc.wantRRs {
+			t.Errorf("Test %d: expected %s with %d records, got %v", i, dns.RcodeToString[tc.wantRcode], tc.wantRRs, rec.Msg)
+		}
+	}
+}
@@ -1,59 +1,1020 @@
 package finalize
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/dnstap"
+	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
 )
 
 // init registers this plugin.
 func init() { plugin.Register(pluginName, setup) }
 
+// setup adds an instance of the plugin for each finalize_cname block of the
+// server block. The instances are chained in the order of the blocks, so that
+// the first instance whose scope matches a request finalizes it. The blocks
+// must not share an admin address, as each instance starts its own admin
+// server.
 func setup(c *caddy.Controller) error {
-	finalize, err := parse(c)
-	if err != nil {
-		return plugin.Error(pluginName, err)
+	var first *Finalize
+	admins := make(map[string]bool)
+	for {
+		finalize, err := parse(c)
+		if err != nil {
+			return plugin.Error(pluginName, err)
+		}
+		if finalize == nil {
+			break
+		}
+		if finalize.admin != nil {
+			if admins[finalize.admin.addr] {
+				return plugin.Error(pluginName, c.Errf("admin address '%s' is used by another block", finalize.admin.addr))
+			}
+			admins[finalize.admin.addr] = true
+		}
+		if first == nil {
+			first = finalize
+		} else {
+			first.following = append(first.following, finalize)
+		}
+		setupInstance(c, finalize)
 	}
+
+	log.Debug("Added plugin to server")
+
+	return nil
+}
+
+func setupInstance(c *caddy.Controller, finalize *Finalize) {
+	c.OnStartup(finalize.OnStartup)
+	c.OnShutdown(finalize.OnShutdown)
+	if finalize.cacheInterop {
+		// the handlers of the server are only known once it has been built
+		c.OnStartup(func() error {
+			return checkCacheOrder(dnsserver.Directives, dnsserver.GetConfig(c).Handler("cache") != nil)
+		})
+	}
+
+	c.OnStartup(func() error {
+		if taph := dnsserver.GetConfig(c).Handler("dnstap"); taph != nil {
+			finalize.SetTapPlugin(taph.(*dnstap.Dnstap))
+		}
+		return nil
+	})
+
 	// Add the Plugin to CoreDNS, so Servers can use it in their plugin chain.
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		finalize.Next = next
 
 		return finalize
 	})
+}
 
-	log.Debug("Added plugin to server")
+// checkCacheOrder returns an error unless the cache plugin is enabled and
+// comes before this plugin in directives, so that it stores the finalized
+// answers.
+func checkCacheOrder(directives []string, enabled bool) error {
+	if !enabled {
+		return plugin.Error(pluginName, fmt.Errorf("cache_interop requires the cache plugin"))
+	}
+	for _, d := range directives {
+		if d == "cache" {
+			return nil
+		}
+		if d == pluginName {
+			break
+		}
+	}
+	return plugin.Error(pluginName, fmt.Errorf("cache_interop requires the cache plugin to come before %s in plugin.cfg", pluginName))
+}
 
-	return nil
+// repeatableProperties are the properties that may be given more than once in
+// a block, each adding to the ones before. All other properties are rejected
+// when repeated, rather than silently overriding the value given first.
+var repeatableProperties = map[string]bool{
+	"except":                true,
+	"types":                 true,
+	"clients":               true,
+	"except_clients":        true,
+	"allow_targets":         true,
+	"deny_targets":          true,
+	"deny_targets_regex":    true,
+	"block_private":         true,
+	"allow_answer_networks": true,
+	"when":                  true,
+	"map":                   true,
+	"route":                 true,
+	"log_level":             true,
 }
 
+// parse parses the next finalize_cname block of c into an instance of the
+// plugin, or returns nil if there is none.
 func parse(c *caddy.Controller) (*Finalize, error) {
+	if !c.Next() {
+		return nil, nil
+	}
+
 	finalizePlugin := New()
-	for c.Next() {
-		args := c.RemainingArgs()
-		switch len(args) {
-		case 0:
-			// do nothing
-		case 1:
+	opts := newUpstreamOptions()
+	var upstreamTo []string
+	var cacheSize int
+	var cacheTTLCap, staleFor time.Duration
+	var prefetchHits, prefetchPercentage int
+	var prefetchWindow time.Duration
+	var cacheHops bool
+	var snapshotPath string
+	snapshotInterval := defaultSnapshotInterval
+	shared := sharedOptions{prefix: defaultSharedPrefix, poolSize: defaultSharedPoolSize}
+	var routeZones plugin.Zones
+	routes := make(map[string][]string)
+	seen := make(map[string]bool)
+	args := c.RemainingArgs()
+	// max_depth is the name used by the original finalize plugin
+	if len(args) > 0 && (strings.EqualFold("max_lookup", args[0]) || strings.EqualFold("max_depth", args[0])) {
+		if len(args) != 2 {
 			return nil, c.ArgErr()
-		case 2:
-			if strings.EqualFold("max_lookup", args[0]) {
-				n, err := strconv.Atoi(args[1])
+		}
+		n, err := parseMaxLookup(args[1])
+		if err != nil {
+			return nil, c.Err(err.Error())
+		}
+		finalizePlugin.maxLookup.Store(int64(n))
+		seen["max_lookup"] = true
+	} else {
+		zones, err := normalizeZones(args)
+		if err != nil {
+			return nil, c.Err(err.Error())
+		}
+		finalizePlugin.zones = zones
+	}
+
+	for c.NextBlock() {
+		if seen[c.Val()] {
+			return nil, c.Errf("duplicate property '%s'", c.Val())
+		}
+		if !repeatableProperties[c.Val()] {
+			seen[c.Val()] = true
+		}
+		switch c.Val() {
+		case "except":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			zones, err := normalizeZones(args)
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			finalizePlugin.except = append(finalizePlugin.except, zones...)
+		case "clients", "except_clients":
+			dir := c.Val()
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			nets, err := parseNetworks(args)
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			if dir == "clients" {
+				finalizePlugin.clients = append(finalizePlugin.clients, nets...)
+			} else {
+				finalizePlugin.exceptClients = append(finalizePlugin.exceptClients, nets...)
+			}
+		case "allow_targets", "deny_targets":
+			dir := c.Val()
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			zones, err := normalizeZones(args)
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			if dir == "allow_targets" {
+				finalizePlugin.allowTargets = append(finalizePlugin.allowTargets, zones...)
+			} else {
+				finalizePlugin.denyTargets = append(finalizePlugin.denyTargets, zones...)
+			}
+		case "deny_targets_regex":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			for _, arg := range args {
+				re, err := regexp.Compile(arg)
 				if err != nil {
-					return nil, err
+					return nil, c.Errf("invalid pattern '%s': %v", arg, err)
 				}
-				if n <= 0 {
-					return nil, fmt.Errorf("max_lookup parameter must be greater than 0")
+				finalizePlugin.denyTargetPatterns = append(finalizePlugin.denyTargetPatterns, re)
+			}
+		case "denied_action":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			action, err := parseAction(c.Val(), deniedActions)
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.deniedAction = action
+		case "on_error":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			action, err := parseAction(c.Val(), errorActions)
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.onError = action
+		case "on_dangling":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			action, err := parseAction(c.Val(), danglingActions)
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.onDangling = action
+		case "block_private":
+			args := c.RemainingArgs()
+			nets := privateNetworks
+			if len(args) > 0 {
+				var err error
+				if nets, err = parseNetworks(args); err != nil {
+					return nil, c.Err(err.Error())
 				}
-				finalizePlugin.maxLookup = n
-			} else {
-				return nil, fmt.Errorf("unsupported parameter %s for upstream setting", args[0])
 			}
+			finalizePlugin.blockedNetworks = append(finalizePlugin.blockedNetworks, nets...)
+		case "allow_answer_networks":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			nets, err := parseNetworks(args)
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			finalizePlugin.allowedNetworks = append(finalizePlugin.allowedNetworks, nets...)
+		case "rpz":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			file := args[0]
+			if !filepath.IsAbs(file) && dnsserver.GetConfig(c).Root != "" {
+				file = filepath.Join(dnsserver.GetConfig(c).Root, file)
+			}
+			origin := ""
+			if len(args) > 1 {
+				origin = args[1]
+			}
+			p, err := loadRPZ(file, origin)
+			if err != nil {
+				return nil, c.Errf("failed to load response policy zone '%s': %v", file, err)
+			}
+			finalizePlugin.rpz = p
+		case "when":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			prog, err := compileWhen(strings.Join(args, " "))
+			if err != nil {
+				return nil, c.Errf("invalid when expression: %v", err)
+			}
+			finalizePlugin.when = append(finalizePlugin.when, prog)
+		case "types":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			if finalizePlugin.types == nil {
+				finalizePlugin.types = make(map[uint16]struct{})
+			}
+			for _, arg := range args {
+				qtype, ok := dns.StringToType[strings.ToUpper(arg)]
+				if !ok {
+					return nil, c.Errf("unknown type '%s'", arg)
+				}
+				finalizePlugin.types[qtype] = struct{}{}
+			}
+		case "max_lookup":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := parseMaxLookup(c.Val())
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.maxLookup.Store(int64(n))
+		case "max_zones":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n <= 0 {
+				return nil, c.Errf("max_zones must be a number greater than 0, got '%s'", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.maxZones = n
+		case "zone_label_limit":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n < 0 {
+				return nil, c.Errf("zone_label_limit must be a number greater than or equal to 0, got '%s'", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.zoneLabels = newZoneLabels(n)
+		case "lookup_timeout":
+			d, err := durationArg(c)
+			if err != nil {
+				return nil, err
+			}
+			finalizePlugin.lookupTimeout = d
+		case "deadline":
+			d, err := durationArg(c)
+			if err != nil {
+				return nil, err
+			}
+			finalizePlugin.deadline = d
+		case "circuit_breaker":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return nil, c.Errf("circuit_breaker failures must be an integer greater than 0, got '%s'", args[0])
+			}
+			d, err := time.ParseDuration(args[1])
+			if err != nil || d <= 0 {
+				return nil, c.Errf("circuit_breaker cooldown must be a duration greater than 0, got '%s'", args[1])
+			}
+			finalizePlugin.breaker = newCircuitBreaker(n, d)
+		case "max_concurrent":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n <= 0 {
+				return nil, c.Errf("max_concurrent must be an integer greater than 0, got '%s'", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.sem = make(chan struct{}, n)
+		case "lookup_rate_limit":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			limiter, err := parseRateLimit(c.Val())
+			if err != nil {
+				return nil, c.Errf("invalid lookup_rate_limit '%s': %v", c.Val(), err)
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.limiter = limiter
+		case "client_lookup_budget":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			limiter, err := parseRateLimit(c.Val())
+			if err != nil {
+				return nil, c.Errf("invalid client_lookup_budget '%s': %v", c.Val(), err)
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.budget = newClientBudget(limiter.Limit(), limiter.Burst())
+		case "ecs":
+			args := c.RemainingArgs()
+			if len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			ecs := &ecsConfig{v4Prefix: defaultECSv4Prefix, v6Prefix: defaultECSv6Prefix}
+			if len(args) > 0 {
+				n, err := strconv.ParseUint(args[0], 10, 8)
+				if err != nil || n > 32 {
+					return nil, c.Errf("invalid ecs IPv4 prefix length '%s'", args[0])
+				}
+				ecs.v4Prefix = uint8(n)
+			}
+			if len(args) > 1 {
+				n, err := strconv.ParseUint(args[1], 10, 8)
+				if err != nil || n > 128 {
+					return nil, c.Errf("invalid ecs IPv6 prefix length '%s'", args[1])
+				}
+				ecs.v6Prefix = uint8(n)
+			}
+			finalizePlugin.ecs = ecs
+		case "harmonize_ttl":
+			args := c.RemainingArgs()
+			switch {
+			case len(args) == 0:
+			case len(args) == 1 && args[0] == "all":
+				finalizePlugin.harmonizeAll = true
+			default:
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.harmonizeTTL = true
+		case "min_ttl":
+			ttl, err := ttlArg(c)
+			if err != nil {
+				return nil, err
+			}
+			finalizePlugin.minTTL = ttl
+		case "max_ttl":
+			ttl, err := ttlArg(c)
+			if err != nil {
+				return nil, err
+			}
+			finalizePlugin.maxTTL = ttl
+		case "address_order":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[0] != "random") {
+				return nil, c.ArgErr()
+			}
+			var seed int64
+			if len(args) == 2 {
+				n, err := strconv.ParseInt(args[1], 10, 64)
+				if err != nil || n == 0 {
+					return nil, c.Errf("address_order seed must be a non-zero integer, got '%s'", args[1])
+				}
+				seed = n
+			}
+			order, err := newAddressOrder(args[0], seed)
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			finalizePlugin.addressOrder = order
+		case "max_addresses":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n <= 0 {
+				return nil, c.Errf("max_addresses must be an integer greater than 0, got '%s'", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.maxAddresses = n
+		case "merge_sections":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.mergeSections = true
+		case "map":
+			args := c.RemainingArgs()
+			if len(args) != 3 {
+				return nil, c.ArgErr()
+			}
+			rule, err := newTargetRule(args[0], args[1], args[2])
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			finalizePlugin.targetMap = append(finalizePlugin.targetMap, rule)
+		case "marker":
+			finalizePlugin.marker = defaultMarkerCode
+			args := c.RemainingArgs()
+			switch len(args) {
+			case 0:
+			case 1:
+				code, err := strconv.ParseUint(args[0], 10, 16)
+				if err != nil || code < 65001 || code > 65534 || uint16(code) == loopOptionCode {
+					return nil, c.Errf("marker option code must be between 65001 and 65534, except 65501: %s", args[0])
+				}
+				finalizePlugin.marker = uint16(code)
+			default:
+				return nil, c.ArgErr()
+			}
+		case "validate":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.validate = true
+		case "dual":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.dual = true
+		case "srv_additional":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.srvAdditional = true
+		case "mx_additional":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.mxAdditional = true
+		case "svcb_alias":
+			args := c.RemainingArgs()
+			switch {
+			case len(args) == 0:
+			case len(args) == 1 && args[0] == "hints":
+				finalizePlugin.svcbHints = true
+			default:
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.svcbAlias = true
+		case "rcode_passthrough":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.rcodePassthrough = true
+		case "minimal":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.minimal = true
+		case "flatten":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.flatten = true
+		case "stability_window":
+			d, err := durationArg(c)
+			if err != nil {
+				return nil, err
+			}
+			finalizePlugin.stability = newStabilityCache(d)
+		case "cache_size":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n <= 0 {
+				return nil, c.Errf("cache_size must be an integer greater than 0, got '%s'", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			cacheSize = n
+		case "cache_ttl_cap":
+			d, err := durationArg(c)
+			if err != nil {
+				return nil, err
+			}
+			cacheTTLCap = d
+		case "serve_stale":
+			staleFor = defaultStaleFor
+			if c.NextArg() {
+				d, err := time.ParseDuration(c.Val())
+				if err != nil || d <= 0 {
+					return nil, c.Errf("invalid serve_stale '%s'", c.Val())
+				}
+				staleFor = d
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+		case "prefetch":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 3 {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return nil, c.Errf("prefetch amount must be an integer greater than 0, got '%s'", args[0])
+			}
+			prefetchHits = n
+			prefetchWindow = defaultPrefetchWindow
+			prefetchPercentage = defaultPrefetchPercentage
+			for _, arg := range args[1:] {
+				if pct, ok := strings.CutSuffix(arg, "%"); ok {
+					n, err := strconv.Atoi(pct)
+					if err != nil || n < 0 || n > 100 {
+						return nil, c.Errf("prefetch percentage must be between 0%% and 100%%, got '%s'", arg)
+					}
+					prefetchPercentage = n
+					continue
+				}
+				d, err := time.ParseDuration(arg)
+				if err != nil || d <= 0 {
+					return nil, c.Errf("prefetch duration must be a duration greater than 0, got '%s'", arg)
+				}
+				prefetchWindow = d
+			}
+		case "cache_hops":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			cacheHops = true
+		case "cache_backend":
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return nil, c.ArgErr()
+			}
+			if args[0] != "redis" && args[0] != "memcached" {
+				return nil, c.Errf("unknown cache_backend '%s', expected redis or memcached", args[0])
+			}
+			shared.backend = args[0]
+			shared.addrs = args[1:]
+		case "cache_key_prefix":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			shared.prefix = args[0]
+		case "cache_pool_size":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n <= 0 {
+				return nil, c.Errf("cache_pool_size must be an integer greater than 0, got '%s'", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			shared.poolSize = n
+		case "cache_snapshot":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			snapshotPath = args[0]
+			if !filepath.IsAbs(snapshotPath) && dnsserver.GetConfig(c).Root != "" {
+				snapshotPath = filepath.Join(dnsserver.GetConfig(c).Root, snapshotPath)
+			}
+			if len(args) > 1 {
+				d, err := time.ParseDuration(args[1])
+				if err != nil || d <= 0 {
+					return nil, c.Errf("cache_snapshot interval must be a duration greater than 0, got '%s'", args[1])
+				}
+				snapshotInterval = d
+			}
+		case "audit_log":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			path := c.Val()
+			if path != auditStdout && !filepath.IsAbs(path) && dnsserver.GetConfig(c).Root != "" {
+				path = filepath.Join(dnsserver.GetConfig(c).Root, path)
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.audits = newAuditLog(path)
+		case "recent_chains":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n <= 0 {
+				return nil, c.Errf("recent_chains must be a number greater than 0, got '%s'", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.recent = newRecentChains(n)
+		case "top_targets":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n <= 0 {
+				return nil, c.Errf("top_targets must be a number greater than 0, got '%s'", args[0])
+			}
+			window := defaultTopWindow
+			if len(args) > 1 {
+				window, err = time.ParseDuration(args[1])
+				if err != nil || window < topSlots*time.Second {
+					return nil, c.Errf("top_targets window must be a duration of at least %v, got '%s'", topSlots*time.Second, args[1])
+				}
+			}
+			finalizePlugin.top = newTopTargets(n, window)
+		case "health_error_rate":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, c.Errf("health_error_rate must be a number greater than 0 and at most 1, got '%s'", args[0])
+			}
+			window := defaultHealthWindow
+			if len(args) > 1 {
+				window, err = time.ParseDuration(args[1])
+				if err != nil || window < healthSlots*time.Second {
+					return nil, c.Errf("health_error_rate window must be a duration of at least %v, got '%s'", healthSlots*time.Second, args[1])
+				}
+			}
+			finalizePlugin.health = newLookupHealth(window, rate)
+		case "slow_chain_threshold":
+			d, err := durationArg(c)
+			if err != nil {
+				return nil, err
+			}
+			finalizePlugin.slowChain = d
+		case "log_level":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return nil, c.ArgErr()
+			}
+			if _, ok := finalizePlugin.events.levels[args[0]]; !ok {
+				return nil, c.Errf("unknown log_level message '%s', expected dangling, circular, max_lookup or upstream_error", args[0])
+			}
+			switch args[1] {
+			case levelDebug, levelInfo, levelWarning, levelError:
+			default:
+				return nil, c.Errf("unknown log_level '%s', expected debug, info, warning or error", args[1])
+			}
+			finalizePlugin.events.levels[args[0]] = args[1]
+		case "log_limit":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.Atoi(c.Val())
+			if err != nil || n <= 0 {
+				return nil, c.Errf("log_limit must be a number greater than 0, got '%s'", c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.events.limit = n
+		case "log_chains":
+			args := c.RemainingArgs()
+			if len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			format, sample := chainLogJSON, 1.0
+			if len(args) > 0 {
+				format = args[0]
+				if format != chainLogJSON && format != chainLogKeyValue {
+					return nil, c.Errf("unknown log_chains format '%s', expected json or kv", format)
+				}
+			}
+			if len(args) > 1 {
+				f, err := strconv.ParseFloat(args[1], 64)
+				if err != nil || f <= 0 || f > 1 {
+					return nil, c.Errf("log_chains sample must be a number greater than 0 and at most 1, got '%s'", args[1])
+				}
+				sample = f
+			}
+			finalizePlugin.chainLog = newChainLog(format, sample)
+		case "admin":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, c.ArgErr()
+			}
+			if _, _, err := net.SplitHostPort(args[0]); err != nil {
+				return nil, c.Errf("invalid admin address '%s': %v", args[0], err)
+			}
+			token := ""
+			if len(args) > 1 {
+				token = args[1]
+			}
+			finalizePlugin.admin = newAdminServer(args[0], token)
+		case "cache_interop":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			finalizePlugin.cacheInterop = true
+		case "negative_ttl":
+			d, err := durationArg(c)
+			if err != nil {
+				return nil, err
+			}
+			finalizePlugin.negative = newNegativeCache(d)
+		case "upstream":
+			upstreamTo = c.RemainingArgs()
+			if len(upstreamTo) == 0 {
+				return nil, c.ArgErr()
+			}
+		case "route":
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return nil, c.ArgErr()
+			}
+			zone := plugin.Host(args[0]).NormalizeExact()
+			if len(zone) == 0 {
+				return nil, c.Errf("unable to normalize '%s'", args[0])
+			}
+			if _, ok := routes[zone[0]]; ok {
+				return nil, c.Errf("duplicate route for zone '%s'", zone[0])
+			}
+			routes[zone[0]] = args[1:]
+			routeZones = append(routeZones, zone[0])
+		case "max_fails":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.ParseUint(c.Val(), 10, 32)
+			if err != nil {
+				return nil, c.Errf("invalid max_fails '%s': %v", c.Val(), err)
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			opts.maxFails = uint32(n)
+		case "health_check":
+			d, err := durationArg(c)
+			if err != nil {
+				return nil, err
+			}
+			opts.hcInterval = d
+		case "edns0_passthrough":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return nil, c.ArgErr()
+			}
+			opts.ednsOptions = nil
+			for _, arg := range args {
+				if strings.EqualFold(arg, "none") && len(args) == 1 {
+					break
+				}
+				code, err := parseEDNS0Code(arg)
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				opts.ednsOptions = append(opts.ednsOptions, code)
+			}
+		case "force_tcp":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			opts.forceTCP = true
+		case "prefer_udp":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			opts.preferUDP = true
+		case "cookies":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			opts.cookies = true
+		case "randomize_case":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			opts.randomizeCase = true
+		case "bind":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			ip, err := parseBindAddr(c.Val())
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			opts.bindAddr = ip
+		case "policy":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			policy := c.Val()
+			if _, err := newPolicy(policy); err != nil {
+				return nil, c.Err(err.Error())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			opts.policy = policy
+		case "tls":
+			args := c.RemainingArgs()
+			if len(args) > 3 {
+				return nil, c.ArgErr()
+			}
+			for i := range args {
+				if !filepath.IsAbs(args[i]) && dnsserver.GetConfig(c).Root != "" {
+					args[i] = filepath.Join(dnsserver.GetConfig(c).Root, args[i])
+				}
+			}
+			tlsConfig, err := pkgtls.NewTLSConfigFromArgs(args...)
+			if err != nil {
+				return nil, c.Errf("invalid tls: %v", err)
+			}
+			opts.tlsConfig = tlsConfig
+		case "tls_servername":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return nil, c.ArgErr()
+			}
+			opts.tlsServerName = args[0]
 		default:
-			return nil, c.ArgErr()
+			return nil, c.Errf("unknown property '%s'", c.Val())
+		}
+	}
+
+	if finalizePlugin.minTTL > 0 && finalizePlugin.maxTTL > 0 && finalizePlugin.minTTL > finalizePlugin.maxTTL {
+		return nil, c.Errf("min_ttl %d is greater than max_ttl %d", finalizePlugin.minTTL, finalizePlugin.maxTTL)
+	}
+
+	if cacheSize > 0 || cacheTTLCap > 0 || staleFor > 0 || prefetchHits > 0 || shared.backend != "" || snapshotPath != "" || cacheHops {
+		if cacheSize == 0 {
+			cacheSize = defaultCacheSize
+		}
+		if cacheTTLCap == 0 {
+			cacheTTLCap = defaultCacheTTLCap
+		}
+		finalizePlugin.cache = newChainCache(cacheSize, cacheTTLCap)
+		finalizePlugin.cache.staleFor = staleFor
+		finalizePlugin.cache.prefetchHits = prefetchHits
+		finalizePlugin.cache.prefetchWindow = prefetchWindow
+		finalizePlugin.cache.prefetchPercentage = prefetchPercentage
+		if cacheHops {
+			finalizePlugin.hops = newChainCache(cacheSize, cacheTTLCap)
+		}
+		if shared.backend != "" {
+			store, err := newSharedStore(shared)
+			if err != nil {
+				return nil, err
+			}
+			finalizePlugin.cache.shared = store
+			finalizePlugin.cache.sharedPrefix = shared.prefix
+		}
+		if snapshotPath != "" {
+			finalizePlugin.snapshot = &snapshotter{
+				path:     snapshotPath,
+				interval: snapshotInterval,
+				cache:    finalizePlugin.cache,
+			}
+		}
+	}
+
+	if finalizePlugin.admin != nil {
+		finalizePlugin.admin.handle("/settings", finalizePlugin.serveSettings)
+		if finalizePlugin.cache != nil {
+			finalizePlugin.admin.handle("/cache", finalizePlugin.serveCache)
+		}
+		if finalizePlugin.recent != nil {
+			finalizePlugin.admin.handle("/chains", finalizePlugin.serveChains)
+		}
+		if finalizePlugin.top != nil {
+			finalizePlugin.admin.handle("/top", finalizePlugin.serveTop)
+		}
+		if finalizePlugin.health == nil {
+			finalizePlugin.health = newLookupHealth(defaultHealthWindow, 0)
+		}
+		finalizePlugin.admin.handle("/health", finalizePlugin.serveHealth)
+	}
+
+	if opts.tlsServerName != "" {
+		if opts.tlsConfig == nil {
+			opts.tlsConfig = new(tls.Config)
+		}
+		opts.tlsConfig.ServerName = opts.tlsServerName
+	}
+
+	opts.loopNonce = finalizePlugin.loopNonce
+	if len(upstreamTo) > 0 {
+		r, err := newResolver(upstreamTo, opts)
+		if err != nil {
+			return nil, release(finalizePlugin, err)
+		}
+		finalizePlugin.Resolver = r
+	}
+
+	if len(routeZones) > 0 {
+		table := &routeTable{
+			zones:     routeZones,
+			resolvers: make(map[string]Resolver),
+			fallback:  finalizePlugin.Resolver,
+		}
+		finalizePlugin.Resolver = table
+		for _, zone := range routeZones {
+			r, err := newResolver(routes[zone], opts)
+			if err != nil {
+				return nil, release(finalizePlugin, err)
+			}
+			table.resolvers[zone] = r
 		}
 	}
 
@@ -61,3 +1022,94 @@ func parse(c *caddy.Controller) (*Finalize, error) {
 
 	return finalizePlugin, nil
 }
+
+// release closes the resolvers and the shared cache store already built for f,
+// whose block turned out to be invalid, and returns err.
+func release(f *Finalize, err error) error {
+	closeResolver(f.Resolver)
+	if f.cache != nil && f.cache.shared != nil {
+		f.cache.shared.Close()
+	}
+	return err
+}
+
+// normalizeZones returns the zones given as arguments in canonical form.
+func normalizeZones(args []string) (plugin.Zones, error) {
+	var zones plugin.Zones
+	for _, arg := range args {
+		zone := plugin.Host(arg).NormalizeExact()
+		if len(zone) == 0 {
+			return nil, fmt.Errorf("unable to normalize '%s'", arg)
+		}
+		zones = append(zones, zone...)
+	}
+	return zones, nil
+}
+
+// parseMaxLookup parses s as the maximum number of lookups of a chain, where
+// 0 means no limit.
+func parseMaxLookup(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("max_lookup must be 0 for no limit or a number greater than 0, got '%s'", s)
+	}
+	return n, nil
+}
+
+// durationArg parses the next argument, which must be the last one, as a
+// duration greater than 0.
+func durationArg(c *caddy.Controller) (time.Duration, error) {
+	name := c.Val()
+	if !c.NextArg() {
+		return 0, c.ArgErr()
+	}
+	d, err := time.ParseDuration(c.Val())
+	if err != nil {
+		return 0, c.Errf("invalid %s '%s': %v", name, c.Val(), err)
+	}
+	if d <= 0 {
+		return 0, c.Errf("%s must be greater than 0", name)
+	}
+	if c.NextArg() {
+		return 0, c.ArgErr()
+	}
+	return d, nil
+}
+
+// ttlArg parses the next argument, which must be the last one, as a TTL in
+// seconds greater than 0.
+func ttlArg(c *caddy.Controller) (uint32, error) {
+	name := c.Val()
+	if !c.NextArg() {
+		return 0, c.ArgErr()
+	}
+	ttl, err := strconv.ParseUint(c.Val(), 10, 32)
+	if err != nil || ttl == 0 {
+		return 0, c.Errf("%s must be an integer greater than 0, got '%s'", name, c.Val())
+	}
+	if c.NextArg() {
+		return 0, c.ArgErr()
+	}
+	return uint32(ttl), nil
+}
+
+// parseRateLimit parses a rate in the form N/UNIT, e.g. 500/s or 100/10s, into
+// a token bucket allowing bursts of up to N events.
+func parseRateLimit(s string) (*rate.Limiter, error) {
+	count, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return nil, fmt.Errorf("expected the form N/UNIT")
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("count must be an integer greater than 0")
+	}
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("unit must be a duration greater than 0")
+	}
+	return rate.NewLimiter(rate.Limit(float64(n)/d.Seconds()), n), nil
+}
@@ -4,9 +4,16 @@
 package finalize
 
 import (
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/pkg/upstream"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
 )
 
 // TestSetup tests the various things that should be parsed by setup.
@@ -22,11 +29,16 @@ func TestSetup(t *testing.T) {
 		t.Fatalf("Expected errors, but got: %v", err)
 	}
 
-	c = caddy.NewTestController("dns", `finalize max_depth 0`)
+	c = caddy.NewTestController("dns", `finalize max_depth -1`)
 	if err := setup(c); err == nil {
 		t.Fatalf("Expected errors, but got: %v", err)
 	}
 
+	c = caddy.NewTestController("dns", `finalize max_lookup 0`)
+	if f, err := parse(c); err != nil || f.maxLookup.Load() != 0 {
+		t.Fatalf("Expected no limit, but got: %v", err)
+	}
+
 	c = caddy.NewTestController("dns", `finalize max_depth x`)
 	if err := setup(c); err == nil {
 		t.Fatalf("Expected errors, but got: %v", err)
@@ -37,3 +49,869 @@ func TestSetup(t *testing.T) {
 		t.Fatalf("Expected no errors, but got: %v", err)
 	}
 }
+
+func TestSetupInstances(t *testing.T) {
+	c := caddy.NewTestController("dns", "finalize_cname example.com {\n max_lookup 3\n}\nfinalize_cname {\n max_lookup 5\n}")
+	first, err := parse(c)
+	if err != nil || len(first.zones) != 1 || first.maxLookup.Load() != 3 {
+		t.Fatalf("Expected the first block scoped to example.com., got %v", err)
+	}
+	second, err := parse(c)
+	if err != nil || len(second.zones) != 0 || second.maxLookup.Load() != 5 {
+		t.Fatalf("Expected the second block with its own settings, got %v", err)
+	}
+	if f, err := parse(c); f != nil || err != nil {
+		t.Errorf("Expected no further block, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname example.com\nfinalize_cname example.net")
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if n := len(dnsserver.GetConfig(c).Plugin); n != 2 {
+		t.Errorf("Expected an instance for each block, got %d", n)
+	}
+}
+
+func TestSetupInstancesAdmin(t *testing.T) {
+	c := caddy.NewTestController("dns", "finalize_cname example.com {\n admin localhost:8053\n}\nfinalize_cname example.net {\n admin localhost:8054\n}")
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname example.com {\n admin localhost:8053\n}\nfinalize_cname example.net {\n admin localhost:8053\n}")
+	if err := setup(c); err == nil || !strings.Contains(err.Error(), "used by another block") {
+		t.Errorf("Expected an error for a shared admin address, got %v", err)
+	}
+}
+
+func TestSetupDuplicate(t *testing.T) {
+	c := caddy.NewTestController("dns", "finalize_cname example.com {\n except a.example.com\n max_lookup 5\n except b.example.com\n cache_size 10\n}")
+	if f, err := parse(c); err != nil || len(f.except) != 2 || f.maxLookup.Load() != 5 {
+		t.Errorf("Expected combined properties with a repeated except, got %v", err)
+	}
+
+	for _, input := range []string{
+		"finalize_cname {\n cache_size 10\n cache_size 20\n}",
+		"finalize_cname max_lookup 5 {\n cache_size 10\n max_lookup 3\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		_, err := parse(c)
+		if err == nil || !strings.Contains(err.Error(), "Testfile:") || !strings.Contains(err.Error(), "duplicate property") {
+			t.Errorf("Expected a duplicate property error at line 3 for %q, got %v", input, err)
+		}
+	}
+}
+
+func TestSetupZones(t *testing.T) {
+	c := caddy.NewTestController("dns", "finalize_cname example.com cdn.net {\n except sub.example.com\n}")
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !slices.Equal(f.zones, []string{"example.com.", "cdn.net."}) || !slices.Equal(f.except, []string{"sub.example.com."}) {
+		t.Errorf("Expected the zones and the exception, got %v and %v", f.zones, f.except)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname example.com")
+	if f, err := parse(c); err != nil || len(f.zones) != 1 {
+		t.Errorf("Expected a single zone, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n types A aaaa\n types HTTPS\n}")
+	if f, err := parse(c); err != nil || len(f.types) != 3 {
+		t.Errorf("Expected 3 types, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n clients 10.9.0.0/16 192.0.2.1\n except_clients 10.9.9.0/24\n}")
+	if f, err := parse(c); err != nil || len(f.clients) != 2 || len(f.exceptClients) != 1 {
+		t.Errorf("Expected the client networks, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n allow_targets corp\n deny_targets external.corp\n denied_action refused\n}")
+	if f, err := parse(c); err != nil || len(f.allowTargets) != 1 || len(f.denyTargets) != 1 || f.deniedAction != dns.RcodeRefused {
+		t.Errorf("Expected the target lists and the REFUSED action, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n deny_targets_regex \\.dyndns\\. ^ads\\.\n}")
+	if f, err := parse(c); err != nil || len(f.denyTargetPatterns) != 2 {
+		t.Errorf("Expected 2 target patterns, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n block_private\n block_private 100.64.0.0/10\n}")
+	if f, err := parse(c); err != nil || len(f.blockedNetworks) != len(privateNetworks)+1 {
+		t.Errorf("Expected the private networks and one more, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n allow_answer_networks 192.0.2.0/24 2001:db8::/32\n}")
+	if f, err := parse(c); err != nil || len(f.allowedNetworks) != 2 {
+		t.Errorf("Expected 2 allowed networks, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n when metadata('kubernetes/client-namespace') == 'legacy'\n when name() != 'a.example.com.'\n}")
+	if f, err := parse(c); err != nil || len(f.when) != 2 {
+		t.Errorf("Expected 2 when expressions, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n audit_log stdout\n}")
+	if f, err := parse(c); err != nil || f.audits == nil || f.audits.path != auditStdout {
+		t.Errorf("Expected an audit log to the standard output, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n on_error servfail\n}")
+	if f, err := parse(c); err != nil || f.onError != dns.RcodeServerFailure {
+		t.Errorf("Expected on_error servfail, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n on_dangling nodata\n}")
+	if f, err := parse(c); err != nil || f.onDangling != dns.RcodeSuccess {
+		t.Errorf("Expected on_dangling nodata, got %v", err)
+	}
+	if f, _ := parse(caddy.NewTestController("dns", "finalize_cname")); f.onDangling != danglingUpstream {
+		t.Errorf("Expected the rcode of the last lookup by default, got %d", f.onDangling)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n client_lookup_budget 50/s\n}")
+	if f, err := parse(c); err != nil || f.budget == nil || f.budget.limit != 50 || f.budget.burst != 50 {
+		t.Errorf("Expected a budget of 50/s, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n max_zones 3\n}")
+	if f, err := parse(c); err != nil || f.maxZones != 3 {
+		t.Errorf("Expected max zones 3, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n zone_label_limit 0\n}")
+	if f, err := parse(c); err != nil || f.zoneLabels.limit != 0 {
+		t.Errorf("Expected a zone label limit of 0, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n log_chains kv 0.1\n}")
+	if f, err := parse(c); err != nil || f.chainLog == nil || f.chainLog.format != chainLogKeyValue || f.chainLog.sample != 0.1 {
+		t.Errorf("Expected key=value chain logs of a tenth of the requests, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n log_level dangling debug\n log_limit 10\n}")
+	if f, err := parse(c); err != nil || f.events.levels[eventDangling] != levelDebug || f.events.limit != 10 {
+		t.Errorf("Expected dangling chains logged at debug level, 10 per minute, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n recent_chains 100\n}")
+	if f, err := parse(c); err != nil || f.recent == nil || len(f.recent.entries) != 100 {
+		t.Errorf("Expected the last 100 chains to be kept, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n health_error_rate 0.5 5m\n}")
+	if f, err := parse(c); err != nil || f.health == nil || f.health.maxErrorRate != 0.5 || f.health.window != 5*time.Minute {
+		t.Errorf("Expected unhealthy above an error rate of 0.5 over 5m, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n slow_chain_threshold 500ms\n}")
+	if f, err := parse(c); err != nil || f.slowChain != 500*time.Millisecond {
+		t.Errorf("Expected chains slower than 500ms to be logged, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n top_targets 20 10m\n}")
+	if f, err := parse(c); err != nil || f.top == nil || f.top.n != 20 || f.top.window != 10*time.Minute {
+		t.Errorf("Expected the top 20 targets over 10m, got %v", err)
+	}
+
+	for _, input := range []string{
+		"finalize_cname {\n top_targets\n}",
+		"finalize_cname {\n top_targets 0\n}",
+		"finalize_cname {\n top_targets 10 1s\n}",
+		"finalize_cname {\n top_targets 10 1h 2h\n}",
+		"finalize_cname {\n recent_chains\n}",
+		"finalize_cname {\n recent_chains 0\n}",
+		"finalize_cname {\n slow_chain_threshold\n}",
+		"finalize_cname {\n health_error_rate\n}",
+		"finalize_cname {\n health_error_rate 0\n}",
+		"finalize_cname {\n health_error_rate 1.5\n}",
+		"finalize_cname {\n health_error_rate 0.5 1s\n}",
+		"finalize_cname {\n slow_chain_threshold 0s\n}",
+		"finalize_cname {\n log_level dangling\n}",
+		"finalize_cname {\n log_level deadline error\n}",
+		"finalize_cname {\n log_level dangling fatal\n}",
+		"finalize_cname {\n log_limit 0\n}",
+		"finalize_cname {\n log_limit\n}",
+		"finalize_cname {\n log_chains xml\n}",
+		"finalize_cname {\n log_chains json 0\n}",
+		"finalize_cname {\n log_chains json 1.5\n}",
+		"finalize_cname {\n log_chains json 1 2\n}",
+		"finalize_cname {\n zone_label_limit\n}",
+		"finalize_cname {\n zone_label_limit -1\n}",
+		"finalize_cname {\n allow_answer_networks\n}",
+		"finalize_cname {\n rpz\n}",
+		"finalize_cname {\n max_zones\n}",
+		"finalize_cname {\n client_lookup_budget\n}",
+		"finalize_cname {\n on_error\n}",
+		"finalize_cname {\n when\n}",
+		"finalize_cname {\n audit_log\n}",
+		"finalize_cname {\n audit_log a.log b.log\n}",
+		"finalize_cname {\n when name(\n}",
+		"finalize_cname {\n on_dangling\n}",
+		"finalize_cname {\n on_dangling servfail\n}",
+		"finalize_cname {\n on_error ignore\n}",
+		"finalize_cname {\n on_error empty servfail\n}",
+		"finalize_cname {\n client_lookup_budget 50\n}",
+		"finalize_cname {\n max_zones 0\n}",
+		"finalize_cname {\n max_zones 2 3\n}",
+		"finalize_cname {\n rpz /nonexistent/db.rpz\n}",
+		"finalize_cname {\n block_private 10.0.0.0/64\n}",
+		"finalize_cname {\n allow_targets\n}",
+		"finalize_cname {\n deny_targets_regex\n}",
+		"finalize_cname {\n deny_targets_regex (\n}",
+		"finalize_cname {\n denied_action\n}",
+		"finalize_cname {\n denied_action servfail\n}",
+		"finalize_cname {\n denied_action refused nxdomain\n}",
+		"finalize_cname {\n clients\n}",
+		"finalize_cname {\n except_clients 10.9.0.0/64\n}",
+		"finalize_cname {\n types\n}",
+		"finalize_cname {\n types A BOGUS\n}",
+		"finalize_cname {\n except\n}",
+		"finalize_cname max_lookup 5 example.com",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected an error for %q", input)
+		}
+	}
+}
+
+func TestSetupTrailingArgs(t *testing.T) {
+	for _, input := range []string{
+		"finalize_cname {\n max_lookup 5 6\n}",
+		"finalize_cname {\n max_concurrent 5 6\n}",
+		"finalize_cname {\n lookup_rate_limit 500/s 1000/s\n}",
+		"finalize_cname {\n client_lookup_budget 50/s 100/s\n}",
+		"finalize_cname {\n max_addresses 2 3\n}",
+		"finalize_cname {\n lookup_timeout 1s 2s\n}",
+		"finalize_cname {\n deadline 1s 2s\n}",
+		"finalize_cname {\n stability_window 1m 2m\n}",
+		"finalize_cname {\n slow_chain_threshold 1s 2s\n}",
+		"finalize_cname {\n min_ttl 10 20\n}",
+		"finalize_cname {\n cache_size 100 200\n}",
+		"finalize_cname {\n cache_ttl_cap 1h 2h\n}",
+		"finalize_cname {\n negative_ttl 30s 1m\n}",
+		"finalize_cname {\n cache_key_prefix a: b:\n}",
+		"finalize_cname {\n cache_pool_size 4 8\n}",
+		"finalize_cname {\n health_check 1s 2s\n}",
+		"finalize_cname {\n max_fails 2 3\n}",
+		"finalize_cname {\n policy random sequential\n}",
+		"finalize_cname {\n tls_servername a.example b.example\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parse(c); err == nil || !strings.Contains(err.Error(), "Wrong argument count") {
+			t.Errorf("Expected an argument count error for %q, got %v", input, err)
+		}
+	}
+}
+
+func TestSetupTTLRange(t *testing.T) {
+	c := caddy.NewTestController("dns", "finalize_cname {\n min_ttl 60\n max_ttl 30\n}")
+	if _, err := parse(c); err == nil || !strings.Contains(err.Error(), "Testfile:") {
+		t.Errorf("Expected an error with the file and line, got %v", err)
+	}
+}
+
+func TestSetupUpstream(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		addr      string
+	}{
+		{"finalize_cname {\n upstream grpc://10.0.0.1:8443\n}", false, "10.0.0.1:8443"},
+		{"finalize_cname {\n upstream grpc://10.0.0.1\n}", false, "10.0.0.1:443"},
+		{"finalize_cname {\n upstream grpc://10.0.0.1\n tls_servername dns.example.com\n}", false, "10.0.0.1:443"},
+		{"finalize_cname {\n upstream 10.0.0.1\n}", false, "10.0.0.1:53"},
+		{"finalize_cname {\n upstream tls://10.0.0.1\n}", false, "10.0.0.1:853"},
+		{"finalize_cname {\n upstream\n}", true, ""},
+		{"finalize_cname {\n upstream grpc://10.0.0.1 grpc://10.0.0.2\n}", true, ""},
+		{"finalize_cname {\n upstream grpc://10.0.0.1 10.0.0.2\n}", true, ""},
+		{"finalize_cname {\n upstream https://10.0.0.1\n}", true, ""},
+		{"finalize_cname {\n upstream example.com\n}", true, ""},
+		{"finalize_cname {\n tls a b c d\n}", true, ""},
+		{"finalize_cname {\n unknown\n}", true, ""},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: expected no error but found one for input %s, got: %v", i, test.input, err)
+		}
+		addr := ""
+		switch r := f.Resolver.(type) {
+		case *grpcUpstream:
+			addr = r.addr
+		case *dnsUpstream:
+			addr = r.hosts[0].addr
+		default:
+			t.Fatalf("Test %d: expected an upstream to be configured, got %T", i, f.Resolver)
+		}
+		if addr != test.addr {
+			t.Errorf("Test %d: expected address %s, got %s", i, test.addr, addr)
+		}
+		f.OnShutdown()
+	}
+}
+
+func TestSetupRoute(t *testing.T) {
+	c := caddy.NewTestController("dns", `finalize_cname {
+		route consul. 10.1.1.1
+		route corp.example 10.2.2.2 10.2.2.3
+	}`)
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	table, ok := f.Resolver.(*routeTable)
+	if !ok {
+		t.Fatalf("Expected a route table, got %T", f.Resolver)
+	}
+	if _, ok := table.fallback.(*upstream.Upstream); !ok {
+		t.Errorf("Expected the default resolver as fallback, got %T", table.fallback)
+	}
+	if r := table.resolverFor("a.corp.example."); len(r.(*dnsUpstream).hosts) != 2 {
+		t.Errorf("Expected two upstream hosts for corp.example., got %+v", r)
+	}
+
+	for _, input := range []string{
+		"finalize_cname {\n route consul.\n}",
+		"finalize_cname {\n route consul. 10.1.1.1\n route consul. 10.1.1.2\n}",
+		"finalize_cname {\n route consul. foo\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected errors for input %s, but got none", input)
+		}
+	}
+}
+
+func TestSetupStabilityWindow(t *testing.T) {
+	c := caddy.NewTestController("dns", "finalize_cname {\n stability_window 30s\n}")
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if f.stability == nil || f.stability.window != 30*time.Second {
+		t.Errorf("Expected a stability window of 30s, got %+v", f.stability)
+	}
+
+	for _, input := range []string{
+		"finalize_cname {\n stability_window\n}",
+		"finalize_cname {\n stability_window 0s\n}",
+		"finalize_cname {\n stability_window soon\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected errors for input %s, but got none", input)
+		}
+	}
+}
+
+func TestSetupCache(t *testing.T) {
+	tests := []struct {
+		input  string
+		size   int
+		ttlCap time.Duration
+	}{
+		{"finalize_cname {\n cache_size 100\n}", 100, defaultCacheTTLCap},
+		{"finalize_cname {\n cache_ttl_cap 5m\n}", defaultCacheSize, 5 * time.Minute},
+		{"finalize_cname {\n cache_size 100\n cache_ttl_cap 5m\n}", 100, 5 * time.Minute},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parse(c)
+		if err != nil {
+			t.Fatalf("Test %d: expected no errors, but got: %v", i, err)
+		}
+		if f.cache == nil || f.cache.size != test.size || f.cache.ttlCap != test.ttlCap {
+			t.Errorf("Test %d: expected cache of size %d and TTL cap %v, got %+v", i, test.size, test.ttlCap, f.cache)
+		}
+	}
+
+	c := caddy.NewTestController("dns", "finalize_cname")
+	if f, _ := parse(c); f.cache != nil || f.negative != nil {
+		t.Errorf("Expected no cache by default")
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n serve_stale\n}")
+	if f, err := parse(c); err != nil || f.cache == nil || f.cache.staleFor != defaultStaleFor {
+		t.Errorf("Expected serve_stale to enable the cache, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n cache_size 10\n serve_stale 5m\n}")
+	if f, err := parse(c); err != nil || f.cache.staleFor != 5*time.Minute {
+		t.Errorf("Expected serve_stale of 5m, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n prefetch 5 20%\n}")
+	if f, err := parse(c); err != nil || f.cache == nil || f.cache.prefetchHits != 5 || f.cache.prefetchWindow != defaultPrefetchWindow || f.cache.prefetchPercentage != 20 {
+		t.Errorf("Expected prefetch of 5 hits within 1m at 20%%, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n cache_hops\n}")
+	if f, err := parse(c); err != nil || f.cache == nil || f.hops == nil {
+		t.Errorf("Expected a hop cache, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n cache_backend redis 127.0.0.1:6379\n cache_key_prefix edge:\n cache_pool_size 5\n}")
+	if f, err := parse(c); err != nil || f.cache == nil || f.cache.shared == nil || f.cache.sharedPrefix != "edge:" {
+		t.Errorf("Expected a shared cache with prefix edge:, got %v", err)
+	} else {
+		f.OnShutdown()
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n cache_snapshot /var/lib/coredns/finalize 1m\n}")
+	if f, err := parse(c); err != nil || f.cache == nil || f.snapshot == nil || f.snapshot.path != "/var/lib/coredns/finalize" || f.snapshot.interval != time.Minute {
+		t.Errorf("Expected a cache snapshot every 1m, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n cache_size 10\n admin localhost:8054\n}")
+	if f, err := parse(c); err != nil || f.admin == nil || f.admin.addr != "localhost:8054" || f.health == nil {
+		t.Errorf("Expected an admin server on localhost:8054, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n admin localhost:8054 secret\n}")
+	if f, err := parse(c); err != nil || f.admin == nil || f.admin.token != "secret" {
+		t.Errorf("Expected an admin server with a token, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n flatten\n}")
+	if f, err := parse(c); err != nil || !f.flatten {
+		t.Errorf("Expected flatten mode, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n minimal\n}")
+	if f, err := parse(c); err != nil || !f.minimal {
+		t.Errorf("Expected minimal mode, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n harmonize_ttl all\n}")
+	if f, err := parse(c); err != nil || !f.harmonizeTTL || !f.harmonizeAll {
+		t.Errorf("Expected TTLs of all records to be harmonized, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n min_ttl 30\n max_ttl 300\n}")
+	if f, err := parse(c); err != nil || f.minTTL != 30 || f.maxTTL != 300 {
+		t.Errorf("Expected TTLs bounded to 30 and 300, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n address_order random 42\n}")
+	if f, err := parse(c); err != nil || f.addressOrder == nil {
+		t.Errorf("Expected a random address order, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n max_addresses 8\n}")
+	if f, err := parse(c); err != nil || f.maxAddresses != 8 {
+		t.Errorf("Expected at most 8 addresses, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n merge_sections\n}")
+	if f, err := parse(c); err != nil || !f.mergeSections {
+		t.Errorf("Expected sections to be merged, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n map suffix external-cdn.com. internal-cdn.corp.\n map regex ^(.*)\\.edge\\.example\\.net\\.$ $1.origin.corp.\n}")
+	if f, err := parse(c); err != nil || len(f.targetMap) != 2 {
+		t.Errorf("Expected 2 target rules, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n svcb_alias hints\n}")
+	if f, err := parse(c); err != nil || !f.svcbAlias || !f.svcbHints {
+		t.Errorf("Expected alias following with hints, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n marker\n}")
+	if f, err := parse(c); err != nil || f.marker != defaultMarkerCode {
+		t.Errorf("Expected the default marker, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n marker 65001\n}")
+	if f, err := parse(c); err != nil || f.marker != 65001 {
+		t.Errorf("Expected marker 65001, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n validate\n}")
+	if f, err := parse(c); err != nil || !f.validate {
+		t.Errorf("Expected validate mode, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n dual\n}")
+	if f, err := parse(c); err != nil || !f.dual {
+		t.Errorf("Expected dual answers, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n srv_additional\n}")
+	if f, err := parse(c); err != nil || !f.srvAdditional {
+		t.Errorf("Expected SRV additional addresses, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n mx_additional\n}")
+	if f, err := parse(c); err != nil || !f.mxAdditional || f.srvAdditional {
+		t.Errorf("Expected MX additional addresses only, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n rcode_passthrough\n}")
+	if f, err := parse(c); err != nil || !f.rcodePassthrough {
+		t.Errorf("Expected rcode passthrough, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n cache_interop\n}")
+	if f, err := parse(c); err != nil || !f.cacheInterop {
+		t.Errorf("Expected cache interop mode, got %v", err)
+	}
+
+	c = caddy.NewTestController("dns", "finalize_cname {\n negative_ttl 10s\n}")
+	if f, err := parse(c); err != nil || f.negative == nil || f.negative.ttl != 10*time.Second {
+		t.Errorf("Expected a negative TTL of 10s, got %v", err)
+	}
+
+	for _, input := range []string{
+		"finalize_cname {\n cache_size\n}",
+		"finalize_cname {\n cache_size 0\n}",
+		"finalize_cname {\n cache_ttl_cap -1s\n}",
+		"finalize_cname {\n negative_ttl\n}",
+		"finalize_cname {\n serve_stale 0s\n}",
+		"finalize_cname {\n serve_stale 1m 1m\n}",
+		"finalize_cname {\n prefetch\n}",
+		"finalize_cname {\n prefetch 0\n}",
+		"finalize_cname {\n prefetch 5 1m 120%\n}",
+		"finalize_cname {\n prefetch 5 soon\n}",
+		"finalize_cname {\n cache_hops yes\n}",
+		"finalize_cname {\n cache_interop yes\n}",
+		"finalize_cname {\n flatten yes\n}",
+		"finalize_cname {\n minimal yes\n}",
+		"finalize_cname {\n harmonize_ttl some\n}",
+		"finalize_cname {\n harmonize_ttl all all\n}",
+		"finalize_cname {\n min_ttl\n}",
+		"finalize_cname {\n min_ttl 0\n}",
+		"finalize_cname {\n max_ttl 1m\n}",
+		"finalize_cname {\n min_ttl 300\n max_ttl 30\n}",
+		"finalize_cname {\n address_order\n}",
+		"finalize_cname {\n address_order sequential\n}",
+		"finalize_cname {\n address_order round_robin 42\n}",
+		"finalize_cname {\n address_order random seed\n}",
+		"finalize_cname {\n max_addresses\n}",
+		"finalize_cname {\n max_addresses 0\n}",
+		"finalize_cname {\n merge_sections all\n}",
+		"finalize_cname {\n rcode_passthrough yes\n}",
+		"finalize_cname {\n svcb_alias all\n}",
+		"finalize_cname {\n marker 10\n}",
+		"finalize_cname {\n marker local\n}",
+		"finalize_cname {\n marker 65501\n}",
+		"finalize_cname {\n marker 65001 65002\n}",
+		"finalize_cname {\n validate strict\n}",
+		"finalize_cname {\n dual yes\n}",
+		"finalize_cname {\n srv_additional yes\n}",
+		"finalize_cname {\n mx_additional yes\n}",
+		"finalize_cname {\n map suffix example.com.\n}",
+		"finalize_cname {\n map exact a.example.com. b.example.com.\n}",
+		"finalize_cname {\n map regex ( b.example.com.\n}",
+		"finalize_cname {\n cache_backend redis\n}",
+		"finalize_cname {\n cache_backend etcd 127.0.0.1:2379\n}",
+		"finalize_cname {\n cache_pool_size 0\n}",
+		"finalize_cname {\n cache_key_prefix\n}",
+		"finalize_cname {\n cache_snapshot\n}",
+		"finalize_cname {\n admin\n}",
+		"finalize_cname {\n admin localhost\n}",
+		"finalize_cname {\n admin localhost:8054 secret more\n}",
+		"finalize_cname {\n cache_snapshot /tmp/finalize 0s\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected errors for input %s, but got none", input)
+		}
+	}
+}
+
+func TestCheckCacheOrder(t *testing.T) {
+	tests := []struct {
+		directives []string
+		enabled    bool
+		wantErr    bool
+	}{
+		{[]string{"cache", pluginName, "forward"}, true, false},
+		{[]string{pluginName, "cache", "forward"}, true, true},
+		{[]string{"cache", pluginName, "forward"}, false, true},
+		{[]string{pluginName, "forward"}, true, true},
+	}
+
+	for i, tc := range tests {
+		err := checkCacheOrder(tc.directives, tc.enabled)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Test %d: expected error %v, got %v", i, tc.wantErr, err)
+		}
+	}
+}
+
+func TestSetupHealthCheck(t *testing.T) {
+	c := caddy.NewTestController("dns", `finalize_cname {
+		upstream 10.0.0.1 10.0.0.2
+		max_fails 5
+		health_check 1s
+		policy round_robin
+	}`)
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	defer f.OnShutdown()
+	u, ok := f.Resolver.(*dnsUpstream)
+	if !ok {
+		t.Fatalf("Expected a DNS upstream, got %T", f.Resolver)
+	}
+	if u.maxFails != 5 || len(u.hosts) != 2 {
+		t.Errorf("Expected max_fails 5 and 2 hosts, got %d and %d", u.maxFails, len(u.hosts))
+	}
+	if u.policy.String() != "round_robin" {
+		t.Errorf("Expected round_robin policy, got %s", u.policy)
+	}
+
+	for _, input := range []string{
+		"finalize_cname {\n max_fails\n}",
+		"finalize_cname {\n max_fails -1\n}",
+		"finalize_cname {\n health_check 0s\n}",
+		"finalize_cname {\n health_check often\n}",
+		"finalize_cname {\n policy\n}",
+		"finalize_cname {\n policy fastest\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected errors for input %s, but got none", input)
+		}
+	}
+}
+
+func TestSetupTimeouts(t *testing.T) {
+	c := caddy.NewTestController("dns", "finalize_cname {\n lookup_timeout 250ms\n deadline 1500ms\n}")
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if f.lookupTimeout != 250*time.Millisecond {
+		t.Errorf("Expected a lookup timeout of 250ms, got %v", f.lookupTimeout)
+	}
+	if f.deadline != 1500*time.Millisecond {
+		t.Errorf("Expected a deadline of 1.5s, got %v", f.deadline)
+	}
+
+	for _, input := range []string{
+		"finalize_cname {\n lookup_timeout\n}",
+		"finalize_cname {\n lookup_timeout -1s\n}",
+		"finalize_cname {\n lookup_timeout 1\n}",
+		"finalize_cname {\n deadline\n}",
+		"finalize_cname {\n deadline 0s\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected errors for input %s, but got none", input)
+		}
+	}
+}
+
+func TestSetupCircuitBreaker(t *testing.T) {
+	c := caddy.NewTestController("dns", "finalize_cname {\n circuit_breaker 5 30s\n}")
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if f.breaker == nil || f.breaker.threshold != 5 || f.breaker.cooldown != 30*time.Second {
+		t.Errorf("Expected a circuit breaker opening after 5 failures for 30s, got %+v", f.breaker)
+	}
+
+	for _, input := range []string{
+		"finalize_cname {\n circuit_breaker\n}",
+		"finalize_cname {\n circuit_breaker 5\n}",
+		"finalize_cname {\n circuit_breaker 0 30s\n}",
+		"finalize_cname {\n circuit_breaker 5 0s\n}",
+		"finalize_cname {\n circuit_breaker 5 30s 1\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected errors for input %s, but got none", input)
+		}
+	}
+}
+
+func TestSetupMaxConcurrent(t *testing.T) {
+	c := caddy.NewTestController("dns", "finalize_cname {\n max_concurrent 100\n}")
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if cap(f.sem) != 100 {
+		t.Errorf("Expected max_concurrent 100, got %d", cap(f.sem))
+	}
+
+	for _, input := range []string{
+		"finalize_cname {\n max_concurrent\n}",
+		"finalize_cname {\n max_concurrent 0\n}",
+		"finalize_cname {\n max_concurrent many\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected errors for input %s, but got none", input)
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		limit     rate.Limit
+		burst     int
+	}{
+		{"500/s", false, 500, 500},
+		{"30/m", false, 0.5, 30},
+		{"100/10s", false, 10, 100},
+		{"500", true, 0, 0},
+		{"0/s", true, 0, 0},
+		{"x/s", true, 0, 0},
+		{"5/fortnight", true, 0, 0},
+		{"5/", true, 0, 0},
+	}
+
+	for i, test := range tests {
+		l, err := parseRateLimit(test.input)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: expected no error for input %s, got: %v", i, test.input, err)
+		}
+		if l.Limit() != test.limit || l.Burst() != test.burst {
+			t.Errorf("Test %d: expected limit %v and burst %d, got %v and %d", i, test.limit, test.burst, l.Limit(), l.Burst())
+		}
+	}
+}
+
+func TestSetupECS(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		v4, v6    uint8
+	}{
+		{"finalize_cname {\n ecs\n}", false, 24, 56},
+		{"finalize_cname {\n ecs 20\n}", false, 20, 56},
+		{"finalize_cname {\n ecs 32 64\n}", false, 32, 64},
+		{"finalize_cname {\n ecs 33\n}", true, 0, 0},
+		{"finalize_cname {\n ecs 24 129\n}", true, 0, 0},
+		{"finalize_cname {\n ecs 24 56 1\n}", true, 0, 0},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: expected no error for input %s, got: %v", i, test.input, err)
+		}
+		if f.ecs.v4Prefix != test.v4 || f.ecs.v6Prefix != test.v6 {
+			t.Errorf("Test %d: expected prefixes %d and %d, got %d and %d", i, test.v4, test.v6, f.ecs.v4Prefix, f.ecs.v6Prefix)
+		}
+	}
+}
+
+func TestSetupEDNS0Passthrough(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		codes     []uint16
+	}{
+		{"finalize_cname {\n upstream 10.0.0.1\n}", false, []uint16{dns.EDNS0SUBNET}},
+		{"finalize_cname {\n upstream 10.0.0.1\n edns0_passthrough ECS COOKIE 65001\n}", false, []uint16{dns.EDNS0SUBNET, dns.EDNS0COOKIE, 65001}},
+		{"finalize_cname {\n upstream 10.0.0.1\n edns0_passthrough none\n}", false, nil},
+		{"finalize_cname {\n edns0_passthrough\n}", true, nil},
+		{"finalize_cname {\n edns0_passthrough FOO\n}", true, nil},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: expected no error for input %s, got: %v", i, test.input, err)
+		}
+		if got := f.Resolver.(*dnsUpstream).ednsOptions; !slices.Equal(got, test.codes) {
+			t.Errorf("Test %d: expected options %v, got %v", i, test.codes, got)
+		}
+		f.OnShutdown()
+	}
+}
+
+func TestSetupTransportKnobs(t *testing.T) {
+	c := caddy.NewTestController("dns", "finalize_cname {\n upstream 10.0.0.1\n force_tcp\n prefer_udp\n cookies\n randomize_case\n}")
+	f, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	defer f.OnShutdown()
+	u := f.Resolver.(*dnsUpstream)
+	if !u.forceTCP || !u.preferUDP {
+		t.Errorf("Expected force_tcp and prefer_udp to be set, got %v and %v", u.forceTCP, u.preferUDP)
+	}
+	if u.hosts[0].cookies == nil {
+		t.Errorf("Expected cookies to be enabled")
+	}
+	if !u.randomizeCase {
+		t.Errorf("Expected randomize_case to be set")
+	}
+
+	for _, input := range []string{
+		"finalize_cname {\n force_tcp yes\n}",
+		"finalize_cname {\n cookies yes\n}",
+		"finalize_cname {\n randomize_case yes\n}",
+		"finalize_cname {\n prefer_udp yes\n}",
+	} {
+		c := caddy.NewTestController("dns", input)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected errors for input %s, but got none", input)
+		}
+	}
+}
+
+func TestSetupBind(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"finalize_cname {\n upstream 10.0.0.1\n bind 127.0.0.1\n}", false},
+		{"finalize_cname {\n upstream 10.0.0.1\n bind lo\n}", false},
+		{"finalize_cname {\n bind\n}", true},
+		{"finalize_cname {\n bind 127.0.0.1 ::1\n}", true},
+		{"finalize_cname {\n bind example.org\n}", true},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		f, err := parse(c)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: expected error %v, got %v", i, test.shouldErr, err)
+		}
+		if err == nil {
+			f.OnShutdown()
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package finalize
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// defaultSharedPrefix is the prefix of the keys stored in a shared cache.
+	defaultSharedPrefix = "finalize_cname:"
+	// defaultSharedPoolSize is the number of connections kept to a shared cache.
+	defaultSharedPoolSize = 10
+	// sharedTimeout bounds each operation on a shared cache.
+	sharedTimeout = 100 * time.Millisecond
+)
+
+// sharedStore is a cache of resolved chains shared by several CoreDNS
+// instances. A missing key is reported by a nil value without an error.
+type sharedStore interface {
+	get(ctx context.Context, key string) ([]byte, error)
+	set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Close() error
+}
+
+// sharedOptions holds the settings of a shared cache.
+type sharedOptions struct {
+	backend  string
+	addrs    []string
+	prefix   string
+	poolSize int
+}
+
+// newSharedStore returns the shared store for the backend of opts, which is
+// either redis or memcached.
+func newSharedStore(opts sharedOptions) (sharedStore, error) {
+	switch opts.backend {
+	case "redis":
+		return &redisStore{client: redis.NewUniversalClient(&redis.UniversalOptions{
+			Addrs:        opts.addrs,
+			PoolSize:     opts.poolSize,
+			ReadTimeout:  sharedTimeout,
+			WriteTimeout: sharedTimeout,
+		})}, nil
+	case "memcached":
+		client := memcache.New(opts.addrs...)
+		client.Timeout = sharedTimeout
+		client.MaxIdleConns = opts.poolSize
+		return &memcachedStore{client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown cache backend: %s", opts.backend)
+}
+
+type redisStore struct {
+	client redis.UniversalClient
+}
+
+func (r *redisStore) get(ctx context.Context, key string) ([]byte, error) {
+	b, err := r.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return b, err
+}
+
+func (r *redisStore) set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return r.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (r *redisStore) Close() error { return r.client.Close() }
+
+type memcachedStore struct {
+	client *memcache.Client
+}
+
+func (m *memcachedStore) get(_ context.Context, key string) ([]byte, error) {
+	item, err := m.client.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
+func (m *memcachedStore) set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	return m.client.Set(&memcache.Item{Key: key, Value: value, Expiration: int32(ttl.Seconds())})
+}
+
+func (m *memcachedStore) Close() error { return m.client.Close() }
+
+// sharedKey returns the key of a chain in a shared cache, resolved in the
+// view named view, if any. The key consists of printable characters only, as
+// required by memcached.
+func sharedKey(prefix, view string, key cacheKey) string {
+	if view != "" {
+		prefix += view + ":"
+	}
+	if key.do {
+		return fmt.Sprintf("%s%s/%d/%s/do", prefix, key.name, key.qtype, key.ecs)
+	}
+	return fmt.Sprintf("%s%s/%d/%s", prefix, key.name, key.qtype, key.ecs)
+}
+
+// encodeChain encodes rrs, stored at the given time, for a shared cache.
+func encodeChain(rrs []dns.RR, stored time.Time) ([]byte, error) {
+	m := new(dns.Msg)
+	m.Answer = rrs
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	return append(binary.BigEndian.AppendUint64(nil, uint64(stored.Unix())), packed...), nil
+}
+
+// decodeChain decodes a chain read from a shared cache, decreasing the TTLs of
+// its records by the time passed since it was stored.
+func decodeChain(b []byte, now time.Time) ([]dns.RR, error) {
+	if len(b) < 8 {
+		return nil, errors.New("short cache entry")
+	}
+	stored := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	m := new(dns.Msg)
+	if err := m.Unpack(b[8:]); err != nil {
+		return nil, err
+	}
+
+	elapsed := uint32(now.Sub(stored).Seconds())
+	for _, rr := range m.Answer {
+		if rr.Header().Ttl <= elapsed {
+			return nil, errors.New("expired cache entry")
+		}
+		rr.Header().Ttl -= elapsed
+	}
+	return m.Answer, nil
+}
+
+// viewName returns the name of the view the request of ctx was routed to by
+// the view plugin, empty if none.
+func viewName(ctx context.Context) string {
+	name, _ := ctx.Value(dnsserver.ViewKey{}).(string)
+	return name
+}
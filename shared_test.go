@@ -0,0 +1,148 @@
+package finalize
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// mapStore is a sharedStore keeping its entries in memory, ignoring TTLs.
+type mapStore struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func (m *mapStore) get(_ context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entries[key], nil
+}
+
+func (m *mapStore) set(_ context.Context, key string, value []byte, _ time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = value
+	return nil
+}
+
+func (m *mapStore) Close() error { return nil }
+
+func (m *mapStore) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+func TestEncodeChain(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rrs := []dns.RR{
+		plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com."),
+		plugintest.A("c.example.com. 60 IN A 192.0.2.1"),
+	}
+
+	b, err := encodeChain(rrs, now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	decoded, err := decodeChain(b, now.Add(10*time.Second))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !sameRRset(decoded, rrs) {
+		t.Errorf("Expected %v, got %v", rrs, decoded)
+	}
+	if decoded[1].Header().Ttl != 50 {
+		t.Errorf("Expected TTL 50, got %d", decoded[1].Header().Ttl)
+	}
+
+	if _, err := decodeChain(b, now.Add(time.Minute)); err == nil {
+		t.Errorf("Expected an error for an expired entry")
+	}
+	if _, err := decodeChain(b[:4], now); err == nil {
+		t.Errorf("Expected an error for a short entry")
+	}
+}
+
+func TestServeDNSSharedCache(t *testing.T) {
+	store := &mapStore{entries: make(map[string][]byte)}
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 60 IN A 192.0.2.1")},
+	}}
+
+	newFinalize := func() *Finalize {
+		f := New()
+		f.Resolver = resolver
+		f.cache = newChainCache(10, time.Minute)
+		f.cache.shared = store
+		f.cache.sharedPrefix = defaultSharedPrefix
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+		return f
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	if _, err := newFinalize().ServeDNS(context.Background(), dnstest.NewRecorder(&plugintest.ResponseWriter{}), req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for i := 0; i < 100 && store.len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b, _ := store.get(context.Background(), defaultSharedPrefix+"b.example.com./1/"); b == nil {
+		t.Fatalf("Expected the chain to be written to the shared cache, got %v", store.entries)
+	}
+
+	// another instance with an empty local cache
+	f := newFinalize()
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(rec.Msg.Answer) != 2 {
+		t.Fatalf("Expected 2 answers, got %v", rec.Msg.Answer)
+	}
+	if len(resolver.lookups) != 1 {
+		t.Errorf("Expected the chain to be served from the shared cache, got lookups %v", resolver.lookups)
+	}
+	if f.cache.len() != 1 {
+		t.Errorf("Expected the chain to be stored in the local cache")
+	}
+}
+
+func TestNewSharedStore(t *testing.T) {
+	for _, backend := range []string{"redis", "memcached"} {
+		store, err := newSharedStore(sharedOptions{backend: backend, addrs: []string{"127.0.0.1:1"}, poolSize: 1})
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got %v", backend, err)
+		}
+		if _, err := store.get(context.Background(), "key"); err == nil {
+			t.Errorf("Expected an error for an unreachable %s server", backend)
+		}
+		store.Close()
+	}
+
+	if _, err := newSharedStore(sharedOptions{backend: "etcd"}); err == nil {
+		t.Errorf("Expected an error for an unknown backend")
+	}
+}
+
+func TestSharedKey(t *testing.T) {
+	key := cacheKey{name: "a.example.com.", qtype: dns.TypeA}
+	if got := sharedKey("p:", "", key); got != "p:a.example.com./1/" {
+		t.Errorf("Unexpected key %s", got)
+	}
+	if got := sharedKey("p:", "internal", key); got != "p:internal:a.example.com./1/" {
+		t.Errorf("Unexpected key %s with a view", got)
+	}
+
+	ctx := context.WithValue(context.Background(), dnsserver.ViewKey{}, "internal")
+	if viewName(ctx) != "internal" || viewName(context.Background()) != "" {
+		t.Errorf("Expected the view of the context")
+	}
+}
@@ -0,0 +1,143 @@
+package finalize
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultSnapshotInterval is the interval at which the cache is written to disk.
+const defaultSnapshotInterval = 5 * time.Minute
+
+// snapshotEntry is a cached chain as written to a snapshot file.
+type snapshotEntry struct {
+	Name  string
+	Qtype uint16
+	ECS   string
+	Scope uint8
+	DO    bool
+	// Chain holds the records as encoded by encodeChain.
+	Chain []byte
+}
+
+// snapshotter periodically writes the cache to a file, so that it can be
+// loaded again after a restart.
+type snapshotter struct {
+	path     string
+	interval time.Duration
+	cache    *chainCache
+
+	// loaded is set once the snapshot file has been loaded, or failed to.
+	loaded atomic.Bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// start loads the snapshot file, if it exists, and starts writing the cache
+// to it every interval.
+func (s *snapshotter) start() {
+	n, err := s.cache.load(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warningf("Failed to load cache snapshot %s: %v", s.path, err)
+	} else if err == nil {
+		log.Infof("Loaded %d chains from cache snapshot %s", n, s.path)
+	}
+	s.loaded.Store(true)
+
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		tick := time.NewTicker(s.interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				if err := s.cache.save(s.path); err != nil {
+					log.Warningf("Failed to write cache snapshot %s: %v", s.path, err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// shutdown stops the periodic writes and writes the cache a last time.
+func (s *snapshotter) shutdown() error {
+	if s.stop == nil {
+		return nil
+	}
+	close(s.stop)
+	s.wg.Wait()
+	s.stop = nil
+	return s.cache.save(s.path)
+}
+
+// save writes the entries of the cache that have not expired to path. The
+// file is replaced atomically.
+func (c *chainCache) save(path string) error {
+	now := c.now()
+
+	c.mu.Lock()
+	entries := make([]snapshotEntry, 0, c.ll.Len())
+	// oldest first, so that loading the snapshot restores the LRU order
+	for el := c.ll.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*cacheEntry)
+		if !now.Before(e.expires) {
+			continue
+		}
+		b, err := encodeChain(e.rrs, e.stored)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, snapshotEntry{Name: e.key.name, Qtype: e.key.qtype, ECS: e.key.ecs, Scope: e.key.scope, DO: e.key.do, Chain: b})
+	}
+	c.mu.Unlock()
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := gob.NewEncoder(f).Encode(entries); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// load adds the entries of the snapshot at path that have not expired to the
+// cache and returns their number.
+func (c *chainCache) load(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var entries []snapshotEntry
+	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+		return 0, err
+	}
+
+	now := c.now()
+	n := 0
+	for _, e := range entries {
+		rrs, err := decodeChain(e.Chain, now)
+		if err != nil {
+			continue
+		}
+		c.add(cacheKey{name: e.Name, qtype: e.Qtype, ecs: e.ECS, scope: e.Scope, do: e.DO}, rrs)
+		n++
+	}
+	return n, nil
+}
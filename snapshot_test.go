@@ -0,0 +1,67 @@
+package finalize
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestChainCacheSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	now := time.Unix(1000, 0)
+
+	c := newChainCache(10, time.Hour)
+	c.now = func() time.Time { return now }
+	short := cacheKey{name: "a.example.com.", qtype: dns.TypeA}
+	long := cacheKey{name: "b.example.com.", qtype: dns.TypeA, ecs: "192.0.2.0/24"}
+	c.add(short, []dns.RR{plugintest.A("a.example.com. 10 IN A 192.0.2.1")})
+	c.add(long, []dns.RR{plugintest.A("b.example.com. 300 IN A 192.0.2.2")})
+
+	if err := c.save(path); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	restored := newChainCache(10, time.Hour)
+	restored.now = func() time.Time { return now }
+	n, err := restored.load(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 chain to be loaded, got %d", n)
+	}
+	if _, ok := restored.get(short); ok {
+		t.Errorf("Expected the expired chain to be dropped")
+	}
+	rrs, ok := restored.get(long)
+	if !ok {
+		t.Fatalf("Expected the chain to be restored")
+	}
+	if rrs[0].Header().Ttl != 240 {
+		t.Errorf("Expected TTL 240, got %d", rrs[0].Header().Ttl)
+	}
+}
+
+func TestSnapshotter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+
+	c := newChainCache(10, time.Hour)
+	s := &snapshotter{path: path, interval: time.Hour, cache: c}
+	s.start()
+	c.add(cacheKey{name: "a.example.com.", qtype: dns.TypeA}, []dns.RR{plugintest.A("a.example.com. 300 IN A 192.0.2.1")})
+	if err := s.shutdown(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	restored := newChainCache(10, time.Hour)
+	s = &snapshotter{path: path, interval: time.Hour, cache: restored}
+	s.start()
+	defer s.shutdown()
+	if restored.len() != 1 {
+		t.Errorf("Expected the cache to be written on shutdown and loaded on startup")
+	}
+}
@@ -0,0 +1,142 @@
+package finalize
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxStabilityEntries is the number of questions whose records are remembered.
+const maxStabilityEntries = 10000
+
+// stabilityCache remembers the terminal records served for an alias, so that
+// the same records keep being served for the duration of the window even when
+// a new lookup returns a different set. At most size entries are kept, the
+// one used least recently is evicted first.
+type stabilityCache struct {
+	window time.Duration
+	size   int
+	now    func() time.Time
+
+	mu sync.Mutex
+	ll *list.List
+	// entries are keyed like the chain cache, by the question, the DO bit
+	// and the client subnet, so that signatures and geo-targeted records
+	// are only served to the clients they were resolved for.
+	entries map[cacheKey]*list.Element
+}
+
+type stabilityEntry struct {
+	key cacheKey
+	// target is the last target of the chain, owning the records.
+	target  string
+	rrs     []dns.RR
+	stored  time.Time
+	expires time.Time
+}
+
+func newStabilityCache(window time.Duration) *stabilityCache {
+	return &stabilityCache{
+		window:  window,
+		size:    maxStabilityEntries,
+		now:     time.Now,
+		ll:      list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// stabilize returns the terminal records of target to serve for key. If a
+// different set was served for the same target within the window and none of
+// its records have expired, that set is returned with its TTLs decreased by
+// the time passed. Otherwise rrs is remembered and returned as is.
+func (c *stabilityCache) stabilize(key cacheKey, target string, rrs []dns.RR) ([]dns.RR, bool) {
+	target = dns.CanonicalName(target)
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var e *stabilityEntry
+	el, ok := c.entries[key]
+	if ok {
+		e = el.Value.(*stabilityEntry)
+	}
+	if e != nil && e.target == target && e.valid(now, c.window) {
+		c.ll.MoveToFront(el)
+		if sameRRset(e.rrs, rrs) {
+			return rrs, false
+		}
+		elapsed := uint32(now.Sub(e.stored).Seconds())
+		stable := make([]dns.RR, len(e.rrs))
+		for i, rr := range e.rrs {
+			stable[i] = dns.Copy(rr)
+			stable[i].Header().Ttl -= elapsed
+		}
+		return stable, true
+	}
+
+	stored := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		stored[i] = dns.Copy(rr)
+	}
+	e = &stabilityEntry{
+		key:     key,
+		target:  target,
+		rrs:     stored,
+		stored:  now,
+		expires: now.Add(time.Duration(minTTL(rrs)) * time.Second),
+	}
+	if ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return rrs, false
+	}
+	c.entries[key] = c.ll.PushFront(e)
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*stabilityEntry).key)
+	}
+
+	return rrs, false
+}
+
+func (e *stabilityEntry) valid(now time.Time, window time.Duration) bool {
+	return now.Before(e.stored.Add(window)) && now.Before(e.expires)
+}
+
+// minTTL returns the lowest TTL found in rrs.
+func minTTL(rrs []dns.RR) uint32 {
+	if len(rrs) == 0 {
+		return 0
+	}
+	ttl := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+// sameRRset reports whether a and b hold the same records, ignoring TTLs and order.
+func sameRRset(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if dns.IsDuplicate(x, y) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
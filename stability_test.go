@@ -0,0 +1,123 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestStabilityCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newStabilityCache(30 * time.Second)
+	c.now = func() time.Time { return now }
+	key := cacheKey{name: "a.example.com.", qtype: dns.TypeA}
+
+	first := []dns.RR{plugintest.A("c.example.com. 60 IN A 192.0.2.1")}
+	second := []dns.RR{plugintest.A("c.example.com. 60 IN A 192.0.2.2")}
+
+	rrs, replaced := c.stabilize(key, "c.example.com.", first)
+	if replaced || rrs[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("Expected first answer to be served as is, got %v", rrs)
+	}
+
+	now = now.Add(10 * time.Second)
+	rrs, replaced = c.stabilize(key, "c.example.com.", second)
+	if !replaced || rrs[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("Expected first answer within the window, got %v", rrs)
+	}
+	if rrs[0].Header().Ttl != 50 {
+		t.Errorf("Expected TTL 50, got %d", rrs[0].Header().Ttl)
+	}
+
+	now = now.Add(25 * time.Second)
+	rrs, replaced = c.stabilize(key, "c.example.com.", second)
+	if replaced || rrs[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("Expected new answer after the window, got %v", rrs)
+	}
+}
+
+func TestStabilityCacheExpired(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newStabilityCache(time.Minute)
+	c.now = func() time.Time { return now }
+	key := cacheKey{name: "a.example.com.", qtype: dns.TypeA}
+
+	c.stabilize(key, "c.example.com.", []dns.RR{plugintest.A("c.example.com. 5 IN A 192.0.2.1")})
+
+	now = now.Add(10 * time.Second)
+	rrs, replaced := c.stabilize(key, "c.example.com.", []dns.RR{plugintest.A("c.example.com. 5 IN A 192.0.2.2")})
+	if replaced || rrs[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("Expected new answer once the old records expired, got %v", rrs)
+	}
+}
+
+func TestStabilityCacheSize(t *testing.T) {
+	c := newStabilityCache(time.Minute)
+	c.size = 2
+	rrs := []dns.RR{plugintest.A("c.example.com. 60 IN A 192.0.2.1")}
+	other := []dns.RR{plugintest.A("c.example.com. 60 IN A 192.0.2.2")}
+
+	for _, name := range []string{"a.example.com.", "b.example.com.", "a.example.com.", "d.example.com."} {
+		c.stabilize(cacheKey{name: name, qtype: dns.TypeA}, "c.example.com.", rrs)
+	}
+	if len(c.entries) != 2 || c.ll.Len() != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(c.entries))
+	}
+	if _, replaced := c.stabilize(cacheKey{name: "a.example.com.", qtype: dns.TypeA}, "c.example.com.", other); !replaced {
+		t.Error("Expected a recent entry to be kept")
+	}
+	if _, replaced := c.stabilize(cacheKey{name: "b.example.com.", qtype: dns.TypeA}, "c.example.com.", other); replaced {
+		t.Error("Expected the entry used least recently to be evicted")
+	}
+}
+
+func TestStabilityCacheKeys(t *testing.T) {
+	c := newStabilityCache(time.Minute)
+	key := cacheKey{name: "a.example.com.", qtype: dns.TypeA}
+	c.stabilize(key, "c.example.com.", []dns.RR{plugintest.A("c.example.com. 60 IN A 192.0.2.1")})
+
+	tests := []struct {
+		key    cacheKey
+		target string
+	}{
+		// the chain was re-pointed to another target
+		{key, "d.example.com."},
+		{cacheKey{name: "a.example.com.", qtype: dns.TypeA, do: true}, "c.example.com."},
+		{cacheKey{name: "a.example.com.", qtype: dns.TypeA, ecs: "198.51.100.0/24", scope: 24}, "c.example.com."},
+	}
+
+	for i, test := range tests {
+		rrs := []dns.RR{plugintest.A(test.target + " 60 IN A 192.0.2.2")}
+		if got, replaced := c.stabilize(test.key, test.target, rrs); replaced || got[0].(*dns.A).A.String() != "192.0.2.2" {
+			t.Errorf("Test %d: expected the records served as is, got %v", i, got)
+		}
+	}
+}
+
+func TestServeDNSStabilityRepointed(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+		"c.example.com.": {plugintest.A("c.example.com. 300 IN A 192.0.2.2")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.stability = newStabilityCache(time.Minute)
+
+	for _, target := range []string{"b.example.com.", "c.example.com."} {
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME " + target))
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(rec.Msg.Answer) != 2 || rec.Msg.Answer[1].Header().Name != target {
+			t.Errorf("Expected the records of %s, got %v", target, rec.Msg.Answer)
+		}
+	}
+}
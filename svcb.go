@@ -0,0 +1,202 @@
+package finalize
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// isServiceType reports whether qtype is HTTPS or SVCB.
+func isServiceType(qtype uint16) bool {
+	return qtype == dns.TypeHTTPS || qtype == dns.TypeSVCB
+}
+
+// svcbOf returns the SVCB data of rr if it is an HTTPS or SVCB record.
+func svcbOf(rr dns.RR) (*dns.SVCB, bool) {
+	switch rr := rr.(type) {
+	case *dns.SVCB:
+		return rr, true
+	case *dns.HTTPS:
+		return &rr.SVCB, true
+	}
+	return nil, false
+}
+
+// aliasTarget returns the target of the AliasMode record of rrs, i.e. of
+// priority 0, if rrs holds no records of type qtype in ServiceMode. An empty
+// string is returned otherwise, or if the target is the root, meaning that
+// the service does not exist.
+func aliasTarget(rrs []dns.RR, qtype uint16) string {
+	target := ""
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != qtype {
+			continue
+		}
+		svcb, ok := svcbOf(rr)
+		if !ok {
+			continue
+		}
+		if svcb.Priority != 0 {
+			return ""
+		}
+		target = svcb.Target
+	}
+	if target == "." {
+		return ""
+	}
+	return target
+}
+
+// serveAlias finalizes an HTTPS or SVCB answer in AliasMode.
+func (s *Finalize) serveAlias(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, response *dns.Msg) (int, error) {
+	log.Debugf("Finalizing alias for request: %+v", response)
+	s.recordRequest(ctx, w, r)
+	defer recordDuration(ctx, time.Now())
+
+	state := request.Request{W: w, Req: r}
+	rrs := make([]dns.RR, len(response.Answer))
+	copy(rrs, response.Answer)
+
+	followed, ok := s.followAliases(ctx, s.lookupState(state), rrs, rrs)
+	if !ok {
+		return s.writeResponse(w, response)
+	}
+	response.Authoritative = false
+	response.AuthenticatedData = false
+	response.Answer = followed
+	s.recordOutcome(ctx, w, r, outcomeFlattened)
+	return s.writeFinalized(ctx, w, state, response, outcomeFlattened)
+}
+
+// followAliases follows the AliasMode record of last, the records answering
+// the end of rrs, and appends the records resolved for its target to rrs,
+// until records in ServiceMode are found. If enabled, address hints are then
+// added to the records in ServiceMode. The records resolved so far are
+// returned if an alias target can not be resolved. The result reports whether
+// any record was added or changed; the AA and AD bits of an answer holding
+// them must be cleared, as they were not validated along with it.
+func (s *Finalize) followAliases(ctx context.Context, state request.Request, rrs, last []dns.RR) ([]dns.RR, bool) {
+	if !s.svcbAlias || !isServiceType(state.QType()) {
+		return rrs, false
+	}
+	n := len(rrs)
+
+	seen := make(map[string]struct{})
+	for target := aliasTarget(last, state.QType()); target != ""; target = aliasTarget(last, state.QType()) {
+		if _, ok := seen[dns.CanonicalName(target)]; ok {
+			circularReferenceCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+			s.events.logf(eventCircular, "Detected circular reference in alias chain. Target [%s] already processed", target)
+			return rrs, len(rrs) > n
+		}
+		if maxLookup := int(s.maxLookup.Load()); maxLookup > 0 && len(seen) >= maxLookup {
+			maxLookupReachedCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+			s.events.logf(eventMaxLookup, "Max lookup %d reached for resolving alias targets", maxLookup)
+			return rrs, len(rrs) > n
+		}
+		seen[dns.CanonicalName(target)] = struct{}{}
+
+		ch, err := s.resolveChain(ctx, state, target)
+		if err != nil {
+			log.Debugf("Failed to resolve alias target [%s]: %v", target, err)
+			return rrs, len(rrs) > n
+		}
+		rrs = s.appendResolved(rrs, ch.rrs)
+		last = ch.rrs
+	}
+
+	hinted := false
+	if s.svcbHints {
+		rrs, hinted = s.addHints(ctx, state, rrs)
+	}
+	return rrs, hinted || len(rrs) > n
+}
+
+// addHints adds the ipv4hint and ipv6hint parameters to the records of rrs in
+// ServiceMode that have none, with the addresses resolved for their target.
+// The signatures of the records are dropped if any hint is added, as they no
+// longer cover them. The result reports whether any hint was added.
+func (s *Finalize) addHints(ctx context.Context, state request.Request, rrs []dns.RR) ([]dns.RR, bool) {
+	hinted := make([]dns.RR, 0, len(rrs))
+	changed := false
+	for _, rr := range rrs {
+		svcb, ok := svcbOf(rr)
+		if !ok || rr.Header().Rrtype != state.QType() || svcb.Priority == 0 {
+			hinted = append(hinted, rr)
+			continue
+		}
+
+		target := svcb.Target
+		if target == "." {
+			target = svcb.Hdr.Name
+		}
+		var v4, v6 []net.IP
+		if !hasKey(svcb, dns.SVCB_IPV4HINT) {
+			v4 = s.resolveAddresses(ctx, state, target, dns.TypeA)
+		}
+		if !hasKey(svcb, dns.SVCB_IPV6HINT) {
+			v6 = s.resolveAddresses(ctx, state, target, dns.TypeAAAA)
+		}
+		if len(v4) == 0 && len(v6) == 0 {
+			hinted = append(hinted, rr)
+			continue
+		}
+
+		rr = dns.Copy(rr)
+		svcb, _ = svcbOf(rr)
+		if len(v4) > 0 {
+			svcb.Value = append(svcb.Value, &dns.SVCBIPv4Hint{Hint: v4})
+		}
+		if len(v6) > 0 {
+			svcb.Value = append(svcb.Value, &dns.SVCBIPv6Hint{Hint: v6})
+		}
+		hinted = append(hinted, rr)
+		changed = true
+	}
+	if !changed {
+		return rrs, false
+	}
+
+	unsigned := hinted[:0]
+	for _, rr := range hinted {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == state.QType() {
+			continue
+		}
+		unsigned = append(unsigned, rr)
+	}
+	return unsigned, true
+}
+
+// hasKey reports whether svcb has a parameter with key.
+func hasKey(svcb *dns.SVCB, key dns.SVCBKey) bool {
+	for _, kv := range svcb.Value {
+		if kv.Key() == key {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveAddresses returns the addresses of type qtype resolved for name,
+// following any CNAME chain.
+func (s *Finalize) resolveAddresses(ctx context.Context, state request.Request, name string, qtype uint16) []net.IP {
+	rrs, err := s.resolveType(ctx, state, name, qtype)
+	if err != nil {
+		log.Debugf("Failed to resolve address hints of [%s]: %v", name, err)
+		return nil
+	}
+
+	var ips []net.IP
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	return ips
+}
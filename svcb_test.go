@@ -0,0 +1,73 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func newRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("Failed to parse %q: %v", s, err)
+	}
+	return rr
+}
+
+func TestAliasTarget(t *testing.T) {
+	tests := []struct {
+		rrs  []string
+		want string
+	}{
+		{[]string{"a.example.com. 300 IN HTTPS 0 b.example.net."}, "b.example.net."},
+		{[]string{"a.example.com. 300 IN CNAME b.example.com.", "b.example.com. 300 IN HTTPS 0 c.example.net."}, "c.example.net."},
+		{[]string{"a.example.com. 300 IN HTTPS 0 ."}, ""},
+		{[]string{"a.example.com. 300 IN HTTPS 1 . alpn=h2"}, ""},
+		{[]string{"a.example.com. 300 IN SVCB 0 b.example.net."}, ""},
+	}
+
+	for i, tc := range tests {
+		var rrs []dns.RR
+		for _, s := range tc.rrs {
+			rrs = append(rrs, newRR(t, s))
+		}
+		if got := aliasTarget(rrs, dns.TypeHTTPS); got != tc.want {
+			t.Errorf("Test %d: expected %q, got %q", i, tc.want, got)
+		}
+	}
+}
+
+func TestServeDNSAlias(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.net.": {newRR(t, "b.example.net. 300 IN HTTPS 1 c.example.net. alpn=h2")},
+		"c.example.net.": {plugintest.A("c.example.net. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.svcbAlias = true
+	f.svcbHints = true
+	f.Next = cnameHandler(newRR(t, "a.example.com. 300 IN HTTPS 0 b.example.net."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeHTTPS)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(rec.Msg.Answer) != 2 {
+		t.Fatalf("Expected the alias and the service record, got %v", rec.Msg.Answer)
+	}
+	svcb, ok := svcbOf(rec.Msg.Answer[1])
+	if !ok || svcb.Priority != 1 || !hasKey(svcb, dns.SVCB_IPV4HINT) || hasKey(svcb, dns.SVCB_IPV6HINT) {
+		t.Errorf("Expected a service record with an ipv4hint, got %v", rec.Msg.Answer[1])
+	}
+	if resolver.answers["b.example.net."][0].(*dns.HTTPS).Value[0].Key() != dns.SVCB_ALPN || len(resolver.answers["b.example.net."][0].(*dns.HTTPS).Value) != 1 {
+		t.Errorf("Expected the upstream record to be left unmodified")
+	}
+}
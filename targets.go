@@ -0,0 +1,125 @@
+package finalize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+var (
+	// errDenied is returned for chains leading to a target that is not allowed.
+	errDenied = errors.New("target denied")
+	// errAddressDenied is returned for chains leading to an address that is
+	// not allowed.
+	errAddressDenied = errors.New("address denied")
+)
+
+// deniedActions maps the names accepted by denied_action to the rcode of the
+// answer, or answerOriginal.
+var deniedActions = map[string]int{
+	"original": answerOriginal,
+	"refused":  dns.RcodeRefused,
+	"nxdomain": dns.RcodeNameError,
+}
+
+// targetAllowed reports whether a chain may lead to name, according to
+// allow_targets, deny_targets and deny_targets_regex.
+func (s *Finalize) targetAllowed(name string) bool {
+	if len(s.allowTargets) > 0 && s.allowTargets.Matches(name) == "" {
+		return false
+	}
+	if s.denyTargets.Matches(name) != "" {
+		return false
+	}
+	if len(s.denyTargetPatterns) > 0 {
+		name = dns.CanonicalName(name)
+		for _, re := range s.denyTargetPatterns {
+			if re.MatchString(name) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkTarget returns an error if a chain may not lead to name, according to
+// targetAllowed and the response policy zone.
+func (s *Finalize) checkTarget(name string) error {
+	if !s.targetAllowed(name) {
+		return fmt.Errorf("%w: %s", errDenied, name)
+	}
+	if s.rpz != nil {
+		return s.rpz.check(name)
+	}
+	return nil
+}
+
+// checkTargets returns an error if the target of a CNAME of rrs is not
+// allowed.
+func (s *Finalize) checkTargets(rrs []dns.RR) error {
+	if len(s.allowTargets) == 0 && len(s.denyTargets) == 0 && len(s.denyTargetPatterns) == 0 && s.rpz == nil {
+		return nil
+	}
+	for _, rr := range rrs {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			if err := s.checkTarget(cname.Target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkAddresses returns an error if an A or AAAA record of rrs points outside
+// of the networks of allow_answer_networks.
+func (s *Finalize) checkAddresses(rrs []dns.RR) error {
+	if s.allowedNetworks == nil {
+		return nil
+	}
+	for _, rr := range rrs {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if !s.allowedNetworks.contains(ip) {
+			return fmt.Errorf("%w: %s", errAddressDenied, ip)
+		}
+	}
+	return nil
+}
+
+// writeDenied answers a request whose chain leads to a target or an address
+// that is not allowed as configured by denied_action: with the original
+// answer, or with the configured rcode and no answer. Targets blocked by the
+// response policy zone are answered as set by the matching rule instead.
+// Either way an Extended DNS Error tells that the chain was blocked.
+func (s *Finalize) writeDenied(ctx context.Context, w dns.ResponseWriter, state request.Request, response *dns.Msg, err error) (int, error) {
+	blockedChainCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	log.Infof("Not finalizing %s: %v", state.Name(), err)
+	s.audit(state, response, "blocked", err.Error())
+
+	rcode := s.deniedAction
+	var rpzErr *rpzError
+	if errors.As(err, &rpzErr) {
+		switch rpzErr.action {
+		case rpzDrop:
+			return dns.RcodeSuccess, nil
+		case rpzNoData:
+			rcode = dns.RcodeSuccess
+		default:
+			rcode = dns.RcodeNameError
+		}
+	}
+
+	return s.writeAction(w, state, response, rcode, dns.ExtendedErrorCodeBlocked, err.Error())
+}
@@ -0,0 +1,115 @@
+package finalize
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestTargetAllowed(t *testing.T) {
+	f := New()
+	f.allowTargets = plugin.Zones{"corp."}
+	f.denyTargets = plugin.Zones{"external.corp."}
+	f.denyTargetPatterns = []*regexp.Regexp{regexp.MustCompile(`\.dyndns\.`)}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a.corp.", true},
+		{"a.external.corp.", false},
+		{"a.example.com.", false},
+		{"a.dyndns.corp.", false},
+		{"A.DynDNS.corp.", false},
+	}
+	for i, tc := range tests {
+		if got := f.targetAllowed(tc.name); got != tc.want {
+			t.Errorf("Test %d: expected %v for %s, got %v", i, tc.want, tc.name, got)
+		}
+	}
+}
+
+func TestServeDNSDeniedTargets(t *testing.T) {
+	tests := []struct {
+		action    int
+		wantRcode int
+		wantRRs   int
+	}{
+		{answerOriginal, dns.RcodeSuccess, 1},
+		{dns.RcodeRefused, dns.RcodeRefused, 0},
+		{dns.RcodeNameError, dns.RcodeNameError, 0},
+	}
+
+	for i, tc := range tests {
+		// the chain leaves the internal zone at the second hop
+		resolver := &stubResolver{answers: map[string][]dns.RR{
+			"b.corp.":        {plugintest.CNAME("b.corp. 300 IN CNAME c.example.com.")},
+			"c.example.com.": {plugintest.A("c.example.com. 300 IN A 192.0.2.1")},
+		}}
+
+		f := New()
+		f.Resolver = resolver
+		f.denyTargets = plugin.Zones{"example.com."}
+		f.deniedAction = tc.action
+		f.Next = cnameHandler(plugintest.CNAME("a.corp. 300 IN CNAME b.corp."))
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.corp.", dns.TypeA)
+		req.SetEdns0(4096, false)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if len(resolver.lookups) != 1 {
+			t.Errorf("Test %d: expected the denied target not to be looked up, got %v", i, resolver.lookups)
+		}
+		if rec.Msg.Rcode != tc.wantRcode || len(rec.Msg.Answer) != tc.wantRRs {
+			t.Errorf("Test %d: expected rcode %s with %d records, got %v", i, dns.RcodeToString[tc.wantRcode], tc.wantRRs, rec.Msg)
+		}
+		if ede := edeOf(rec.Msg); ede == nil || ede.InfoCode != dns.ExtendedErrorCodeBlocked {
+			t.Errorf("Test %d: expected the Blocked EDE, got %v", i, ede)
+		}
+	}
+}
+
+func TestServeDNSAllowedNetworks(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantRRs int
+	}{
+		{"192.0.2.1", 2},
+		{"198.51.100.1", 0},
+	}
+
+	for i, tc := range tests {
+		resolver := &stubResolver{answers: map[string][]dns.RR{
+			"b.example.com.": {plugintest.A("b.example.com. 300 IN A " + tc.addr)},
+		}}
+
+		f := New()
+		f.Resolver = resolver
+		f.allowedNetworks, _ = parseNetworks([]string{"192.0.2.0/24", "2001:db8::/32"})
+		f.deniedAction = dns.RcodeRefused
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if len(rec.Msg.Answer) != tc.wantRRs {
+			t.Errorf("Test %d: expected %d records for %s, got %v", i, tc.wantRRs, tc.addr, rec.Msg)
+		}
+		if tc.wantRRs == 0 && rec.Msg.Rcode != dns.RcodeRefused {
+			t.Errorf("Test %d: expected REFUSED, got %s", i, dns.RcodeToString[rec.Msg.Rcode])
+		}
+	}
+}
@@ -0,0 +1,507 @@
+// Package test contains integration tests that run the plugin inside a
+// complete CoreDNS server.
+package test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/coredns/caddy"
+	_ "github.com/coredns/coredns/core" // Hook in CoreDNS.
+	"github.com/coredns/coredns/core/dnsserver"
+	_ "github.com/coredns/coredns/plugin/metrics"
+	_ "github.com/coredns/coredns/plugin/ready"
+	_ "github.com/hrko/coredns-finalize-cname"
+	"github.com/miekg/dns"
+)
+
+const pluginName = "finalize_cname"
+
+// records answers a.example.org with a CNAME chain that crosses several
+// zones, which has to be followed by the plugin hop by hop.
+const records = `
+    scripted {
+        a.example.org. 60 IN CNAME b.example.net.
+        b.example.net. 60 IN CNAME c.example.com.
+        c.example.com. 60 IN A 192.0.2.1
+        dangling.example.org. 60 IN CNAME empty.example.org.
+        empty.example.org. 60 IN TXT "no address"
+        loop1.example.org. 60 IN CNAME loop2.example.org.
+        loop2.example.org. 60 IN CNAME loop1.example.org.
+    }
+`
+
+var mu sync.Mutex
+
+func init() {
+	// Insert the plugin right after the cache plugin, as described in the README.
+	for i, d := range dnsserver.Directives {
+		if d == "cache" {
+			dnsserver.Directives = append(dnsserver.Directives[:i+1], append([]string{pluginName}, dnsserver.Directives[i+1:]...)...)
+			return
+		}
+	}
+	panic("cache directive not found")
+}
+
+// input implements caddy.Input for a Corefile held in a string.
+type input string
+
+func (i input) Body() []byte       { return []byte(i) }
+func (i input) Path() string       { return "Corefile" }
+func (i input) ServerType() string { return "dns" }
+
+// coreDNSServer starts a CoreDNS instance for corefile and returns it with the
+// UDP address of its first server.
+func coreDNSServer(t *testing.T, corefile string) (*caddy.Instance, string) {
+	t.Helper()
+	mu.Lock()
+	defer mu.Unlock()
+	caddy.Quiet = true
+	dnsserver.Quiet = true
+
+	i, err := caddy.Start(input(corefile))
+	if err != nil {
+		t.Fatalf("Could not start CoreDNS server: %s", err)
+	}
+	t.Cleanup(func() { i.Stop() })
+
+	addr := ""
+	if srvs := i.Servers(); len(srvs) > 0 && srvs[0].LocalAddr() != nil {
+		addr = srvs[0].LocalAddr().String()
+	}
+	return i, addr
+}
+
+// freePort returns a TCP port that is currently not in use.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not find a free port: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func query(t *testing.T, addr, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	r, err := dns.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("Expected to receive reply, but didn't: %s", err)
+	}
+	return r
+}
+
+func assertAnswer(t *testing.T, r *dns.Msg, want ...string) {
+	t.Helper()
+	if len(r.Answer) != len(want) {
+		t.Fatalf("Expected %d answers, got %d: %v", len(want), len(r.Answer), r.Answer)
+	}
+	for i, rr := range r.Answer {
+		got := strings.Join(strings.Fields(rr.String()), " ")
+		if got != want[i] {
+			t.Errorf("Expected answer %d to be %q, got %q", i, want[i], got)
+		}
+	}
+}
+
+func assertExtra(t *testing.T, r *dns.Msg, want ...string) {
+	t.Helper()
+	var got []string
+	for _, rr := range r.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			got = append(got, strings.Join(strings.Fields(rr.String()), " "))
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected additional records %q, got %q", want, got)
+	}
+}
+
+func TestSelfLookup(t *testing.T) {
+	_, addr := coreDNSServer(t, `.:0 {
+    finalize_cname
+`+records+`
+}`)
+
+	r := query(t, addr, "a.example.org.", dns.TypeA)
+	assertAnswer(t, r,
+		"a.example.org. 60 IN CNAME b.example.net.",
+		"b.example.net. 60 IN CNAME c.example.com.",
+		"c.example.com. 60 IN A 192.0.2.1",
+	)
+}
+
+func TestDangling(t *testing.T) {
+	_, addr := coreDNSServer(t, `.:0 {
+    finalize_cname
+`+records+`
+}`)
+
+	r := query(t, addr, "dangling.example.org.", dns.TypeA)
+	assertAnswer(t, r, "dangling.example.org. 60 IN CNAME empty.example.org.")
+}
+
+func TestCNAMEQuestion(t *testing.T) {
+	_, addr := coreDNSServer(t, `.:0 {
+    finalize_cname
+`+records+`
+}`)
+
+	r := query(t, addr, "a.example.org.", dns.TypeCNAME)
+	assertAnswer(t, r, "a.example.org. 60 IN CNAME b.example.net.")
+}
+
+func TestStabilityWindow(t *testing.T) {
+	_, addr := coreDNSServer(t, `.:0 {
+    finalize_cname {
+        stability_window 30s
+    }
+`+records+`
+}`)
+
+	r := query(t, addr, "a.example.org.", dns.TypeA)
+	assertAnswer(t, r,
+		"a.example.org. 60 IN CNAME b.example.net.",
+		"b.example.net. 60 IN CNAME c.example.com.",
+		"c.example.com. 60 IN A 192.0.2.1",
+	)
+}
+
+func TestGRPCUpstream(t *testing.T) {
+	port := freePort(t)
+	coreDNSServer(t, fmt.Sprintf(`grpc://.:%d {
+`+records+`
+}`, port))
+
+	_, addr := coreDNSServer(t, fmt.Sprintf(`.:0 {
+    finalize_cname {
+        upstream grpc://127.0.0.1:%d
+    }
+    scripted {
+        a.example.org. 60 IN CNAME b.example.net.
+    }
+}`, port))
+
+	r := query(t, addr, "a.example.org.", dns.TypeA)
+	assertAnswer(t, r,
+		"a.example.org. 60 IN CNAME b.example.net.",
+		"b.example.net. 60 IN CNAME c.example.com.",
+		"c.example.com. 60 IN A 192.0.2.1",
+	)
+}
+
+// TestECS queries without EDNS, which must not get the OPT record added to
+// the lookups for the client subnet.
+func TestECS(t *testing.T) {
+	_, addr := coreDNSServer(t, `.:0 {
+    finalize_cname {
+        ecs
+    }
+`+records+`
+}`)
+
+	r := query(t, addr, "a.example.org.", dns.TypeA)
+	assertAnswer(t, r,
+		"a.example.org. 60 IN CNAME b.example.net.",
+		"b.example.net. 60 IN CNAME c.example.com.",
+		"c.example.com. 60 IN A 192.0.2.1",
+	)
+	if opt := r.IsEdns0(); opt != nil {
+		t.Errorf("Expected no OPT record in the reply, got %v", opt)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.org.", dns.TypeA)
+	m.SetEdns0(1232, false)
+	r, err := dns.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("Expected to receive reply, but didn't: %s", err)
+	}
+	if len(r.Answer) != 3 {
+		t.Errorf("Expected the chain to be finalized, got %v", r.Answer)
+	}
+	if r.IsEdns0() == nil {
+		t.Error("Expected an OPT record in the reply")
+	}
+}
+
+func TestBlockPrivate(t *testing.T) {
+	_, addr := coreDNSServer(t, `.:0 {
+    finalize_cname example.org {
+        block_private
+        mx_additional
+    }
+    scripted {
+        a.example.org. 60 IN CNAME b.example.net.
+        b.example.net. 60 IN A 192.0.2.1
+        private.example.org. 60 IN CNAME internal.example.net.
+        internal.example.net. 60 IN A 100.64.0.1
+        mapped.example.org. 60 IN CNAME mapped.example.net.
+        mapped.example.net. 60 IN AAAA ::ffff:127.0.0.1
+        example.org. 60 IN MX 10 mail.example.org.
+        mail.example.org. 60 IN CNAME internal.example.net.
+    }
+}`)
+
+	r := query(t, addr, "a.example.org.", dns.TypeA)
+	assertAnswer(t, r,
+		"a.example.org. 60 IN CNAME b.example.net.",
+		"b.example.net. 60 IN A 192.0.2.1",
+	)
+
+	r = query(t, addr, "private.example.org.", dns.TypeA)
+	assertAnswer(t, r, "private.example.org. 60 IN CNAME internal.example.net.")
+
+	r = query(t, addr, "mapped.example.org.", dns.TypeAAAA)
+	assertAnswer(t, r, "mapped.example.org. 60 IN CNAME mapped.example.net.")
+
+	r = query(t, addr, "example.org.", dns.TypeMX)
+	assertAnswer(t, r, "example.org. 60 IN MX 10 mail.example.org.")
+	assertExtra(t, r, "mail.example.org. 60 IN CNAME internal.example.net.")
+}
+
+func TestAdditional(t *testing.T) {
+	_, addr := coreDNSServer(t, `.:0 {
+    finalize_cname {
+        srv_additional
+        mx_additional
+    }
+    scripted {
+        _sip._tcp.example.org. 60 IN SRV 10 5 5060 sip.example.org.
+        sip.example.org. 60 IN CNAME host.example.net.
+        host.example.net. 60 IN A 192.0.2.3
+        example.org. 60 IN MX 10 mail.example.org.
+        mail.example.org. 60 IN A 192.0.2.4
+    }
+}`)
+
+	r := query(t, addr, "_sip._tcp.example.org.", dns.TypeSRV)
+	assertAnswer(t, r, "_sip._tcp.example.org. 60 IN SRV 10 5 5060 sip.example.org.")
+	assertExtra(t, r,
+		"sip.example.org. 60 IN CNAME host.example.net.",
+		"host.example.net. 60 IN A 192.0.2.3",
+	)
+
+	r = query(t, addr, "example.org.", dns.TypeMX)
+	assertAnswer(t, r, "example.org. 60 IN MX 10 mail.example.org.")
+	assertExtra(t, r, "mail.example.org. 60 IN A 192.0.2.4")
+}
+
+// TestAdminSettings disables the plugin through the settings endpoint, which
+// must refuse changes without the token, and all changes if no token is set.
+func TestAdminSettings(t *testing.T) {
+	adminAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	_, addr := coreDNSServer(t, `.:0 {
+    finalize_cname {
+        admin `+adminAddr+` secret
+    }
+`+records+`
+}`)
+	openAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	coreDNSServer(t, `.:0 {
+    finalize_cname {
+        admin `+openAddr+`
+    }
+`+records+`
+}`)
+
+	settings := func(method, adminAddr, token, body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://"+adminAddr+"/settings", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Could not create request: %s", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Could not reach the admin server: %s", err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Could not read the settings: %s", err)
+		}
+		return resp.StatusCode, string(b)
+	}
+
+	if code, body := settings(http.MethodGet, adminAddr, "secret", ""); code != http.StatusOK || !strings.Contains(body, `"enabled":true`) {
+		t.Fatalf("Expected the plugin to be enabled, got status %d: %s", code, body)
+	}
+	if code, _ := settings(http.MethodPut, adminAddr, "", `{"enabled":false}`); code != http.StatusUnauthorized {
+		t.Fatalf("Expected the change without token to be refused, got status %d", code)
+	}
+	if code, _ := settings(http.MethodPut, openAddr, "", `{"enabled":false}`); code != http.StatusForbidden {
+		t.Fatalf("Expected the change without a token set to be refused, got status %d", code)
+	}
+	assertAnswer(t, query(t, addr, "a.example.org.", dns.TypeA),
+		"a.example.org. 60 IN CNAME b.example.net.",
+		"b.example.net. 60 IN CNAME c.example.com.",
+		"c.example.com. 60 IN A 192.0.2.1",
+	)
+
+	if code, body := settings(http.MethodPut, adminAddr, "secret", `{"enabled":false}`); code != http.StatusOK {
+		t.Fatalf("Expected the change to be accepted, got status %d: %s", code, body)
+	}
+	assertAnswer(t, query(t, addr, "a.example.org.", dns.TypeA), "a.example.org. 60 IN CNAME b.example.net.")
+}
+
+func TestRoute(t *testing.T) {
+	_, upstreamAddr := coreDNSServer(t, `.:0 {
+    scripted {
+        c.example.com. 60 IN A 192.0.2.2
+    }
+}`)
+
+	_, addr := coreDNSServer(t, `.:0 {
+    finalize_cname {
+        route example.com. `+upstreamAddr+`
+    }
+`+records+`
+}`)
+
+	r := query(t, addr, "a.example.org.", dns.TypeA)
+	assertAnswer(t, r,
+		"a.example.org. 60 IN CNAME b.example.net.",
+		"b.example.net. 60 IN CNAME c.example.com.",
+		"c.example.com. 60 IN A 192.0.2.2",
+	)
+}
+
+// TestInstances runs a block without upstream servers next to one whose
+// upstream server never replies, which has to keep the server from reporting
+// it is ready although the ready plugin only knows the first instance.
+func TestInstances(t *testing.T) {
+	readyAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	_, addr := coreDNSServer(t, fmt.Sprintf(`.:0 {
+    ready %s
+    finalize_cname example.org
+    finalize_cname example.net {
+        upstream 127.0.0.1:%d
+    }
+`+records+`
+}`, readyAddr, freePort(t)))
+
+	r := query(t, addr, "a.example.org.", dns.TypeA)
+	assertAnswer(t, r,
+		"a.example.org. 60 IN CNAME b.example.net.",
+		"b.example.net. 60 IN CNAME c.example.com.",
+		"c.example.com. 60 IN A 192.0.2.1",
+	)
+
+	resp, err := http.Get("http://" + readyAddr + "/ready")
+	if err != nil {
+		t.Fatalf("Could not check readiness: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the server not to be ready, got status %d", resp.StatusCode)
+	}
+}
+
+// TestMaxLookup uses a gRPC upstream, as lookups to the server itself are
+// finalized by the plugin again, each with a limit of its own.
+func TestMaxLookup(t *testing.T) {
+	port := freePort(t)
+	coreDNSServer(t, fmt.Sprintf(`grpc://.:%d {
+`+records+`
+}`, port))
+
+	_, addr := coreDNSServer(t, fmt.Sprintf(`.:0 {
+    finalize_cname {
+        max_lookup 1
+        upstream grpc://127.0.0.1:%d
+    }
+`+records+`
+}`, port))
+
+	r := query(t, addr, "a.example.org.", dns.TypeA)
+	assertAnswer(t, r, "a.example.org. 60 IN CNAME b.example.net.")
+}
+
+func TestCircularReference(t *testing.T) {
+	port := freePort(t)
+	coreDNSServer(t, fmt.Sprintf(`grpc://.:%d {
+`+records+`
+}`, port))
+
+	_, addr := coreDNSServer(t, fmt.Sprintf(`.:0 {
+    finalize_cname {
+        upstream grpc://127.0.0.1:%d
+    }
+`+records+`
+}`, port))
+
+	r := query(t, addr, "loop1.example.org.", dns.TypeA)
+	assertAnswer(t, r, "loop1.example.org. 60 IN CNAME loop2.example.org.")
+}
+
+func TestInvalidCorefile(t *testing.T) {
+	for _, corefile := range []string{
+		".:0 {\n finalize_cname max_lookup -1\n}",
+		".:0 {\n finalize_cname {\n unknown\n }\n}",
+		".:0 {\n finalize_cname {\n upstream grpc://127.0.0.1 127.0.0.2\n }\n}",
+		".:0 {\n finalize_cname {\n route example.com.\n }\n}",
+	} {
+		mu.Lock()
+		i, err := caddy.Start(input(corefile))
+		mu.Unlock()
+		if err == nil {
+			i.Stop()
+			t.Errorf("Expected an error for Corefile %q", corefile)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metricsAddr := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	_, addr := coreDNSServer(t, `.:0 {
+    prometheus `+metricsAddr+`
+    finalize_cname {
+        cache_size 100
+    }
+`+records+`
+}`)
+
+	query(t, addr, "a.example.org.", dns.TypeA)
+	query(t, addr, "dangling.example.org.", dns.TypeA)
+
+	resp, err := http.Get("http://" + metricsAddr + "/metrics")
+	if err != nil {
+		t.Fatalf("Could not scrape metrics: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not read metrics: %s", err)
+	}
+
+	for _, name := range []string{
+		"coredns_finalize_cname_request_count_total",
+		"coredns_finalize_cname_dangling_cname_count_total",
+		"coredns_finalize_cname_request_duration_seconds",
+		"coredns_finalize_cname_next_duration_seconds",
+		"coredns_finalize_cname_chain_depth_bucket",
+		"coredns_finalize_cname_lookup_duration_seconds",
+		"coredns_finalize_cname_outcomes_total",
+		"coredns_finalize_cname_inflight_chains",
+		"coredns_finalize_cname_inflight_lookups",
+		"coredns_finalize_cname_lookups_per_request_bucket",
+		"coredns_finalize_cname_cache_misses_total",
+		"coredns_finalize_cname_cache_entries",
+	} {
+		if !strings.Contains(string(body), name) {
+			t.Errorf("Expected metric %s to be exported", name)
+		}
+	}
+}
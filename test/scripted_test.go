@@ -0,0 +1,73 @@
+package test
+
+import (
+	"context"
+	"strings"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// scripted is a plugin that answers queries from a static list of records
+// without following CNAMEs, so that every hop is left to finalize_cname.
+//
+//	scripted {
+//	    a.example.org. 60 IN CNAME b.example.net.
+//	}
+type scripted struct {
+	Next plugin.Handler
+	rrs  []dns.RR
+}
+
+func init() {
+	plugin.Register("scripted", setupScripted)
+	dnsserver.Directives = append(dnsserver.Directives, "scripted")
+}
+
+func setupScripted(c *caddy.Controller) error {
+	s := &scripted{}
+	for c.Next() {
+		for c.NextBlock() {
+			line := append([]string{c.Val()}, c.RemainingArgs()...)
+			rr, err := dns.NewRR(strings.Join(line, " "))
+			if err != nil {
+				return plugin.Error("scripted", err)
+			}
+			s.rrs = append(s.rrs, rr)
+		}
+	}
+
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		s.Next = next
+		return s
+	})
+	return nil
+}
+
+// ServeDNS implements the plugin.Handler interface.
+func (s *scripted) ServeDNS(_ context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	state := request.Request{W: w, Req: r}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	m.Rcode = dns.RcodeNameError
+	for _, rr := range s.rrs {
+		if !strings.EqualFold(rr.Header().Name, state.QName()) {
+			continue
+		}
+		m.Rcode = dns.RcodeSuccess
+		if rr.Header().Rrtype == state.QType() || rr.Header().Rrtype == dns.TypeCNAME {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+// Name implements the plugin.Handler interface.
+func (s *scripted) Name() string { return "scripted" }
@@ -0,0 +1,132 @@
+package finalize
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTopWindow is the window the most finalized names are counted in.
+	defaultTopWindow = time.Hour
+	// topSlots is the number of slots the window is split into, as it slides
+	// a slot at a time.
+	topSlots = 6
+	// maxTopSlotNames bounds the names counted in a slot, further names are
+	// not counted until the next slot.
+	maxTopSlotNames = 10000
+)
+
+// topTargets counts the heads and terminal targets of the finalized chains
+// over a sliding window, to list the most frequent ones.
+type topTargets struct {
+	n      int
+	window time.Duration
+	now    func() time.Time
+
+	mu    sync.Mutex
+	slots []*topSlot
+}
+
+// topSlot holds the counts of a slot of the window.
+type topSlot struct {
+	start   time.Time
+	heads   map[string]int
+	targets map[string]int
+}
+
+// topEntry is a name and its count, as listed by the top endpoint.
+type topEntry struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// topList is the reply of the top endpoint.
+type topList struct {
+	Window  string     `json:"window"`
+	Heads   []topEntry `json:"heads"`
+	Targets []topEntry `json:"targets"`
+}
+
+func newTopTargets(n int, window time.Duration) *topTargets {
+	return &topTargets{n: n, window: window, now: time.Now}
+}
+
+// add counts a finalized chain from head to target.
+func (t *topTargets) add(head, target string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	slot := t.current()
+	countName(slot.heads, head)
+	countName(slot.targets, target)
+}
+
+// current returns the slot for the current time, starting a new one if
+// needed, and drops the slots that left the window. t.mu must be held.
+func (t *topTargets) current() *topSlot {
+	now := t.now()
+	start := now.Truncate(t.window / topSlots)
+	if len(t.slots) > 0 && t.slots[len(t.slots)-1].start.Equal(start) {
+		return t.slots[len(t.slots)-1]
+	}
+
+	t.slots = slices.DeleteFunc(t.slots, func(s *topSlot) bool { return now.Sub(s.start) >= t.window })
+	slot := &topSlot{start: start, heads: make(map[string]int), targets: make(map[string]int)}
+	t.slots = append(t.slots, slot)
+	return slot
+}
+
+func countName(counts map[string]int, name string) {
+	if _, ok := counts[name]; ok || len(counts) < maxTopSlotNames {
+		counts[name]++
+	}
+}
+
+// list returns the most frequent heads and targets within the window.
+func (t *topTargets) list() topList {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	heads, targets := make(map[string]int), make(map[string]int)
+	for _, s := range t.slots {
+		if now.Sub(s.start) >= t.window {
+			continue
+		}
+		for name, n := range s.heads {
+			heads[name] += n
+		}
+		for name, n := range s.targets {
+			targets[name] += n
+		}
+	}
+	return topList{Window: t.window.String(), Heads: topOf(heads, t.n), Targets: topOf(targets, t.n)}
+}
+
+// topOf returns the n names with the highest counts, ties ordered by name.
+func topOf(counts map[string]int, n int) []topEntry {
+	entries := make([]topEntry, 0, len(counts))
+	for name, count := range counts {
+		entries = append(entries, topEntry{Name: name, Count: count})
+	}
+	slices.SortFunc(entries, func(a, b topEntry) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Name, b.Name)
+	})
+	return entries[:min(n, len(entries))]
+}
+
+// serveTop lists the most frequently finalized heads and targets on GET.
+func (s *Finalize) serveTop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.top.list())
+}
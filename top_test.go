@@ -0,0 +1,75 @@
+package finalize
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestTopTargets(t *testing.T) {
+	now := time.Unix(0, 0)
+	top := newTopTargets(2, time.Minute)
+	top.now = func() time.Time { return now }
+
+	top.add("a.example.com.", "cdn.example.net.")
+	top.add("b.example.com.", "cdn.example.net.")
+	now = now.Add(30 * time.Second)
+	top.add("b.example.com.", "cdn.example.net.")
+	top.add("c.example.com.", "other.example.net.")
+
+	list := top.list()
+	if len(list.Heads) != 2 || list.Heads[0] != (topEntry{"b.example.com.", 2}) || list.Heads[1] != (topEntry{"a.example.com.", 1}) {
+		t.Errorf("Expected the 2 most frequent heads, got %v", list.Heads)
+	}
+	if len(list.Targets) != 2 || list.Targets[0] != (topEntry{"cdn.example.net.", 3}) {
+		t.Errorf("Expected cdn.example.net. as most frequent target, got %v", list.Targets)
+	}
+
+	// the slot of the first two chains leaves the window
+	now = now.Add(40 * time.Second)
+	list = top.list()
+	if len(list.Targets) != 2 || list.Targets[0] != (topEntry{"cdn.example.net.", 1}) {
+		t.Errorf("Expected the counts of the first slot to leave the window, got %v", list.Targets)
+	}
+	top.add("d.example.com.", "cdn.example.net.")
+	if len(top.slots) != 2 {
+		t.Errorf("Expected the slots outside the window to be dropped, got %d", len(top.slots))
+	}
+}
+
+func TestServeTop(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.top = newTopTargets(10, time.Hour)
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	if _, err := f.ServeDNS(context.Background(), dnstest.NewRecorder(&plugintest.ResponseWriter{}), req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	f.serveTop(rec, httptest.NewRequest(http.MethodGet, "/top", nil))
+	var list topList
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("Expected a JSON object, got %v", err)
+	}
+	if len(list.Heads) != 1 || list.Heads[0] != (topEntry{"a.example.com.", 1}) {
+		t.Errorf("Expected head a.example.com., got %v", list.Heads)
+	}
+	if len(list.Targets) != 1 || list.Targets[0] != (topEntry{"b.example.com.", 1}) {
+		t.Errorf("Expected target b.example.com., got %v", list.Targets)
+	}
+}
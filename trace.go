@@ -0,0 +1,71 @@
+package finalize
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// traceIDHeaders are the headers carrying the trace ID when the tracers of
+// the trace plugin, Zipkin and Datadog, inject a span context.
+var traceIDHeaders = []string{"x-b3-traceid", "x-datadog-trace-id"}
+
+// startSpan starts a span named operation as a child of the span in ctx, and
+// returns it along with a context holding it. Without a span in ctx, i.e.
+// when the trace plugin is not active, nil and ctx are returned.
+func startSpan(ctx context.Context, operation string) (ot.Span, context.Context) {
+	parent := ot.SpanFromContext(ctx)
+	if parent == nil {
+		return nil, ctx
+	}
+	span := parent.Tracer().StartSpan(operation, ot.ChildOf(parent.Context()))
+	return span, ot.ContextWithSpan(ctx, span)
+}
+
+// lookupOutcome returns the outcome of a lookup to tag its span with: the
+// rcode of the reply, or error if there is none.
+func lookupOutcome(reply *dns.Msg, err error) string {
+	if err != nil || reply == nil {
+		return "error"
+	}
+	return dns.RcodeToString[reply.Rcode]
+}
+
+// traceID returns the ID of the trace of the span in ctx, or an empty string
+// without a span or for a tracer not injecting one of traceIDHeaders.
+func traceID(ctx context.Context) string {
+	span := ot.SpanFromContext(ctx)
+	if span == nil {
+		return ""
+	}
+	carrier := ot.TextMapCarrier{}
+	if err := span.Tracer().Inject(span.Context(), ot.TextMap, carrier); err != nil {
+		return ""
+	}
+	for key, val := range carrier {
+		for _, header := range traceIDHeaders {
+			if strings.EqualFold(key, header) {
+				return val
+			}
+		}
+	}
+	return ""
+}
+
+// observeDuration observes the time since start with o. While tracing, the
+// ID of the trace is attached to the observation as exemplar, linking the
+// bucket to the trace.
+func observeDuration(ctx context.Context, o prometheus.Observer, start time.Time) {
+	d := time.Since(start).Seconds()
+	if id := traceID(ctx); id != "" {
+		if eo, ok := o.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(d, prometheus.Labels{"trace_id": id})
+			return
+		}
+	}
+	o.Observe(d)
+}
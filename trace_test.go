@@ -0,0 +1,114 @@
+package finalize
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestServeDNSSpans(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.CNAME("b.example.com. 300 IN CNAME c.example.com.")},
+		"c.example.com.": {plugintest.A("c.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	tracer := mocktracer.New()
+	root := tracer.StartSpan("request")
+	ctx := ot.ContextWithSpan(context.Background(), root)
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(ctx, rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// the first span is the one of the next plugin
+	spans := tracer.FinishedSpans()
+	if len(spans) != 4 {
+		t.Fatalf("Expected 4 finished spans, got %d", len(spans))
+	}
+	spans = spans[1:]
+	finalize := spans[2]
+	if finalize.OperationName != pluginName+"/finalize" || finalize.ParentID != root.(*mocktracer.MockSpan).SpanContext.SpanID {
+		t.Errorf("Expected the finalization span as child of the request, got %s", finalize.OperationName)
+	}
+	if outcome := finalize.Tag("outcome"); outcome != outcomeFlattened {
+		t.Errorf("Expected outcome %s, got %v", outcomeFlattened, outcome)
+	}
+	for i, target := range []string{"b.example.com.", "c.example.com."} {
+		span := spans[i]
+		if span.OperationName != pluginName+"/lookup" || span.ParentID != finalize.SpanContext.SpanID {
+			t.Errorf("Expected lookup span %d as child of the finalization span, got %s", i, span.OperationName)
+		}
+		if got := span.Tag("target"); got != target {
+			t.Errorf("Expected target %s, got %v", target, got)
+		}
+		if got := span.Tag("outcome"); got != "NOERROR" {
+			t.Errorf("Expected outcome NOERROR, got %v", got)
+		}
+	}
+}
+
+func TestServeDNSWithoutSpan(t *testing.T) {
+	if span, _ := startSpan(context.Background(), pluginName+"/finalize"); span != nil {
+		t.Errorf("Expected no span without a parent, got %v", span)
+	}
+}
+
+// b3Injector injects the trace ID of a mock span context as Zipkin does.
+type b3Injector struct{}
+
+func (b3Injector) Inject(sc mocktracer.MockSpanContext, carrier interface{}) error {
+	carrier.(ot.TextMapWriter).Set("X-B3-TraceId", fmt.Sprintf("%016x", sc.TraceID))
+	return nil
+}
+
+func TestObserveDuration(t *testing.T) {
+	tracer := mocktracer.New()
+	tracer.RegisterInjector(ot.TextMap, b3Injector{})
+	span := tracer.StartSpan("request")
+	traced := ot.ContextWithSpan(context.Background(), span)
+	want := fmt.Sprintf("%016x", span.(*mocktracer.MockSpan).SpanContext.TraceID)
+
+	tests := []struct {
+		ctx     context.Context
+		traceID string
+	}{
+		{context.Background(), ""},
+		{traced, want},
+	}
+
+	for i, test := range tests {
+		h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test", Buckets: []float64{1}})
+		observeDuration(test.ctx, h, time.Now())
+
+		m := new(dto.Metric)
+		if err := h.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		if n := m.GetHistogram().GetSampleCount(); n != 1 {
+			t.Errorf("Test %d: expected 1 observation, got %d", i, n)
+		}
+		got := ""
+		if exemplar := m.GetHistogram().GetBucket()[0].GetExemplar(); exemplar != nil {
+			got = exemplar.GetLabel()[0].GetValue()
+		}
+		if got != test.traceID {
+			t.Errorf("Test %d: expected exemplar with trace ID %q, got %q", i, test.traceID, got)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package finalize
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+var (
+	errBogus       = errors.New("DNSSEC validation failed")
+	errUnvalidated = errors.New("answer not validated")
+)
+
+// validates reports whether the lookups for the request of state must be
+// validated: in validate mode, unless the client set the CD bit to see the
+// data as is.
+func (s *Finalize) validates(state request.Request) bool {
+	return s.validate && !state.Req.CheckingDisabled
+}
+
+// cacheable reports whether the chains and lookups resolved for the request
+// of state may be cached. Replies to lookups made with the CD bit may hold
+// data that failed validation, which must not be served to other clients.
+func cacheable(state request.Request) bool {
+	return !state.Req.CheckingDisabled
+}
+
+// withDO returns a copy of state with the DO bit set, so that a validating
+// upstream reports whether the reply was validated in the AD bit.
+func withDO(state request.Request) request.Request {
+	req := state.Req.Copy()
+	if o := req.IsEdns0(); o != nil {
+		o.SetDo()
+	} else {
+		req.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return request.Request{W: state.W, Req: req}
+}
+
+// checkValidated returns an error unless the reply to the lookup of name was
+// validated by the upstream. Validating upstreams answer with SERVFAIL when
+// the data is bogus.
+func checkValidated(reply *dns.Msg, name string) error {
+	if reply.Rcode == dns.RcodeServerFailure {
+		return fmt.Errorf("%w for %s", errBogus, name)
+	}
+	if !reply.AuthenticatedData {
+		return fmt.Errorf("%w for %s", errUnvalidated, name)
+	}
+	return nil
+}
+
+// writeValidationFailure answers the request with SERVFAIL and an Extended
+// DNS Error telling why, instead of merging data that failed validation.
+func (s *Finalize) writeValidationFailure(ctx context.Context, w dns.ResponseWriter, state request.Request, err error) (int, error) {
+	validationFailureCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	log.Warningf("Refusing to finalize %s: %v", state.Name(), err)
+	s.audit(state, nil, "failed", err.Error())
+
+	code := dns.ExtendedErrorCodeDNSSECIndeterminate
+	if errors.Is(err, errBogus) {
+		code = dns.ExtendedErrorCodeDNSBogus
+	}
+	m := new(dns.Msg)
+	m.SetRcode(state.Req, dns.RcodeServerFailure)
+	addEDE(m, state, code, err.Error())
+	return s.writeResponse(w, m)
+}
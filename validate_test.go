@@ -0,0 +1,105 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSValidate(t *testing.T) {
+	tests := []struct {
+		authenticated bool
+		rcode         int
+		wantRcode     int
+		wantEDE       uint16
+	}{
+		{true, dns.RcodeSuccess, dns.RcodeSuccess, 0},
+		{false, dns.RcodeSuccess, dns.RcodeServerFailure, dns.ExtendedErrorCodeDNSSECIndeterminate},
+		{false, dns.RcodeServerFailure, dns.RcodeServerFailure, dns.ExtendedErrorCodeDNSBogus},
+	}
+
+	for i, tc := range tests {
+		resolver := &stubResolver{
+			answers: map[string][]dns.RR{
+				"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+			},
+			rcodes:        map[string]int{"b.example.com.": tc.rcode},
+			authenticated: tc.authenticated,
+		}
+
+		f := New()
+		f.Resolver = resolver
+		f.validate = true
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		req.SetEdns0(4096, false)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if rec.Msg.Rcode != tc.wantRcode {
+			t.Errorf("Test %d: expected rcode %s, got %s", i, dns.RcodeToString[tc.wantRcode], dns.RcodeToString[rec.Msg.Rcode])
+		}
+		if tc.wantRcode == dns.RcodeSuccess {
+			if len(rec.Msg.Answer) != 2 {
+				t.Errorf("Test %d: expected the finalized answer, got %v", i, rec.Msg.Answer)
+			}
+			continue
+		}
+		if len(rec.Msg.Answer) != 0 {
+			t.Errorf("Test %d: expected no answer, got %v", i, rec.Msg.Answer)
+		}
+		if ede := edeOf(rec.Msg); ede == nil || ede.InfoCode != tc.wantEDE {
+			t.Errorf("Test %d: expected EDE %d, got %v", i, tc.wantEDE, ede)
+		}
+	}
+}
+
+func TestWithDO(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	state := withDO(request.Request{W: &plugintest.ResponseWriter{}, Req: req})
+	if o := state.Req.IsEdns0(); o == nil || !o.Do() {
+		t.Errorf("Expected the DO bit to be set, got %v", state.Req)
+	}
+	if req.IsEdns0() != nil {
+		t.Errorf("Expected the original request to be left as is, got %v", req)
+	}
+}
+
+func TestServeDNSCheckingDisabled(t *testing.T) {
+	resolver := &stubResolver{answers: map[string][]dns.RR{
+		"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+	}}
+
+	f := New()
+	f.Resolver = resolver
+	f.validate = true
+	f.cache = newChainCache(10, time.Minute)
+	f.hops = newChainCache(10, time.Minute)
+	f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.example.com.", dns.TypeA)
+	req.CheckingDisabled = true
+	rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+	if _, err := f.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// the reply is not validated, but the client asked not to check
+	if rec.Msg.Rcode != dns.RcodeSuccess || len(rec.Msg.Answer) != 2 {
+		t.Errorf("Expected the finalized answer, got %v", rec.Msg)
+	}
+	if f.cache.len() != 0 || f.hops.len() != 0 {
+		t.Errorf("Expected nothing to be cached, got %d chains and %d lookups", f.cache.len(), f.hops.len())
+	}
+}
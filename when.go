@@ -0,0 +1,33 @@
+package finalize
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/plugin/pkg/expression"
+	"github.com/coredns/coredns/request"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// compileWhen compiles a when expression, with the variables and functions
+// of the view plugin, such as metadata(LABEL) and client_ip().
+func compileWhen(input string) (*vm.Program, error) {
+	return expr.Compile(input, expr.Env(expression.DefaultEnv(context.Background(), nil)), expr.DisableBuiltin("type"), expr.AsBool())
+}
+
+// matchesWhen reports whether all when expressions evaluate to true for the
+// request of state. Expressions failing to evaluate count as false.
+func (s *Finalize) matchesWhen(ctx context.Context, state *request.Request) bool {
+	env := expression.DefaultEnv(ctx, state)
+	for _, prog := range s.when {
+		result, err := expr.Run(prog, env)
+		if err != nil {
+			log.Debugf("Failed to evaluate when expression for %s: %v", state.Name(), err)
+			return false
+		}
+		if b, ok := result.(bool); !ok || !b {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package finalize
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	plugintest "github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSWhen(t *testing.T) {
+	// the test response writer has the client address 10.240.0.1
+	tests := []struct {
+		when []string
+		want int
+	}{
+		{nil, 2},
+		{[]string{`metadata('kubernetes/client-namespace') == 'legacy'`}, 2},
+		{[]string{`metadata('kubernetes/client-namespace') == 'default'`}, 1},
+		{[]string{`metadata('kubernetes/client-namespace') == 'legacy'`, `incidr(client_ip(), '10.9.0.0/16')`}, 1},
+		{[]string{`name() == 'a.example.com.'`, `incidr(client_ip(), '10.240.0.0/16')`}, 2},
+		// expressions failing to evaluate count as false
+		{[]string{`incidr(client_ip(), 'nonsense')`}, 1},
+	}
+
+	for i, tc := range tests {
+		resolver := &stubResolver{answers: map[string][]dns.RR{
+			"b.example.com.": {plugintest.A("b.example.com. 300 IN A 192.0.2.1")},
+		}}
+
+		f := New()
+		f.Resolver = resolver
+		for _, input := range tc.when {
+			prog, err := compileWhen(input)
+			if err != nil {
+				t.Fatalf("Test %d: expected no error compiling %s, got %v", i, input, err)
+			}
+			f.when = append(f.when, prog)
+		}
+		f.Next = cnameHandler(plugintest.CNAME("a.example.com. 300 IN CNAME b.example.com."))
+
+		ctx := metadata.ContextWithMetadata(context.Background())
+		metadata.SetValueFunc(ctx, "kubernetes/client-namespace", func() string { return "legacy" })
+
+		req := new(dns.Msg)
+		req.SetQuestion("a.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&plugintest.ResponseWriter{})
+		if _, err := f.ServeDNS(ctx, rec, req); err != nil {
+			t.Fatalf("Test %d: expected no error, got %v", i, err)
+		}
+
+		if len(rec.Msg.Answer) != tc.want {
+			t.Errorf("Test %d: expected %d records, got %v", i, tc.want, rec.Msg.Answer)
+		}
+	}
+}
+
+func TestCompileWhen(t *testing.T) {
+	for _, input := range []string{`name(`, `name()`, `undefined() == 1`} {
+		if _, err := compileWhen(input); err == nil {
+			t.Errorf("Expected an error for %s, got none", input)
+		}
+	}
+}